@@ -1,10 +1,8 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/json"
-	"fmt"
-	"log"
+	"context"
+	"log/slog"
 	"net/http"
 	"strings"
 	"time"
@@ -13,132 +11,122 @@ import (
 	"go.mongodb.org/mongo-driver/v2/mongo"
 )
 
-func handleAnalyticsRoutes(db *mongo.Client) *http.ServeMux {
+func handleAnalyticsRoutes(db *mongo.Client, geo GeoProvider, bots *BotDetector, broker *AnalyticsBroker, notifier Notifier) *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /stats", getStatistics(db))
-	mux.HandleFunc("GET /identify", identify(db))
+	mux.HandleFunc("GET /entries/{collection}", getEntryStatistics(db))
+	mux.HandleFunc("GET /export/events", ensureAuthenticated(exportEvents(db)))
+	mux.HandleFunc("GET /export/stats", ensureAuthenticated(exportStatistics(db)))
+	mux.HandleFunc("POST /reports/weekly", ensureLoggedIn(sendWeeklyReportNow(db, notifier)))
+	mux.HandleFunc("GET /goals", getGoals(db))
+	mux.HandleFunc("POST /goals", ensureLoggedIn(createGoal(db)))
+	mux.HandleFunc("DELETE /goals/{id}", ensureLoggedIn(deleteGoal(db)))
+	mux.HandleFunc("GET /identify", identify(db, geo, bots, broker))
+	mux.HandleFunc("POST /event", recordEvent(db, geo, bots, broker))
+	mux.HandleFunc("GET /live", ensureAuthenticated(streamLiveAnalytics(broker)))
+	mux.HandleFunc("GET /consent", getConsent())
+	mux.HandleFunc("POST /consent", setConsent(db))
+	mux.HandleFunc("GET /visitor", exportVisitorData(db))
+	mux.HandleFunc("DELETE /visitor", eraseVisitorData(db))
 
 	return mux
 }
 
-// Ideally this will be precalculated every so often
-// For now though we'll be manually calculating every aspect of the data to simplify the logic
+// Statistics are read from the rollups precalculated by the rollup job once they cover the range, unless ?source=events is requested
 func getStatistics(db *mongo.Client) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		startDateString := r.URL.Query().Get("start")
-		endDateString := r.URL.Query().Get("end")
-
-		filter := bson.D{}
-		if startDateString != "" {
-			time, err := time.Parse(time.RFC3339, startDateString)
-			if err != nil {
-				log.Printf("Failed to parse start date string with %q", startDateString)
-			} else {
-				filter = append(filter, bson.E{Key: "loggedAt", Value: bson.D{{Key: "$gte", Value: time}}})
-			}
-		}
-
-		if endDateString != "" {
-			time, err := time.Parse(time.RFC3339, endDateString)
-			if err != nil {
-				log.Printf("Failed to parse end date string with %q", endDateString)
-			} else {
-				filter = append(filter, bson.E{Key: "loggedAt", Value: bson.D{{Key: "$lte", Value: time}}})
-			}
+		query, misses := parseStatsQuery(r.Context(), db, r.URL.Query())
+		if len(misses) > 0 {
+			WriteError(w, r, validationError(ErrorCodeInvalidQuery, "Invalid statistics query", misses))
+			return
 		}
 
-		log.Println("Filtering with: ", filter)
-
-		cmsDatabase := db.Database(CMS_DATABASE)
-		results, err := getDBResource(cmsDatabase, CMS_C_ANALYTICS_USERS, filter)
+		statistics, err := collectStatistics(r.Context(), db, query)
 		if err != nil {
-			WriteJSON(w, http.StatusInternalServerError, ResponseMessage{
-				Status:  StatusCodeError,
-				Message: err.Error(),
-			})
+			WriteError(w, r, toAPIError(err, "Error while aggregating statistics"))
 			return
 		}
 
-		totalVisitorsByCountry := make(map[string]int)
-		totalVisits := 0
-		totalUniqueVisits := 0
-
-		for _, analytic := range results {
-			currentVisitCount := int((analytic["visitCount"]).(int32))
-			totalVisits += int((analytic["visitCount"]).(int32))
-			totalUniqueVisits++
-			count, exists := totalVisitorsByCountry[(analytic["countryCode"]).(string)]
-			if exists {
-				totalVisitorsByCountry[(analytic["countryCode"]).(string)] = count + currentVisitCount
-			} else {
-				totalVisitorsByCountry[(analytic["countryCode"]).(string)] = currentVisitCount
-			}
-		}
-
 		WriteJSON(w, http.StatusOK, ResponseMessage{
 			Status: StatusCodeOk,
-			Data: map[string]any{
-				"totalVisitorsByCountry": totalVisitorsByCountry,
-				"totalVisits":            totalVisits,
-				"totalUniqueVisits":      totalUniqueVisits,
-			},
+			Data:   statistics,
 		})
 	}
 }
 
-func identify(db *mongo.Client) http.HandlerFunc {
+func identify(db *mongo.Client, geo GeoProvider, bots *BotDetector, broker *AnalyticsBroker) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		visitor := getCloudflareVisitorDetails(r)
-		if visitor.Ip == "" {
-			visitor.Ip = cleanIpFromPort(r.RemoteAddr)
-			visitor = getIPInfoDetails(visitor.Ip)
-		}
-
-		cookie, err := r.Cookie(visitorCookieKey)
-		if err == nil {
-			visitor.Visited = cookie != nil
+		if doNotTrack(r) {
+			WriteJSON(w, http.StatusOK, ResponseMessage{
+				Status:  StatusCodeOk,
+				Message: "Visitor opted out of tracking",
+			})
+			return
 		}
 
-		cmsDatabase := db.Database(CMS_DATABASE)
-		if visitor.Visited == false {
-			visitor.UserId = rand.Text()
-		} else {
-			visitor.UserId = cookie.Value
-		}
+		isBot, botReason := bots.Classify(r)
+		visitor := locateVisitor(r, geo)
 
-		res, err := getDBResource(cmsDatabase, CMS_C_ANALYTICS_USERS, bson.M{"userId": visitor.UserId})
+		userId, sessionId, err := resolveVisitorIdentity(db, w, r)
 		if err != nil {
-			WriteJSON(w, http.StatusInternalServerError, ResponseMessage{
-				Status:  StatusCodeError,
-				Message: "Error while collecting analytics details: " + err.Error(),
-			})
+			WriteError(w, r, toAPIError(err, "Error while identifying visitor"))
 			return
 		}
 
+		visitor.UserId = userId
+		cmsDatabase := db.Database(CMS_DATABASE)
 		analytic := &Analytic{
 			Ip:          visitor.Ip,
 			UserId:      visitor.UserId,
 			CountryCode: visitor.CountryCode,
+			Region:      visitor.Region,
+			City:        visitor.City,
 			LoggedAt:    time.Now(),
 		}
 
-		if len(res) == 0 {
-			http.SetCookie(w, &http.Cookie{
-				Name:   visitorCookieKey,
-				Value:  visitor.UserId,
-				Secure: true,
-			})
+		// Bots only get a flagged event so they don't count as visitors
+		if isBot == false {
+			res, err := getDBResource(r.Context(), cmsDatabase, CMS_C_ANALYTICS_USERS, bson.M{"userId": visitor.UserId})
+			if err != nil {
+				WriteError(w, r, toAPIError(err, "Error while collecting analytics details"))
+				return
+			}
 
-			analytic.VisitCount = 1
-			createDBResource(cmsDatabase, CMS_C_ANALYTICS_USERS, analytic.ToMap())
+			// Visits are counted by the events, the visit count is left as it was before them
+			if len(res) == 0 {
+				createDBResource(r.Context(), cmsDatabase, CMS_C_ANALYTICS_USERS, analytic.ToMap())
+			} else {
+				changes := analytic.ToMap()
+				delete(changes, "visitCount")
+
+				updateDBResource(r.Context(), cmsDatabase, CMS_C_ANALYTICS_USERS,
+					bson.D{{Key: "userId", Value: visitor.UserId}},
+					bson.M{"$set": changes})
+			}
+		}
+
+		// The page defaults to the one that made the request, the referrer can only be known by the page itself
+		pageUrl := r.URL.Query().Get("url")
+		if pageUrl == "" {
+			pageUrl = r.Referer()
+		}
+
+		event := buildAnalyticsEvent(r, visitor, visitor.UserId, sessionId, pageUrl, r.URL.Query().Get("referrer"))
+		event.IsBot = isBot
+		event.BotReason = botReason
+
+		// An invalid entry shouldn't lose the page view, it's recorded without it
+		collection, entryId := r.URL.Query().Get("collection"), r.URL.Query().Get("entryId")
+		if misses := validateEventEntry(r.Context(), db, collection, entryId); len(misses) == 0 {
+			event.Collection = collection
+			event.EntryId = entryId
 		} else {
-			rawCount, _ := res[0]["visitCount"]
-			count, _ := (rawCount).(int32)
-			analytic.VisitCount = int(count) + 1
+			slog.WarnContext(r.Context(), "Ignoring the entry of identify", "misses", misses)
+		}
 
-			updateDBResource(cmsDatabase, CMS_C_ANALYTICS_USERS,
-				bson.D{{Key: "userId", Value: visitor.UserId}},
-				bson.M{"$set": analytic.ToMap()})
+		// Visitors leaving the page mustn't lose the page view they just made
+		if saveAnalyticsEvent(context.WithoutCancel(r.Context()), db, event) == nil {
+			broker.Publish(event)
 		}
 
 		WriteJSON(w, http.StatusOK, ResponseMessage{
@@ -155,6 +143,8 @@ type Visitor struct {
 	UserId      string
 	Ip          string
 	CountryCode string
+	Region      string
+	City        string
 	Visited     bool
 }
 
@@ -163,6 +153,8 @@ func (v *Visitor) ToMap() map[string]interface{} {
 		"userId":      v.UserId,
 		"ip":          v.Ip,
 		"countryCode": v.CountryCode,
+		"region":      v.Region,
+		"city":        v.City,
 		"visited":     v.Visited,
 	}
 }
@@ -171,8 +163,11 @@ type Analytic struct {
 	UserId      string
 	Ip          string
 	CountryCode string
-	VisitCount  int
-	LoggedAt    time.Time
+	Region      string
+	City        string
+	// Visits recorded before analytics events, only the migration reads it
+	VisitCount int
+	LoggedAt   time.Time
 }
 
 func (a *Analytic) ToMap() map[string]interface{} {
@@ -180,47 +175,27 @@ func (a *Analytic) ToMap() map[string]interface{} {
 		"userId":      a.UserId,
 		"ip":          a.Ip,
 		"countryCode": a.CountryCode,
+		"region":      a.Region,
+		"city":        a.City,
 		"visitCount":  a.VisitCount,
 		"loggedAt":    bson.NewDateTimeFromTime(a.LoggedAt),
 	}
 }
 
+// The region and city headers are only sent when Cloudflare's visitor location headers are enabled.
+// Location headers of requests that didn't come through a trusted proxy are ignored.
 func getCloudflareVisitorDetails(r *http.Request) *Visitor {
-	return &Visitor{
-		Ip:          r.Header.Get("Cf-Connecting-Ip"),
-		CountryCode: r.Header.Get("Cf-Ipcountry"),
-		Visited:     false,
+	visitor := &Visitor{Ip: clientIp(r), Visited: false}
+	if fromTrustedProxy(r) {
+		visitor.CountryCode = r.Header.Get("Cf-Ipcountry")
+		visitor.Region = r.Header.Get("Cf-Region")
+		visitor.City = r.Header.Get("Cf-Ipcity")
 	}
-}
 
-func updateVisitorInfo(db *mongo.Database, visitor *Visitor) {
+	return visitor
 }
 
-func getIPInfoDetails(ip string) *Visitor {
-	visitor := &Visitor{Ip: ip}
-
-	response, err := http.Get(fmt.Sprintf("https://ipinfo.io/%s/json", ip))
-	if err != nil {
-		return visitor
-	}
-
-	var responseBody map[string]string
-	err = json.NewDecoder(response.Body).Decode(&responseBody)
-	if err != nil {
-		return visitor
-	}
-
-	isBogon, exists := responseBody["bogon"]
-	if exists && isBogon == "true" {
-		return visitor
-	}
-
-	country, exists := responseBody["country"]
-	if exists {
-		visitor.CountryCode = country
-	}
-
-	return visitor
+func updateVisitorInfo(db *mongo.Database, visitor *Visitor) {
 }
 
 func cleanIpFromPort(remoteAddr string) string {
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+const (
+	botRateWindow = time.Minute
+	// No person browses a portfolio this fast
+	maxRequestsPerWindow = 60
+	// Visitors getting a new visitor cookie on every request aren't keeping cookies
+	maxCookielessRequestsPerWindow = 10
+	defaultBotTrackerSize          = 10000
+	botPatternsReloadInterval      = time.Minute
+)
+
+// User agent fragments of crawlers, scripts, link previews and uptime monitors, matched case insensitively
+var defaultBotPatterns = []string{
+	`bot\b`, `bot/`, `crawl`, `spider`, `slurp`, `scrap`, `archiver`,
+	`curl/`, `wget/`, `python-requests`, `python-urllib`, `aiohttp`, `httpx`, `go-http-client`, `java/`, `okhttp`,
+	`axios/`, `node-fetch`, `undici`, `libwww`, `headlesschrome`, `phantomjs`, `puppeteer`, `playwright`, `selenium`,
+	`lighthouse`, `pagespeed`, `gtmetrix`, `pingdom`, `uptime`, `statuscake`, `site24x7`, `betteruptime`, `monitor`,
+	`facebookexternalhit`, `embedly`, `whatsapp`, `discord`, `slack`, `telegram`, `skypeuripreview`, `bingpreview`,
+}
+
+// Classifies requests as bots by their user agent and by how they behave.
+// Extra patterns can be added one per line to the patterns file, which is reloaded when it changes.
+type BotDetector struct {
+	mu               sync.RWMutex
+	patterns         []*regexp.Regexp
+	patternsFile     string
+	patternsModified time.Time
+	rates            *LRUCache[string, *requestRate]
+}
+
+type requestRate struct {
+	mu          sync.Mutex
+	windowStart time.Time
+	requests    int
+	cookieless  int
+}
+
+func newBotDetector(patternsFile string) *BotDetector {
+	detector := &BotDetector{
+		patterns:     compileBotPatterns(defaultBotPatterns),
+		patternsFile: patternsFile,
+		rates:        newLRUCache[string, *requestRate](defaultBotTrackerSize),
+	}
+
+	err := detector.Reload()
+	if err != nil {
+		slog.Error("Error while loading bot patterns", "error", err)
+	}
+
+	return detector
+}
+
+// Reloads the patterns file when it changed since it was last read
+func (d *BotDetector) Reload() error {
+	if d.patternsFile == "" {
+		return nil
+	}
+
+	info, err := os.Stat(d.patternsFile)
+	if err != nil {
+		return err
+	}
+
+	d.mu.RLock()
+	unchanged := info.ModTime().Equal(d.patternsModified)
+	d.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	f, err := os.Open(d.patternsFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	patterns := append([]string{}, defaultBotPatterns...)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		patterns = append(patterns, line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	compiled := compileBotPatterns(patterns)
+
+	d.mu.Lock()
+	d.patterns = compiled
+	d.patternsModified = info.ModTime()
+	d.mu.Unlock()
+
+	slog.Info("Loaded bot patterns", "count", len(compiled))
+	return nil
+}
+
+// Periodically picks up changes to the patterns file
+func (d *BotDetector) Job() Job {
+	return Job{
+		Name:     "bot_patterns",
+		Interval: botPatternsReloadInterval,
+		Run: func(ctx context.Context, db *mongo.Client) error {
+			return d.Reload()
+		},
+	}
+}
+
+// Returns whether the request comes from a bot and why
+func (d *BotDetector) Classify(r *http.Request) (bool, string) {
+	userAgent := r.UserAgent()
+	if strings.TrimSpace(userAgent) == "" {
+		return true, "empty user agent"
+	}
+
+	d.mu.RLock()
+	patterns := d.patterns
+	d.mu.RUnlock()
+
+	for _, pattern := range patterns {
+		if pattern.MatchString(userAgent) {
+			return true, "user agent matches " + strings.TrimPrefix(pattern.String(), "(?i)")
+		}
+	}
+
+	_, err := r.Cookie(visitorCookieKey)
+	expectsCookie := useAnalyticsCookies(r)
+	return d.trackRate(clientIp(r)+" "+userAgent, expectsCookie && err != nil)
+}
+
+// Counts the requests of the client in the current window, the fingerprint only lives in memory
+func (d *BotDetector) trackRate(fingerprint string, cookieless bool) (bool, string) {
+	rate, exists := d.rates.Get(fingerprint)
+	if exists == false {
+		rate = &requestRate{windowStart: time.Now()}
+		d.rates.Add(fingerprint, rate)
+	}
+
+	rate.mu.Lock()
+	defer rate.mu.Unlock()
+
+	if time.Since(rate.windowStart) > botRateWindow {
+		rate.windowStart = time.Now()
+		rate.requests = 0
+		rate.cookieless = 0
+	}
+
+	rate.requests++
+	if cookieless {
+		rate.cookieless++
+	}
+
+	if rate.requests > maxRequestsPerWindow {
+		return true, "implausible request rate"
+	}
+
+	if rate.cookieless > maxCookielessRequestsPerWindow {
+		return true, "doesn't keep cookies"
+	}
+
+	return false, ""
+}
+
+func compileBotPatterns(patterns []string) []*regexp.Regexp {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		expression, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			slog.Warn("Skipping invalid bot pattern", "pattern", pattern, "error", err)
+			continue
+		}
+
+		compiled = append(compiled, expression)
+	}
+
+	return compiled
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// Entries can be ranked by any of these fields
+var entrySortFields = map[string]string{
+	"views":    "views",
+	"readers":  "uniqueReaders",
+	"readTime": "averageReadTime",
+}
+
+type EntryStatistics struct {
+	EntryId string `bson:"entryId" json:"entryId"`
+	// Read from the entry's title attribute, empty when the entry was deleted
+	Title         string `bson:"title" json:"title"`
+	Deleted       bool   `bson:"deleted" json:"deleted"`
+	Views         int    `bson:"views" json:"views"`
+	UniqueReaders int    `bson:"uniqueReaders" json:"uniqueReaders"`
+	// Seconds, the average is per view
+	TotalReadTime   float64 `bson:"totalReadTime" json:"totalReadTime"`
+	AverageReadTime float64 `bson:"averageReadTime" json:"averageReadTime"`
+	// Percentage, averaged over the visits of the entry
+	AverageScrollDepth float64 `bson:"averageScrollDepth" json:"averageScrollDepth"`
+}
+
+// Ranks the entries of a collection by views, unique readers or average read time (?sort=).
+// Takes the same range, limit and includeBots parameters as the statistics, but always reads the raw events.
+// Those are deleted after the retention period, so the default range is cut at the retention cutoff
+// and ranges starting before it are rejected.
+func getEntryStatistics(db *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		collectionPath := r.PathValue("collection")
+
+		query, misses := parseStatsQuery(r.Context(), db, r.URL.Query())
+		query.Source = StatsSourceEvents
+
+		if start, shortened := query.retainedStart(); shortened {
+			if r.URL.Query().Get("start") != "" {
+				misses["start"] = fmt.Sprintf("Events before %v were deleted after the retention period", start.Format(time.RFC3339))
+			}
+
+			query.Start = start
+			if query.Start.Before(query.End) == false {
+				misses["end"] = fmt.Sprintf("Events before %v were deleted after the retention period", start.Format(time.RFC3339))
+			}
+		}
+
+		sortBy := r.URL.Query().Get("sort")
+		if sortBy == "" {
+			sortBy = "views"
+		}
+
+		if _, exists := entrySortFields[sortBy]; exists == false {
+			misses["sort"] = "Must be one of views, readers or readTime"
+		}
+
+		if len(misses) > 0 {
+			WriteError(w, r, validationError(ErrorCodeInvalidQuery, "Invalid entry statistics query", misses))
+			return
+		}
+
+		attributes, err := getCollectionAttributes(r.Context(), db, collectionPath)
+		if err != nil {
+			WriteError(w, r, toAPIError(err, "Error while getting the collection"))
+			return
+		}
+
+		pipeline := entryStatisticsPipeline(query, collectionPath, titleAttribute(attributes), entrySortFields[sortBy])
+		entries, err := aggregateDBResource[EntryStatistics](r.Context(), db.Database(CMS_DATABASE), CMS_C_ANALYTICS_EVENTS, pipeline)
+		if err != nil {
+			WriteError(w, r, toAPIError(err, "Error while aggregating entry statistics"))
+			return
+		}
+
+		WriteJSON(w, http.StatusOK, ResponseMessage{
+			Status: StatusCodeOk,
+			Data: map[string]any{
+				"range":      query.Range(),
+				"collection": collectionPath,
+				"sort":       sortBy,
+				"entries":    entries,
+			},
+		})
+	}
+}
+
+// Page views and engagement beacons are first summed per visit, so the scroll depth of a visit is the furthest it reached
+func entryStatisticsPipeline(stats *StatsQuery, collectionPath string, title string, sortField string) bson.A {
+	match := bson.D{
+		{Key: "collection", Value: collectionPath},
+		{Key: "entryId", Value: bson.D{{Key: "$ne", Value: ""}}},
+		{Key: "type", Value: bson.D{{Key: "$in", Value: bson.A{string(AnalyticsEventPageView), string(AnalyticsEventEngagement)}}}},
+		{Key: "timestamp", Value: bson.D{
+			{Key: "$gte", Value: bson.NewDateTimeFromTime(stats.Start)},
+			{Key: "$lt", Value: bson.NewDateTimeFromTime(stats.End)},
+		}},
+	}
+
+	if stats.IncludeBots == false {
+		match = append(match, bson.E{Key: "isBot", Value: bson.D{{Key: "$ne", Value: true}}})
+	}
+
+	titleValue := any("")
+	if title != "" {
+		titleValue = "$" + title
+	}
+
+	return bson.A{
+		bson.D{{Key: "$match", Value: match}},
+		visitKeyStage(),
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{{Key: "entryId", Value: "$entryId"}, {Key: "visit", Value: "$visitKey"}}},
+			{Key: "views", Value: bson.D{{Key: "$sum", Value: bson.D{{Key: "$cond", Value: bson.A{
+				bson.D{{Key: "$eq", Value: bson.A{"$type", string(AnalyticsEventPageView)}}}, 1, 0,
+			}}}}}},
+			{Key: "readTime", Value: bson.D{{Key: "$sum", Value: "$readTime"}}},
+			{Key: "scrollDepth", Value: bson.D{{Key: "$max", Value: "$scrollDepth"}}},
+			{Key: "userId", Value: bson.D{{Key: "$first", Value: "$userId"}}},
+		}}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$_id.entryId"},
+			{Key: "views", Value: bson.D{{Key: "$sum", Value: "$views"}}},
+			{Key: "readers", Value: bson.D{{Key: "$addToSet", Value: "$userId"}}},
+			{Key: "readTime", Value: bson.D{{Key: "$sum", Value: "$readTime"}}},
+			{Key: "scrollDepth", Value: bson.D{{Key: "$avg", Value: "$scrollDepth"}}},
+		}}},
+		bson.D{{Key: "$project", Value: bson.D{
+			{Key: "_id", Value: 0},
+			{Key: "entryId", Value: "$_id"},
+			{Key: "views", Value: 1},
+			{Key: "uniqueReaders", Value: bson.D{{Key: "$size", Value: "$readers"}}},
+			{Key: "totalReadTime", Value: "$readTime"},
+			{Key: "averageReadTime", Value: bson.D{{Key: "$cond", Value: bson.A{
+				bson.D{{Key: "$gt", Value: bson.A{"$views", 0}}},
+				bson.D{{Key: "$divide", Value: bson.A{"$readTime", "$views"}}},
+				0,
+			}}}},
+			{Key: "averageScrollDepth", Value: bson.D{{Key: "$ifNull", Value: bson.A{"$scrollDepth", 0}}}},
+		}}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: sortField, Value: -1}, {Key: "entryId", Value: 1}}}},
+		bson.D{{Key: "$limit", Value: stats.Limit}},
+		bson.D{{Key: "$lookup", Value: bson.D{
+			{Key: "from", Value: collectionPath},
+			{Key: "let", Value: bson.D{{Key: "id", Value: bson.D{{Key: "$convert", Value: bson.D{
+				{Key: "input", Value: "$entryId"},
+				{Key: "to", Value: "objectId"},
+				{Key: "onError", Value: nil},
+			}}}}}},
+			{Key: "pipeline", Value: bson.A{
+				bson.D{{Key: "$match", Value: bson.D{{Key: "$expr", Value: bson.D{{Key: "$eq", Value: bson.A{"$_id", "$$id"}}}}}}},
+				bson.D{{Key: "$project", Value: bson.D{{Key: "title", Value: titleValue}}}},
+			}},
+			{Key: "as", Value: "entry"},
+		}}},
+		bson.D{{Key: "$addFields", Value: bson.D{
+			{Key: "title", Value: bson.D{{Key: "$ifNull", Value: bson.A{bson.D{{Key: "$first", Value: "$entry.title"}}, ""}}}},
+			{Key: "deleted", Value: bson.D{{Key: "$eq", Value: bson.A{bson.D{{Key: "$size", Value: "$entry"}}, 0}}}},
+		}}},
+		bson.D{{Key: "$project", Value: bson.D{{Key: "entry", Value: 0}}}},
+	}
+}
+
+// Entries are named by their title or name attribute, falling back to the first string attribute
+func titleAttribute(attributes []CollectionAttribute) string {
+	for _, attribute := range attributes {
+		name := strings.ToLower(attribute.Name)
+		if name == "title" || name == "name" {
+			return attribute.Name
+		}
+	}
+
+	for _, attribute := range attributes {
+		if attribute.Type == CollectionAttrTypeString {
+			return attribute.Name
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+const sessionCookieKey = "sessionId"
+
+// A session ends after this long without any event
+const sessionLifetime = 30 * time.Minute
+
+type AnalyticsEventType string
+
+const (
+	AnalyticsEventPageView AnalyticsEventType = "pageview"
+	// Sent by the page while it's read, each beacon carries the read time since the previous one
+	AnalyticsEventEngagement AnalyticsEventType = "engagement"
+	// Named events sent by the site, like a click on "Contact me"
+	AnalyticsEventCustom AnalyticsEventType = "custom"
+	// Sent when a visitor follows a link to another site
+	AnalyticsEventOutbound AnalyticsEventType = "outbound"
+)
+
+var ValidAnalyticsEventTypes = map[AnalyticsEventType]bool{
+	AnalyticsEventPageView:   true,
+	AnalyticsEventEngagement: true,
+	AnalyticsEventCustom:     true,
+	AnalyticsEventOutbound:   true,
+}
+
+const (
+	maxEventNameLength     = 64
+	maxEventProperties     = 10
+	maxEventPropertyLength = 100
+)
+
+// Longer read times in a single beacon come from pages left open in the background
+const maxEngagementReadTime = 30 * 60
+
+var analyticsEventIndexes = []mongo.IndexModel{
+	{Keys: bson.D{{Key: "timestamp", Value: 1}}},
+	{Keys: bson.D{{Key: "userId", Value: 1}, {Key: "timestamp", Value: 1}}},
+	{Keys: bson.D{{Key: "sessionId", Value: 1}}},
+	{Keys: bson.D{{Key: "path", Value: 1}, {Key: "timestamp", Value: 1}}},
+	{Keys: bson.D{{Key: "collection", Value: 1}, {Key: "entryId", Value: 1}, {Key: "timestamp", Value: 1}}},
+	{Keys: bson.D{{Key: "type", Value: 1}, {Key: "name", Value: 1}, {Key: "timestamp", Value: 1}}},
+}
+
+// A single, never updated, occurrence of something a visitor did
+type AnalyticsEvent struct {
+	Type      AnalyticsEventType
+	UserId    string
+	SessionId string
+	Path      string
+	// The collection entry shown by the page, if any
+	Collection string
+	EntryId    string
+	// Seconds read and the furthest scrolled percentage, only set on engagement events
+	ReadTime    float64
+	ScrollDepth float64
+	// The name and properties of custom events
+	Name       string
+	Properties map[string]string
+	// The host of the link followed by outbound events
+	OutboundDomain string
+	// Only the host of the referring page is kept
+	Referrer        string
+	Utm             UTMParameters
+	UserAgentFamily string
+	CountryCode     string
+	Region          string
+	City            string
+	Timestamp       time.Time
+	IsBot           bool
+	// Why the visitor was classified as a bot
+	BotReason string
+	// Set on events created from the visitor records that predate events
+	Migrated bool
+}
+
+func (e *AnalyticsEvent) ToMap() map[string]interface{} {
+	return map[string]interface{}{
+		"type":            string(e.Type),
+		"userId":          e.UserId,
+		"sessionId":       e.SessionId,
+		"path":            e.Path,
+		"collection":      e.Collection,
+		"entryId":         e.EntryId,
+		"readTime":        e.ReadTime,
+		"scrollDepth":     e.ScrollDepth,
+		"name":            e.Name,
+		"properties":      e.Properties,
+		"outboundDomain":  e.OutboundDomain,
+		"referrer":        e.Referrer,
+		"utm":             e.Utm.ToMap(),
+		"userAgentFamily": e.UserAgentFamily,
+		"countryCode":     e.CountryCode,
+		"region":          e.Region,
+		"city":            e.City,
+		"timestamp":       bson.NewDateTimeFromTime(e.Timestamp),
+		"isBot":           e.IsBot,
+		"botReason":       e.BotReason,
+		"migrated":        e.Migrated,
+	}
+}
+
+type UTMParameters struct {
+	Source   string
+	Medium   string
+	Campaign string
+	Term     string
+	Content  string
+}
+
+func parseUTMParameters(query url.Values) UTMParameters {
+	return UTMParameters{
+		Source:   query.Get("utm_source"),
+		Medium:   query.Get("utm_medium"),
+		Campaign: query.Get("utm_campaign"),
+		Term:     query.Get("utm_term"),
+		Content:  query.Get("utm_content"),
+	}
+}
+
+func (u UTMParameters) ToMap() map[string]interface{} {
+	return map[string]interface{}{
+		"source":   u.Source,
+		"medium":   u.Medium,
+		"campaign": u.Campaign,
+		"term":     u.Term,
+		"content":  u.Content,
+	}
+}
+
+type AnalyticsEventBody struct {
+	Type AnalyticsEventType `json:"type"`
+	// The url (or path) of the page, UTM parameters are read from its query
+	Url        string `json:"url"`
+	Referrer   string `json:"referrer"`
+	Collection string `json:"collection"`
+	EntryId    string `json:"entryId"`
+	// Only read from engagement events
+	ReadTime    float64 `json:"readTime"`
+	ScrollDepth float64 `json:"scrollDepth"`
+	// Only read from custom events
+	Name       string            `json:"name"`
+	Properties map[string]string `json:"properties"`
+	// The url of the followed link, only read from outbound events
+	Target string `json:"target"`
+}
+
+func (a AnalyticsEventBody) Validate(r *http.Request, db *mongo.Client) (Misses, error) {
+	misses := make(Misses, 0)
+
+	if a.Type != "" {
+		if _, exists := ValidAnalyticsEventTypes[a.Type]; exists == false {
+			misses["type"] = "Must be a valid event type"
+		}
+	}
+
+	if _, err := url.Parse(a.Url); err != nil || a.Url == "" {
+		misses["url"] = "Must be the url of the page"
+	}
+
+	for key, miss := range validateEventEntry(r.Context(), db, a.Collection, a.EntryId) {
+		misses[key] = miss
+	}
+
+	if a.ReadTime < 0 || a.ReadTime > maxEngagementReadTime {
+		misses["readTime"] = fmt.Sprintf("Must be between 0 and %v seconds", maxEngagementReadTime)
+	}
+
+	if a.ScrollDepth < 0 || a.ScrollDepth > 100 {
+		misses["scrollDepth"] = "Must be a percentage between 0 and 100"
+	}
+
+	if a.Type == AnalyticsEventCustom && (a.Name == "" || len(a.Name) > maxEventNameLength) {
+		misses["name"] = fmt.Sprintf("Must be a name of at most %v characters", maxEventNameLength)
+	}
+
+	if len(a.Properties) > maxEventProperties {
+		misses["properties"] = fmt.Sprintf("Must have at most %v properties", maxEventProperties)
+	}
+
+	for key, value := range a.Properties {
+		if len(key) > maxEventPropertyLength || len(value) > maxEventPropertyLength {
+			misses["properties"] = fmt.Sprintf("Keys and values must be at most %v characters", maxEventPropertyLength)
+		}
+	}
+
+	if a.Type == AnalyticsEventOutbound {
+		if target, err := url.Parse(a.Target); err != nil || target.Hostname() == "" {
+			misses["target"] = "Must be the absolute url of the followed link"
+		}
+	}
+
+	return misses, nil
+}
+
+// Entries are optional, but must belong to an existing collection when they're given
+func validateEventEntry(ctx context.Context, db *mongo.Client, collection string, entryId string) Misses {
+	misses := make(Misses, 0)
+	if collection == "" && entryId == "" {
+		return misses
+	}
+
+	if _, err := bson.ObjectIDFromHex(entryId); err != nil {
+		misses["entryId"] = "Must be the id of an entry of the collection"
+	}
+
+	if _, err := getCollectionAttributes(ctx, db, collection); err != nil {
+		misses["collection"] = "Must be the path of an existing collection"
+	}
+
+	return misses
+}
+
+// Records an event sent either with fetch or navigator.sendBeacon.
+// Beacons can't set a JSON content type, so the body is parsed as JSON regardless of it.
+func recordEvent(db *mongo.Client, geo GeoProvider, bots *BotDetector, broker *AnalyticsBroker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, _, err := ReadBodyJSON[AnalyticsEventBody](r, db)
+		if err != nil {
+			WriteError(w, r, toAPIError(err, "Error while validating the event"))
+			return
+		}
+
+		if doNotTrack(r) {
+			WriteJSON(w, http.StatusAccepted, ResponseMessage{Status: StatusCodeOk, Message: "Visitor opted out of tracking"})
+			return
+		}
+
+		event, err := newAnalyticsEvent(db, geo, bots, w, r, body.Url, body.Referrer)
+		if err != nil {
+			WriteError(w, r, toAPIError(err, "Error while identifying visitor"))
+			return
+		}
+
+		if body.Type != "" {
+			event.Type = body.Type
+		}
+
+		event.Collection = body.Collection
+		event.EntryId = body.EntryId
+		switch event.Type {
+		case AnalyticsEventEngagement:
+			event.ReadTime = body.ReadTime
+			event.ScrollDepth = body.ScrollDepth
+		case AnalyticsEventCustom:
+			event.Name = body.Name
+			event.Properties = body.Properties
+		case AnalyticsEventOutbound:
+			target, _ := url.Parse(body.Target)
+			event.OutboundDomain = strings.TrimPrefix(strings.ToLower(target.Hostname()), "www.")
+		}
+
+		// Beacons are sent as the page unloads, the visitor going away mustn't cancel saving them
+		err = saveAnalyticsEvent(context.WithoutCancel(r.Context()), db, event)
+		if err != nil {
+			WriteError(w, r, toAPIError(err, "Error while recording event"))
+			return
+		}
+
+		broker.Publish(event)
+		WriteJSON(w, http.StatusAccepted, ResponseMessage{Status: StatusCodeOk, Message: "Recorded event"})
+	}
+}
+
+// Builds a page view for the visitor making the request, assigning them a visitor and session cookie if they're allowed
+func newAnalyticsEvent(
+	db *mongo.Client,
+	geo GeoProvider,
+	bots *BotDetector,
+	w http.ResponseWriter,
+	r *http.Request,
+	pageUrl string,
+	referrer string,
+) (*AnalyticsEvent, error) {
+	isBot, botReason := bots.Classify(r)
+
+	userId, sessionId, err := resolveVisitorIdentity(db, w, r)
+	if err != nil {
+		return nil, err
+	}
+
+	event := buildAnalyticsEvent(r, locateVisitor(r, geo), userId, sessionId, pageUrl, referrer)
+	event.IsBot = isBot
+	event.BotReason = botReason
+	return event, nil
+}
+
+func buildAnalyticsEvent(r *http.Request, visitor *Visitor, userId string, sessionId string, pageUrl string, referrer string) *AnalyticsEvent {
+	event := &AnalyticsEvent{
+		Type:            AnalyticsEventPageView,
+		UserId:          userId,
+		SessionId:       sessionId,
+		UserAgentFamily: userAgentFamily(r.UserAgent()),
+		CountryCode:     visitor.CountryCode,
+		Region:          visitor.Region,
+		City:            visitor.City,
+		Timestamp:       time.Now(),
+	}
+
+	page, err := url.Parse(pageUrl)
+	if err == nil {
+		event.Path = page.Path
+		event.Utm = parseUTMParameters(page.Query())
+	}
+
+	referrerUrl, err := url.Parse(referrer)
+	if err == nil && referrerUrl.Host != "" && (page == nil || referrerUrl.Host != page.Host) {
+		event.Referrer = strings.TrimPrefix(referrerUrl.Hostname(), "www.")
+	}
+
+	return event
+}
+
+func saveAnalyticsEvent(ctx context.Context, db *mongo.Client, event *AnalyticsEvent) error {
+	_, err := createDBResource(ctx, db.Database(CMS_DATABASE), CMS_C_ANALYTICS_EVENTS, event.ToMap())
+	if err != nil {
+		slog.ErrorContext(ctx, "Error while saving analytics event", "error", err)
+	}
+
+	return err
+}
+
+// Returns the visitor id from the visitor cookie, assigning a new one if it's missing
+func resolveVisitorId(w http.ResponseWriter, r *http.Request) string {
+	cookie, err := r.Cookie(visitorCookieKey)
+	if err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+
+	userId := rand.Text()
+	http.SetCookie(w, &http.Cookie{
+		Name:   visitorCookieKey,
+		Value:  userId,
+		Secure: true,
+	})
+
+	return userId
+}
+
+// Returns the current session id, every event extends the session by the session lifetime
+func resolveSessionId(w http.ResponseWriter, r *http.Request) string {
+	sessionId := ""
+	cookie, err := r.Cookie(sessionCookieKey)
+	if err == nil && cookie.Value != "" {
+		sessionId = cookie.Value
+	} else {
+		sessionId = rand.Text()
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:   sessionCookieKey,
+		Value:  sessionId,
+		MaxAge: int(sessionLifetime.Seconds()),
+		Secure: true,
+	})
+
+	return sessionId
+}
+
+// Finds the visitor's location from the Cloudflare headers, falling back to the GeoIP provider.
+// In privacy mode the IP is truncated before the lookup and in the returned visitor.
+func locateVisitor(r *http.Request, geo GeoProvider) *Visitor {
+	visitor := getCloudflareVisitorDetails(r)
+	if visitor.Ip == "" {
+		visitor.Ip = cleanIpFromPort(r.RemoteAddr)
+	}
+
+	visitor.Ip = anonymizeIp(visitor.Ip)
+	if visitor.CountryCode == "" {
+		location := locateIp(r.Context(), geo, visitor.Ip)
+		visitor.CountryCode = location.CountryCode
+		visitor.Region = location.Region
+		visitor.City = location.City
+	}
+
+	return visitor
+}
+
+// Order matters as most browsers include the names of the browsers they're based on
+var userAgentFamilies = []struct {
+	Token  string
+	Family string
+}{
+	{"Edg/", "Edge"},
+	{"EdgA/", "Edge"},
+	{"OPR/", "Opera"},
+	{"SamsungBrowser/", "Samsung Internet"},
+	{"Firefox/", "Firefox"},
+	{"FxiOS/", "Firefox"},
+	{"CriOS/", "Chrome"},
+	{"Chrome/", "Chrome"},
+	{"Safari/", "Safari"},
+}
+
+func userAgentFamily(userAgent string) string {
+	for _, family := range userAgentFamilies {
+		if strings.Contains(userAgent, family.Token) {
+			return family.Family
+		}
+	}
+
+	if userAgent == "" {
+		return "Unknown"
+	}
+
+	return "Other"
+}
+
+// Creates one event per recorded visit of each visitor.
+// Only the last visit time was ever kept, so every migrated visit is placed at that time.
+// Visit counts stopped growing once events were recorded, so running it again never counts those visits.
+func migrateVisitorsToEvents(ctx context.Context, db *mongo.Client) error {
+	cmsDatabase := db.Database(CMS_DATABASE)
+	visitors, err := getDBResource(ctx, cmsDatabase, CMS_C_ANALYTICS_USERS, bson.D{})
+	if err != nil {
+		return err
+	}
+
+	events := make([]interface{}, 0, len(visitors))
+	for _, visitor := range visitors {
+		event := &AnalyticsEvent{Type: AnalyticsEventPageView, Migrated: true, UserAgentFamily: "Unknown"}
+		event.UserId, _ = visitor["userId"].(string)
+		event.CountryCode, _ = visitor["countryCode"].(string)
+		if loggedAt, ok := visitor["loggedAt"].(bson.DateTime); ok {
+			event.Timestamp = loggedAt.Time()
+		}
+
+		// Visitors first seen after events were recorded have every visit as an event already
+		visitCount := 1
+		if count, ok := visitor["visitCount"].(int32); ok {
+			visitCount = int(count)
+		}
+
+		for range visitCount {
+			events = append(events, event.ToMap())
+		}
+	}
+
+	if len(events) == 0 {
+		return nil
+	}
+
+	// A run that failed halfway (or wasn't recorded) left some migrated events behind,
+	// they're replaced so running it again never counts a visit twice
+	_, err = deleteDBResources(ctx, cmsDatabase, CMS_C_ANALYTICS_EVENTS, bson.M{"migrated": true})
+	if err != nil && errors.As(err, new(*DBNotFoundError)) == false {
+		return err
+	}
+
+	inserted, err := createDBResources(ctx, cmsDatabase, CMS_C_ANALYTICS_EVENTS, events)
+	if err != nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "Migrated visitors into analytics events", "visitors", len(visitors), "events", inserted)
+	return nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+type ExportFormat string
+
+const (
+	ExportFormatCSV  ExportFormat = "csv"
+	ExportFormatJSON ExportFormat = "json"
+)
+
+// An analytics event as it's exported, the UTM parameters are flattened for CSV
+type ExportedEvent struct {
+	Timestamp       time.Time         `bson:"timestamp" json:"timestamp"`
+	Type            string            `bson:"type" json:"type"`
+	UserId          string            `bson:"userId" json:"userId"`
+	SessionId       string            `bson:"sessionId" json:"sessionId"`
+	Path            string            `bson:"path" json:"path"`
+	Collection      string            `bson:"collection" json:"collection"`
+	EntryId         string            `bson:"entryId" json:"entryId"`
+	Referrer        string            `bson:"referrer" json:"referrer"`
+	Utm             ExportedUtm       `bson:"utm" json:"utm"`
+	UserAgentFamily string            `bson:"userAgentFamily" json:"userAgentFamily"`
+	CountryCode     string            `bson:"countryCode" json:"countryCode"`
+	Region          string            `bson:"region" json:"region"`
+	City            string            `bson:"city" json:"city"`
+	ReadTime        float64           `bson:"readTime" json:"readTime"`
+	ScrollDepth     float64           `bson:"scrollDepth" json:"scrollDepth"`
+	Name            string            `bson:"name" json:"name"`
+	Properties      map[string]string `bson:"properties" json:"properties"`
+	OutboundDomain  string            `bson:"outboundDomain" json:"outboundDomain"`
+	IsBot           bool              `bson:"isBot" json:"isBot"`
+	BotReason       string            `bson:"botReason" json:"botReason"`
+	Migrated        bool              `bson:"migrated" json:"migrated"`
+}
+
+type ExportedUtm struct {
+	Source   string `bson:"source" json:"source"`
+	Medium   string `bson:"medium" json:"medium"`
+	Campaign string `bson:"campaign" json:"campaign"`
+	Term     string `bson:"term" json:"term"`
+	Content  string `bson:"content" json:"content"`
+}
+
+var exportedEventColumns = []string{
+	"timestamp", "type", "userId", "sessionId", "path", "collection", "entryId", "referrer",
+	"utmSource", "utmMedium", "utmCampaign", "utmTerm", "utmContent",
+	"userAgentFamily", "countryCode", "region", "city", "readTime", "scrollDepth",
+	"name", "properties", "outboundDomain", "isBot", "botReason", "migrated",
+}
+
+// Text cells are sent by visitors, they're escaped so spreadsheets don't run them as formulas
+func (e *ExportedEvent) Row() []string {
+	properties := ""
+	if len(e.Properties) > 0 {
+		encoded, _ := json.Marshal(e.Properties)
+		properties = string(encoded)
+	}
+
+	return []string{
+		e.Timestamp.UTC().Format(time.RFC3339), csvCell(e.Type), csvCell(e.UserId), csvCell(e.SessionId),
+		csvCell(e.Path), csvCell(e.Collection), csvCell(e.EntryId), csvCell(e.Referrer),
+		csvCell(e.Utm.Source), csvCell(e.Utm.Medium), csvCell(e.Utm.Campaign), csvCell(e.Utm.Term), csvCell(e.Utm.Content),
+		csvCell(e.UserAgentFamily), csvCell(e.CountryCode), csvCell(e.Region), csvCell(e.City),
+		strconv.FormatFloat(e.ReadTime, 'f', -1, 64), strconv.FormatFloat(e.ScrollDepth, 'f', -1, 64),
+		csvCell(e.Name), csvCell(properties), csvCell(e.OutboundDomain), strconv.FormatBool(e.IsBot), csvCell(e.BotReason),
+		strconv.FormatBool(e.Migrated),
+	}
+}
+
+// Prefixes text starting like a formula (=, +, -, @, tab or carriage return) with a quote
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+
+	return value
+}
+
+func parseExportFormat(r *http.Request, misses Misses) ExportFormat {
+	format := ExportFormat(r.URL.Query().Get("format"))
+	switch format {
+	case "":
+		return ExportFormatCSV
+	case ExportFormatCSV, ExportFormatJSON:
+		return format
+	default:
+		misses["format"] = "Must be either csv or json"
+		return format
+	}
+}
+
+func setExportHeaders(w http.ResponseWriter, name string, stats *StatsQuery, format ExportFormat) {
+	contentType := "text/csv; charset=utf-8"
+	if format == ExportFormatJSON {
+		contentType = "application/json"
+	}
+
+	filename := fmt.Sprintf("analytics-%v-%v-%v.%v", name, stats.Start.Format(time.DateOnly), stats.End.Format(time.DateOnly), format)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", filename))
+}
+
+// Streams the raw events of the range (start and end, like the statistics) as CSV or a JSON array.
+// Bots are excluded unless includeBots is set.
+func exportEvents(db *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats, misses := parseStatsQuery(r.Context(), db, r.URL.Query())
+		format := parseExportFormat(r, misses)
+		if len(misses) > 0 {
+			WriteError(w, r, validationError(ErrorCodeInvalidQuery, "Invalid export query", misses))
+			return
+		}
+
+		filter := bson.D{{Key: "timestamp", Value: bson.D{
+			{Key: "$gte", Value: bson.NewDateTimeFromTime(stats.Start)},
+			{Key: "$lt", Value: bson.NewDateTimeFromTime(stats.End)},
+		}}}
+
+		if stats.IncludeBots == false {
+			filter = append(filter, bson.E{Key: "isBot", Value: bson.D{{Key: "$ne", Value: true}}})
+		}
+
+		// Large exports take longer than the server's write timeout
+		http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+		setExportHeaders(w, "events", stats, format)
+		w.WriteHeader(http.StatusOK)
+
+		// Once streaming started the status can't change anymore, errors can only end the body early
+		var err error
+		sort := options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}})
+		if format == ExportFormatJSON {
+			count := 0
+			fmt.Fprint(w, "[")
+			err = forEachDBResource(r.Context(), db.Database(CMS_DATABASE), CMS_C_ANALYTICS_EVENTS, filter, func(event ExportedEvent) error {
+				if count > 0 {
+					fmt.Fprint(w, ",")
+				}
+				count++
+
+				encoded, err := json.Marshal(event)
+				if err != nil {
+					return err
+				}
+
+				_, err = w.Write(encoded)
+				return err
+			}, sort)
+			fmt.Fprint(w, "]")
+		} else {
+			writer := csv.NewWriter(w)
+			writer.Write(exportedEventColumns)
+			err = forEachDBResource(r.Context(), db.Database(CMS_DATABASE), CMS_C_ANALYTICS_EVENTS, filter, func(event ExportedEvent) error {
+				return writer.Write(event.Row())
+			}, sort)
+			writer.Flush()
+		}
+
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error while exporting analytics events", "error", err)
+		}
+	}
+}
+
+// Exports the statistics of the range. JSON contains every statistic,
+// CSV contains a single table picked with ?table= (series, pages, referrers, countries or goals).
+func exportStatistics(db *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats, misses := parseStatsQuery(r.Context(), db, r.URL.Query())
+		format := parseExportFormat(r, misses)
+
+		table := r.URL.Query().Get("table")
+		if table == "" {
+			table = "series"
+		}
+
+		if _, exists := statisticsTables[table]; exists == false {
+			misses["table"] = "Must be one of series, pages, referrers, countries or goals"
+		}
+
+		if len(misses) > 0 {
+			WriteError(w, r, validationError(ErrorCodeInvalidQuery, "Invalid export query", misses))
+			return
+		}
+
+		statistics, err := collectStatistics(r.Context(), db, stats)
+		if err != nil {
+			WriteError(w, r, toAPIError(err, "Error while aggregating statistics"))
+			return
+		}
+
+		if format == ExportFormatJSON {
+			setExportHeaders(w, "stats", stats, format)
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(statistics)
+			return
+		}
+
+		setExportHeaders(w, "stats-"+table, stats, format)
+		w.WriteHeader(http.StatusOK)
+
+		writer := csv.NewWriter(w)
+		writer.WriteAll(statisticsTables[table](statistics))
+	}
+}
+
+var statisticsTables = map[string]func(*Statistics) [][]string{
+	"series": func(statistics *Statistics) [][]string {
+		rows := [][]string{{"bucket", "pageViews", "visits", "uniqueVisitors"}}
+		for _, bucket := range statistics.Series {
+			rows = append(rows, append([]string{bucket.Bucket.Format(time.RFC3339)}, totalsRow(bucket.StatsTotals)...))
+		}
+		return rows
+	},
+	"pages": func(statistics *Statistics) [][]string {
+		return entriesTable("path", statistics.TopPages)
+	},
+	"referrers": func(statistics *Statistics) [][]string {
+		return entriesTable("referrer", statistics.TopReferrers)
+	},
+	"countries": func(statistics *Statistics) [][]string {
+		return entriesTable("countryCode", statistics.TopCountries)
+	},
+	"goals": func(statistics *Statistics) [][]string {
+		rows := [][]string{{"goal", "type", "value", "completions", "conversions", "conversionRate"}}
+		for _, goal := range statistics.Goals {
+			rows = append(rows, []string{
+				csvCell(goal.Goal.Name), string(goal.Goal.Type), csvCell(goal.Goal.Value),
+				strconv.Itoa(goal.Completions), strconv.Itoa(goal.Conversions),
+				strconv.FormatFloat(goal.ConversionRate, 'f', 2, 64),
+			})
+		}
+		return rows
+	},
+}
+
+func entriesTable(key string, entries []StatsEntry) [][]string {
+	rows := [][]string{{key, "pageViews", "visits", "uniqueVisitors"}}
+	for _, entry := range entries {
+		rows = append(rows, append([]string{csvCell(entry.Key)}, totalsRow(entry.StatsTotals)...))
+	}
+	return rows
+}
+
+func totalsRow(totals StatsTotals) []string {
+	return []string{strconv.Itoa(totals.PageViews), strconv.Itoa(totals.Visits), strconv.Itoa(totals.UniqueVisitors)}
+}
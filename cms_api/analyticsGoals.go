@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+type GoalType string
+
+const (
+	// Reached by viewing the page, a trailing * matches every page under the path
+	GoalTypePage GoalType = "page"
+	// Reached by sending a custom event with the name
+	GoalTypeEvent GoalType = "event"
+	// Reached by following a link to the domain or one of its subdomains
+	GoalTypeOutbound GoalType = "outbound"
+)
+
+var ValidGoalTypes = map[GoalType]bool{
+	GoalTypePage:     true,
+	GoalTypeEvent:    true,
+	GoalTypeOutbound: true,
+}
+
+type Goal struct {
+	Id        string    `json:"id"`
+	Name      string    `json:"name"`
+	Type      GoalType  `json:"type"`
+	Value     string    `json:"value"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func (g *Goal) ToMap() map[string]interface{} {
+	return map[string]interface{}{
+		"name":      g.Name,
+		"type":      string(g.Type),
+		"value":     g.Value,
+		"createdAt": bson.NewDateTimeFromTime(g.CreatedAt),
+	}
+}
+
+type GoalBody struct {
+	Name  string   `json:"name"`
+	Type  GoalType `json:"type"`
+	Value string   `json:"value"`
+}
+
+func (g GoalBody) Validate(r *http.Request, db *mongo.Client) (Misses, error) {
+	misses := make(Misses, 0)
+
+	if strings.TrimSpace(g.Name) == "" {
+		misses["name"] = "Must be provided"
+	}
+
+	if _, exists := ValidGoalTypes[g.Type]; exists == false {
+		misses["type"] = "Must be one of page, event or outbound"
+	}
+
+	switch {
+	case g.Value == "":
+		misses["value"] = "Must be provided"
+	case g.Type == GoalTypePage && strings.HasPrefix(g.Value, "/") == false:
+		misses["value"] = "Must be a path starting with /"
+	case g.Type == GoalTypeOutbound && strings.ContainsAny(g.Value, "/:"):
+		misses["value"] = "Must be a domain, without a scheme or path"
+	}
+
+	return misses, nil
+}
+
+func getGoals(db *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		goals, err := loadGoals(r.Context(), db)
+		if err != nil {
+			WriteError(w, r, toAPIError(err, "Error while getting goals"))
+			return
+		}
+
+		WriteJSON(w, http.StatusOK, ResponseMessage{Status: StatusCodeOk, Data: goals})
+	}
+}
+
+func createGoal(db *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, _, err := ReadBodyJSON[GoalBody](r, db)
+		if err != nil {
+			WriteError(w, r, toAPIError(err, "Error while validating the goal"))
+			return
+		}
+
+		goal := &Goal{
+			Name:      strings.TrimSpace(body.Name),
+			Type:      body.Type,
+			Value:     strings.ToLower(body.Value),
+			CreatedAt: time.Now(),
+		}
+
+		// Paths and event names are case sensitive, domains aren't
+		if goal.Type != GoalTypeOutbound {
+			goal.Value = body.Value
+		}
+
+		created, err := createDBResource(r.Context(), db.Database(CMS_DATABASE), CMS_C_ANALYTICS_GOALS, goal.ToMap())
+		if err != nil {
+			WriteError(w, r, toAPIError(err, "Error while creating goal"))
+			return
+		}
+
+		if id, ok := created["_id"].(bson.ObjectID); ok {
+			goal.Id = id.Hex()
+		}
+
+		WriteJSON(w, http.StatusCreated, ResponseMessage{Status: StatusCodeOk, Message: "Created goal", Data: goal})
+	}
+}
+
+func deleteGoal(db *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := bson.ObjectIDFromHex(r.PathValue("id"))
+		if err != nil {
+			WriteError(w, r, newAPIError(ErrorCodeInvalidId, fmt.Sprintf("Invalid goal id (%v)", r.PathValue("id"))))
+			return
+		}
+
+		err = deleteDBResource(r.Context(), db.Database(CMS_DATABASE), CMS_C_ANALYTICS_GOALS, bson.M{"_id": id})
+		// The goals collection only exists once a goal was created
+		var notFound *DBNotFoundError
+		if errors.As(err, &notFound) {
+			WriteError(w, r, newAPIError(ErrorCodeResourceNotFound, fmt.Sprintf("Couldn't find goal (%v)", id.Hex())))
+			return
+		}
+
+		if err != nil {
+			WriteError(w, r, toAPIError(err, "Error while deleting goal"))
+			return
+		}
+
+		WriteJSON(w, http.StatusOK, ResponseMessage{Status: StatusCodeOk, Message: "Deleted goal"})
+	}
+}
+
+func loadGoals(ctx context.Context, db *mongo.Client) ([]Goal, error) {
+	records, err := getDBResource(ctx, db.Database(CMS_DATABASE), CMS_C_ANALYTICS_GOALS, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+
+	goals := make([]Goal, 0, len(records))
+	for _, record := range records {
+		goal := Goal{}
+		if id, ok := record["_id"].(bson.ObjectID); ok {
+			goal.Id = id.Hex()
+		}
+
+		goal.Name, _ = record["name"].(string)
+		goal.Value, _ = record["value"].(string)
+		goalType, _ := record["type"].(string)
+		goal.Type = GoalType(goalType)
+		if createdAt, ok := record["createdAt"].(bson.DateTime); ok {
+			goal.CreatedAt = createdAt.Time()
+		}
+
+		goals = append(goals, goal)
+	}
+
+	return goals, nil
+}
+
+// The events completing the goal
+func (g *Goal) Filter() bson.D {
+	switch g.Type {
+	case GoalTypePage:
+		path := any(g.Value)
+		if prefix, wildcard := strings.CutSuffix(g.Value, "*"); wildcard {
+			path = bson.D{{Key: "$regex", Value: "^" + regexp.QuoteMeta(prefix)}}
+		}
+
+		return bson.D{{Key: "type", Value: string(AnalyticsEventPageView)}, {Key: "path", Value: path}}
+	case GoalTypeEvent:
+		return bson.D{{Key: "type", Value: string(AnalyticsEventCustom)}, {Key: "name", Value: g.Value}}
+	default:
+		return bson.D{
+			{Key: "type", Value: string(AnalyticsEventOutbound)},
+			{Key: "outboundDomain", Value: bson.D{{Key: "$regex", Value: "(^|\\.)" + regexp.QuoteMeta(g.Value) + "$"}}},
+		}
+	}
+}
+
+type GoalBucket struct {
+	Bucket      time.Time `json:"bucket"`
+	Completions int       `json:"completions"`
+	Conversions int       `json:"conversions"`
+	// Percentage of the bucket's unique visitors that converted
+	ConversionRate float64 `json:"conversionRate"`
+}
+
+// Completions count every time the goal was reached, conversions count the visitors that reached it
+type GoalStatistics struct {
+	Goal           Goal         `json:"goal"`
+	Completions    int          `json:"completions"`
+	Conversions    int          `json:"conversions"`
+	ConversionRate float64      `json:"conversionRate"`
+	Series         []GoalBucket `json:"series"`
+}
+
+// Aggregates every goal over the range of the statistics in a single pass over the raw events,
+// which only cover the range since the retention cutoff. Visitors are counted by grouping on them,
+// so the size of the results doesn't grow with the traffic. Conversion rates are relative to the unique
+// visitors of the statistics.
+func collectGoalStatistics(ctx context.Context, db *mongo.Client, stats *StatsQuery, statistics *Statistics) ([]GoalStatistics, error) {
+	goals, err := loadGoals(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]GoalStatistics, 0, len(goals))
+	if len(goals) == 0 {
+		return results, nil
+	}
+
+	start, _ := stats.retainedStart()
+	match := bson.D{
+		{Key: "timestamp", Value: bson.D{
+			{Key: "$gte", Value: bson.NewDateTimeFromTime(start)},
+			{Key: "$lt", Value: bson.NewDateTimeFromTime(stats.End)},
+		}},
+	}
+
+	if stats.IncludeBots == false {
+		match = append(match, bson.E{Key: "isBot", Value: bson.D{{Key: "$ne", Value: true}}})
+	}
+
+	facets := bson.D{}
+	for i, goal := range goals {
+		facets = append(facets, bson.E{Key: fmt.Sprintf("goal%d", i), Value: bson.A{
+			bson.D{{Key: "$match", Value: goal.Filter()}},
+			bson.D{{Key: "$group", Value: bson.D{
+				{Key: "_id", Value: bson.D{{Key: "bucket", Value: statsBucketExpression("$timestamp", stats)}, {Key: "userId", Value: "$userId"}}},
+				{Key: "completions", Value: bson.D{{Key: "$sum", Value: 1}}},
+			}}},
+			bson.D{{Key: "$group", Value: bson.D{
+				{Key: "_id", Value: "$_id.bucket"},
+				{Key: "completions", Value: bson.D{{Key: "$sum", Value: "$completions"}}},
+				{Key: "conversions", Value: bson.D{{Key: "$sum", Value: 1}}},
+			}}},
+			bson.D{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+		}})
+
+		facets = append(facets, bson.E{Key: fmt.Sprintf("goal%dTotals", i), Value: bson.A{
+			bson.D{{Key: "$match", Value: goal.Filter()}},
+			bson.D{{Key: "$group", Value: bson.D{
+				{Key: "_id", Value: "$userId"},
+				{Key: "completions", Value: bson.D{{Key: "$sum", Value: 1}}},
+			}}},
+			bson.D{{Key: "$group", Value: bson.D{
+				{Key: "_id", Value: nil},
+				{Key: "completions", Value: bson.D{{Key: "$sum", Value: "$completions"}}},
+				{Key: "conversions", Value: bson.D{{Key: "$sum", Value: 1}}},
+			}}},
+		}})
+	}
+
+	type goalGroup struct {
+		Bucket      time.Time `bson:"_id"`
+		Completions int       `bson:"completions"`
+		Conversions int       `bson:"conversions"`
+	}
+
+	aggregated, err := aggregateDBResource[map[string][]goalGroup](ctx, db.Database(CMS_DATABASE), CMS_C_ANALYTICS_EVENTS, bson.A{
+		bson.D{{Key: "$match", Value: match}},
+		bson.D{{Key: "$facet", Value: facets}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(aggregated) == 0 {
+		return nil, errors.New("Goal aggregation returned no results")
+	}
+
+	visitorsByBucket := make(map[int64]int)
+	for _, bucket := range statistics.Series {
+		visitorsByBucket[bucket.Bucket.Unix()] = bucket.UniqueVisitors
+	}
+
+	for i, goal := range goals {
+		result := GoalStatistics{Goal: goal, Series: make([]GoalBucket, 0)}
+		groups := make(map[int64]goalGroup)
+		for _, group := range aggregated[0][fmt.Sprintf("goal%d", i)] {
+			groups[group.Bucket.Unix()] = group
+		}
+
+		for _, totals := range aggregated[0][fmt.Sprintf("goal%dTotals", i)] {
+			result.Completions = totals.Completions
+			result.Conversions = totals.Conversions
+		}
+
+		result.ConversionRate = percentageOf(result.Conversions, statistics.Totals.UniqueVisitors)
+
+		for _, start := range stats.Buckets() {
+			group := groups[start.Unix()]
+			result.Series = append(result.Series, GoalBucket{
+				Bucket:         start,
+				Completions:    group.Completions,
+				Conversions:    group.Conversions,
+				ConversionRate: percentageOf(group.Conversions, visitorsByBucket[start.Unix()]),
+			})
+		}
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+func percentageOf(part int, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+
+	return float64(part) / float64(total) * 100
+}
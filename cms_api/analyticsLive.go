@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Visitors seen this recently count as active
+	activeVisitorWindow = 5 * time.Minute
+	// Also keeps idle connections from being closed by proxies
+	liveHeartbeatInterval = 15 * time.Second
+	// Events are dropped for subscribers that fall this far behind
+	liveSubscriberBuffer = 64
+)
+
+type LiveEventType string
+
+const (
+	LiveEventVisit    LiveEventType = "visit"
+	LiveEventPageView LiveEventType = "pageview"
+	LiveEventActive   LiveEventType = "active"
+)
+
+// What the live feed shows of an event, visitors stay anonymous
+type LiveEvent struct {
+	Type            LiveEventType `json:"type"`
+	Path            string        `json:"path"`
+	Referrer        string        `json:"referrer"`
+	CountryCode     string        `json:"countryCode"`
+	Region          string        `json:"region"`
+	City            string        `json:"city"`
+	UserAgentFamily string        `json:"userAgentFamily"`
+	Timestamp       time.Time     `json:"timestamp"`
+	ActiveVisitors  int           `json:"activeVisitors"`
+}
+
+// In-process pub/sub of analytics events, it also tracks the visitors and sessions seen recently
+type AnalyticsBroker struct {
+	mu          sync.Mutex
+	subscribers map[chan LiveEvent]struct{}
+	visitors    map[string]time.Time
+	sessions    map[string]time.Time
+	closed      chan struct{}
+	closeOnce   sync.Once
+}
+
+func newAnalyticsBroker() *AnalyticsBroker {
+	return &AnalyticsBroker{
+		subscribers: make(map[chan LiveEvent]struct{}),
+		visitors:    make(map[string]time.Time),
+		sessions:    make(map[string]time.Time),
+		closed:      make(chan struct{}),
+	}
+}
+
+// Ends every live stream, called when the server shuts down
+func (b *AnalyticsBroker) Close() {
+	b.closeOnce.Do(func() {
+		close(b.closed)
+	})
+}
+
+// Sends the page view to every subscriber, the first page view of a session is published as a visit
+func (b *AnalyticsBroker) Publish(event *AnalyticsEvent) {
+	if event.IsBot || event.Type != AnalyticsEventPageView {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.prune(now)
+
+	liveEvent := LiveEvent{
+		Type:            LiveEventPageView,
+		Path:            event.Path,
+		Referrer:        event.Referrer,
+		CountryCode:     event.CountryCode,
+		Region:          event.Region,
+		City:            event.City,
+		UserAgentFamily: event.UserAgentFamily,
+		Timestamp:       event.Timestamp,
+	}
+
+	if _, exists := b.sessions[event.SessionId]; exists == false {
+		liveEvent.Type = LiveEventVisit
+	}
+
+	b.sessions[event.SessionId] = now
+	b.visitors[event.UserId] = now
+	liveEvent.ActiveVisitors = len(b.visitors)
+
+	for subscriber := range b.subscribers {
+		select {
+		case subscriber <- liveEvent:
+		default:
+		}
+	}
+}
+
+// Returns the events published from now on, the returned function must be called once done
+func (b *AnalyticsBroker) Subscribe() (<-chan LiveEvent, func()) {
+	subscriber := make(chan LiveEvent, liveSubscriberBuffer)
+
+	b.mu.Lock()
+	b.subscribers[subscriber] = struct{}{}
+	b.mu.Unlock()
+
+	return subscriber, func() {
+		b.mu.Lock()
+		delete(b.subscribers, subscriber)
+		b.mu.Unlock()
+	}
+}
+
+func (b *AnalyticsBroker) ActiveVisitors() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.prune(time.Now())
+	return len(b.visitors)
+}
+
+func (b *AnalyticsBroker) prune(now time.Time) {
+	for visitor, seenAt := range b.visitors {
+		if now.Sub(seenAt) > activeVisitorWindow {
+			delete(b.visitors, visitor)
+		}
+	}
+
+	for session, seenAt := range b.sessions {
+		if now.Sub(seenAt) > sessionLifetime {
+			delete(b.sessions, session)
+		}
+	}
+}
+
+// Streams visits and page views as Server-Sent Events, along with the count of active visitors.
+// EventSource can't send the Authorization header, so clients read the stream with fetch.
+func streamLiveAnalytics(broker *AnalyticsBroker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		controller := http.NewResponseController(w)
+		// The stream outlives any write timeout of the server
+		controller.SetWriteDeadline(time.Time{})
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+
+		events, unsubscribe := broker.Subscribe()
+		defer unsubscribe()
+
+		heartbeat := time.NewTicker(liveHeartbeatInterval)
+		defer heartbeat.Stop()
+
+		next := LiveEvent{Type: LiveEventActive, Timestamp: time.Now(), ActiveVisitors: broker.ActiveVisitors()}
+		for {
+			err := writeServerSentEvent(w, next)
+			if err == nil {
+				err = controller.Flush()
+			}
+
+			if err != nil {
+				slog.InfoContext(r.Context(), "Closing live analytics stream", "reason", err)
+				return
+			}
+
+			select {
+			case <-r.Context().Done():
+				return
+			case <-broker.closed:
+				return
+			case event := <-events:
+				next = event
+			case <-heartbeat.C:
+				next = LiveEvent{Type: LiveEventActive, Timestamp: time.Now(), ActiveVisitors: broker.ActiveVisitors()}
+			}
+		}
+	}
+}
+
+func writeServerSentEvent(w http.ResponseWriter, event LiveEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+	return err
+}
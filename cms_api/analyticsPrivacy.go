@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const consentCookieKey = "analyticsConsent"
+
+// A year, the longest a consent choice should be remembered
+const consentLifetime = 365 * 24 * time.Hour
+
+type ConsentState string
+
+const (
+	ConsentGranted ConsentState = "granted"
+	ConsentDenied  ConsentState = "denied"
+	ConsentUnknown ConsentState = "unknown"
+)
+
+var analyticsSaltIndexes = []mongo.IndexModel{
+	{Keys: bson.D{{Key: "day", Value: 1}}, Options: options.Index().SetUnique(true)},
+}
+
+// In privacy mode visitors are only identified with cookies once they've granted consent
+// and IPs are truncated before they're stored or sent to a lookup service.
+// It's enabled with analytics.privacyMode.
+func analyticsPrivacyMode() bool {
+	return appConfig.Analytics.PrivacyMode
+}
+
+// Visitors sending Do Not Track or Global Privacy Control aren't tracked at all
+func doNotTrack(r *http.Request) bool {
+	return r.Header.Get("DNT") == "1" || r.Header.Get("Sec-GPC") == "1"
+}
+
+func consentState(r *http.Request) ConsentState {
+	cookie, err := r.Cookie(consentCookieKey)
+	if err != nil {
+		return ConsentUnknown
+	}
+
+	switch ConsentState(cookie.Value) {
+	case ConsentGranted:
+		return ConsentGranted
+	case ConsentDenied:
+		return ConsentDenied
+	default:
+		return ConsentUnknown
+	}
+}
+
+// Cookies are used when the visitor granted consent, or outside of privacy mode unless they denied it
+func useAnalyticsCookies(r *http.Request) bool {
+	switch consentState(r) {
+	case ConsentGranted:
+		return true
+	case ConsentDenied:
+		return false
+	default:
+		return analyticsPrivacyMode() == false
+	}
+}
+
+// Keeps the network part of the IP (/24 for IPv4, /48 for IPv6), which is still enough to locate the country
+func truncateIp(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
+	}
+
+	bits := 48
+	if addr.Is4() || addr.Is4In6() {
+		addr = addr.Unmap()
+		bits = 24
+	}
+
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return ""
+	}
+
+	return prefix.Addr().String()
+}
+
+func anonymizeIp(ip string) string {
+	if analyticsPrivacyMode() == false {
+		return ip
+	}
+
+	return truncateIp(ip)
+}
+
+// Cf-Connecting-Ip is only honoured from trusted proxies, anyone else could pick the address they're counted as
+func clientIp(r *http.Request) string {
+	if ip := r.Header.Get("Cf-Connecting-Ip"); ip != "" && fromTrustedProxy(r) {
+		return ip
+	}
+
+	return cleanIpFromPort(r.RemoteAddr)
+}
+
+// Returns the visitor and session ids of the request, either from cookies or from a cookieless hash
+func resolveVisitorIdentity(db *mongo.Client, w http.ResponseWriter, r *http.Request) (string, string, error) {
+	if useAnalyticsCookies(r) {
+		return resolveVisitorId(w, r), resolveSessionId(w, r), nil
+	}
+
+	userId, err := cookielessVisitorId(db, r)
+	if err != nil {
+		return "", "", err
+	}
+
+	sessionId, err := cookielessSessionId(r.Context(), db, userId)
+	if err != nil {
+		return "", "", err
+	}
+
+	return userId, sessionId, nil
+}
+
+// Hashes the IP and user agent with a salt that changes every day,
+// so a visitor can be recognised within a day but never across days and the IP is never stored
+func cookielessVisitorId(db *mongo.Client, r *http.Request) (string, error) {
+	salt, err := visitorSalt.Current(r.Context(), db)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	io.WriteString(hash, salt)
+	io.WriteString(hash, r.Host)
+	io.WriteString(hash, clientIp(r))
+	io.WriteString(hash, r.UserAgent())
+
+	return hex.EncodeToString(hash.Sum(nil))[:32], nil
+}
+
+// Continues the visitor's last session while it hasn't expired, there's no cookie to carry it
+func cookielessSessionId(ctx context.Context, db *mongo.Client, userId string) (string, error) {
+	events, err := getDBResource(ctx, db.Database(CMS_DATABASE), CMS_C_ANALYTICS_EVENTS,
+		bson.D{
+			{Key: "userId", Value: userId},
+			{Key: "timestamp", Value: bson.D{{Key: "$gte", Value: bson.NewDateTimeFromTime(time.Now().Add(-sessionLifetime))}}},
+		},
+		options.Find().SetSort(bson.D{{Key: "timestamp", Value: -1}}).SetLimit(1),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	if len(events) > 0 {
+		if sessionId, ok := events[0]["sessionId"].(string); ok && sessionId != "" {
+			return sessionId, nil
+		}
+	}
+
+	return rand.Text(), nil
+}
+
+// The salt of the current UTC day, shared through the database so every instance hashes visitors the same way.
+// Salts of previous days are deleted so yesterday's hashes can't be recomputed.
+type DailySalt struct {
+	mu   sync.Mutex
+	day  string
+	salt string
+}
+
+var visitorSalt = &DailySalt{}
+
+func (s *DailySalt) Current(ctx context.Context, db *mongo.Client) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	day := time.Now().UTC().Format(time.DateOnly)
+	if s.day == day {
+		return s.salt, nil
+	}
+
+	cmsDatabase := db.Database(CMS_DATABASE)
+	salt := make([]byte, 32)
+	rand.Read(salt)
+
+	// Only the first instance to reach a new day gets to set its salt
+	err := upsertDBResource(ctx, cmsDatabase, CMS_C_ANALYTICS_SALTS, bson.M{"day": day}, bson.M{"$setOnInsert": bson.M{
+		"day":       day,
+		"salt":      hex.EncodeToString(salt),
+		"createdAt": bson.NewDateTimeFromTime(time.Now()),
+	}})
+	if err != nil {
+		return "", err
+	}
+
+	salts, err := getDBResource(ctx, cmsDatabase, CMS_C_ANALYTICS_SALTS, bson.M{"day": day})
+	if err != nil {
+		return "", err
+	}
+
+	if len(salts) == 0 {
+		return "", errors.New("Couldn't find the salt of " + day)
+	}
+
+	s.salt, _ = salts[0]["salt"].(string)
+	s.day = day
+
+	_, err = deleteDBResources(ctx, cmsDatabase, CMS_C_ANALYTICS_SALTS, bson.M{"day": bson.M{"$ne": day}})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error while deleting old analytics salts", "error", err)
+	}
+
+	return s.salt, nil
+}
+
+type ConsentBody struct {
+	Analytics *bool `json:"analytics"`
+}
+
+func (c ConsentBody) Validate(r *http.Request, db *mongo.Client) (Misses, error) {
+	misses := make(Misses, 0)
+
+	if c.Analytics == nil {
+		misses["analytics"] = "Must be either true or false"
+	}
+
+	return misses, nil
+}
+
+func getConsent() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, http.StatusOK, ResponseMessage{
+			Status: StatusCodeOk,
+			Data: map[string]any{
+				"consent":     consentState(r),
+				"doNotTrack":  doNotTrack(r),
+				"privacyMode": analyticsPrivacyMode(),
+				"cookies":     useAnalyticsCookies(r) && doNotTrack(r) == false,
+			},
+		})
+	}
+}
+
+// Remembers the visitor's choice, denying consent also removes the analytics cookies
+func setConsent(db *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, _, err := ReadBodyJSON[ConsentBody](r, db)
+		if err != nil {
+			WriteError(w, r, toAPIError(err, "Error while validating the consent"))
+			return
+		}
+
+		consent := ConsentDenied
+		if *body.Analytics {
+			consent = ConsentGranted
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:   consentCookieKey,
+			Value:  string(consent),
+			MaxAge: int(consentLifetime.Seconds()),
+			Secure: true,
+		})
+
+		if consent == ConsentDenied {
+			clearAnalyticsCookies(w)
+		}
+
+		WriteJSON(w, http.StatusOK, ResponseMessage{
+			Status:  StatusCodeOk,
+			Message: "Saved consent",
+			Data:    map[string]any{"consent": consent},
+		})
+	}
+}
+
+func clearAnalyticsCookies(w http.ResponseWriter) {
+	for _, name := range []string{visitorCookieKey, sessionCookieKey} {
+		http.SetCookie(w, &http.Cookie{Name: name, Value: "", MaxAge: -1, Secure: true})
+	}
+}
+
+// Visitors can only access their own records, identified by their cookie or today's cookieless hash.
+// Authenticated requests can pick any visitor with ?userId=.
+func dataSubjectId(db *mongo.Client, r *http.Request) (string, error) {
+	if userId := r.URL.Query().Get("userId"); userId != "" {
+		if isAuthenticated(r) == false {
+			return "", newAPIError(ErrorCodeUnauthorized, "Not authorized to access the records of other visitors")
+		}
+
+		return userId, nil
+	}
+
+	cookie, err := r.Cookie(visitorCookieKey)
+	if err == nil && cookie.Value != "" {
+		return cookie.Value, nil
+	}
+
+	return cookielessVisitorId(db, r)
+}
+
+// Exports every record kept about the visitor
+func exportVisitorData(db *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId, err := dataSubjectId(db, r)
+		if err != nil {
+			WriteError(w, r, toAPIError(err, "Error while identifying visitor"))
+			return
+		}
+
+		cmsDatabase := db.Database(CMS_DATABASE)
+		visitor, err := getDBResource(r.Context(), cmsDatabase, CMS_C_ANALYTICS_USERS, bson.M{"userId": userId})
+		if err != nil {
+			WriteError(w, r, toAPIError(err, "Error while exporting visitor data"))
+			return
+		}
+
+		events, err := getDBResource(r.Context(), cmsDatabase, CMS_C_ANALYTICS_EVENTS, bson.M{"userId": userId},
+			options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}}))
+		if err != nil {
+			WriteError(w, r, toAPIError(err, "Error while exporting visitor data"))
+			return
+		}
+
+		WriteJSON(w, http.StatusOK, ResponseMessage{
+			Status: StatusCodeOk,
+			Data: map[string]any{
+				"userId":  userId,
+				"visitor": visitor,
+				"events":  events,
+			},
+		})
+	}
+}
+
+// Erases every record kept about the visitor, including their traces in the rollups
+func eraseVisitorData(db *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId, err := dataSubjectId(db, r)
+		if err != nil {
+			WriteError(w, r, toAPIError(err, "Error while identifying visitor"))
+			return
+		}
+
+		// A half finished erasure leaves rollups counting deleted events, so it completes even if the client leaves
+		erased, err := eraseVisitor(context.WithoutCancel(r.Context()), db, userId)
+		if err != nil {
+			WriteError(w, r, toAPIError(err, "Error while erasing visitor data"))
+			return
+		}
+
+		if r.URL.Query().Get("userId") == "" {
+			clearAnalyticsCookies(w)
+		}
+
+		WriteJSON(w, http.StatusOK, ResponseMessage{
+			Status:  StatusCodeOk,
+			Message: "Erased visitor data",
+			Data:    map[string]any{"userId": userId, "erasedEvents": erased},
+		})
+	}
+}
+
+// Deletes the visitor's records and events, then recomputes the rollups their events were part of.
+// Rollups older than the retention period can't be recomputed, the visitor is only removed from their visitor lists.
+func eraseVisitor(ctx context.Context, db *mongo.Client, userId string) (int64, error) {
+	cmsDatabase := db.Database(CMS_DATABASE)
+
+	traces, err := aggregateDBResource[struct {
+		Bucket   time.Time `bson:"_id"`
+		Sessions []string  `bson:"sessions"`
+	}](ctx, cmsDatabase, CMS_C_ANALYTICS_EVENTS, bson.A{
+		bson.D{{Key: "$match", Value: bson.D{{Key: "userId", Value: userId}}}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{{Key: "$dateTrunc", Value: bson.D{{Key: "date", Value: "$timestamp"}, {Key: "unit", Value: "hour"}}}}},
+			{Key: "sessions", Value: bson.D{{Key: "$addToSet", Value: "$sessionId"}}},
+		}}},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	erased, err := deleteDBResources(ctx, cmsDatabase, CMS_C_ANALYTICS_EVENTS, bson.M{"userId": userId})
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = deleteDBResources(ctx, cmsDatabase, CMS_C_ANALYTICS_USERS, bson.M{"userId": userId})
+	if err != nil {
+		return erased, err
+	}
+
+	hours := make([]time.Time, 0, len(traces))
+	sessions := make([]string, 0)
+	for _, trace := range traces {
+		hours = append(hours, trace.Bucket)
+		sessions = append(sessions, trace.Sessions...)
+	}
+
+	_, err = recomputeRollups(ctx, db, hours)
+	if err != nil {
+		return erased, err
+	}
+
+	_, err = updateDBResources(ctx, cmsDatabase, CMS_C_ANALYTICS_ROLLUPS,
+		bson.M{"visitors": userId},
+		bson.M{"$pull": bson.M{"visitors": userId, "visits": bson.M{"$in": sessions}}},
+	)
+	return erased, err
+}
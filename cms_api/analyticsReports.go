@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	htmltemplate "html/template"
+	"log/slog"
+	"net/http"
+	"text/template"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+const (
+	analyticsReportJob = "analytics_weekly_report"
+	// The job only sends a report once per week, checking hourly keeps it close to Monday midnight
+	analyticsReportCheckInterval = time.Hour
+	reportTopEntries             = 5
+)
+
+// The weekly report checks every hour whether last week's report was sent
+func weeklyReportJob(notifier Notifier) Job {
+	return Job{
+		Name:     analyticsReportJob,
+		Interval: analyticsReportCheckInterval,
+		Run: func(ctx context.Context, db *mongo.Client) error {
+			return sendWeeklyReport(ctx, db, notifier, false)
+		},
+	}
+}
+
+// Sends the report of the last whole week (Monday to Monday, UTC) unless it was already sent
+func sendWeeklyReport(ctx context.Context, db *mongo.Client, notifier Notifier, force bool) error {
+	week := lastReportWeek(time.Now())
+
+	state, err := getJobState(ctx, db, analyticsReportJob)
+	if err != nil {
+		return err
+	}
+
+	if sentWeek, ok := state["lastReportWeek"].(bson.DateTime); ok && sentWeek.Time().Equal(week) && force == false {
+		return nil
+	}
+
+	report, err := buildWeeklyReport(ctx, db, week)
+	if err != nil {
+		return err
+	}
+
+	err = notifier.Notify(report)
+	if err != nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "Sent the weekly analytics report", "week", week.Format(time.DateOnly))
+	return saveJobState(ctx, db, analyticsReportJob, bson.M{"lastReportWeek": bson.NewDateTimeFromTime(week)})
+}
+
+// The Monday starting the last whole week before now
+func lastReportWeek(now time.Time) time.Time {
+	today := now.UTC().Truncate(24 * time.Hour)
+	daysSinceMonday := (int(today.Weekday()) + 6) % 7
+	return today.AddDate(0, 0, -daysSinceMonday-7)
+}
+
+type weeklyReportData struct {
+	Site       string
+	Statistics *Statistics
+	Start      time.Time
+	// The range ends on the Monday after, the report shows the Sunday
+	End time.Time
+}
+
+func (d weeklyReportData) Change(key string) string {
+	change := d.Statistics.Previous.Change[key]
+	if change == nil {
+		return "new"
+	}
+
+	return fmt.Sprintf("%+.1f%%", *change)
+}
+
+// The report is read from the rollups once they cover the whole week, from the raw events until then
+func buildWeeklyReport(ctx context.Context, db *mongo.Client, week time.Time) (*Report, error) {
+	stats := &StatsQuery{
+		Start:    week,
+		End:      week.AddDate(0, 0, 7),
+		Interval: StatsIntervalDay,
+		Location: time.UTC,
+		Limit:    reportTopEntries,
+		Source:   StatsSourceRollups,
+	}
+
+	watermark, err := rollupWatermark(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	if watermark.Before(stats.End) {
+		stats.Source = StatsSourceEvents
+	}
+
+	statistics, err := collectStatistics(ctx, db, stats)
+	if err != nil {
+		return nil, err
+	}
+
+	data := weeklyReportData{
+		Site:       appConfig.Reports.SiteName,
+		Statistics: statistics,
+		Start:      stats.Start,
+		End:        stats.End.AddDate(0, 0, -1),
+	}
+
+	report := &Report{
+		Subject: fmt.Sprintf("%v analytics: week of %v", data.Site, data.Start.Format("Jan 2, 2006")),
+		SentAt:  time.Now(),
+	}
+
+	var text bytes.Buffer
+	if err := weeklyReportText.Execute(&text, data); err != nil {
+		return nil, err
+	}
+
+	var html bytes.Buffer
+	if err := weeklyReportHTML.Execute(&html, data); err != nil {
+		return nil, err
+	}
+
+	report.Text = text.String()
+	report.HTML = html.String()
+	return report, nil
+}
+
+// Sends last week's report right away, even when it was already sent
+func sendWeeklyReportNow(db *mongo.Client, notifier Notifier) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if notifier == nil {
+			WriteError(w, r, newAPIError(ErrorCodeReportsDisabled, "Reports are disabled, set REPORT_NOTIFIER to enable them"))
+			return
+		}
+
+		err := sendWeeklyReport(r.Context(), db, notifier, true)
+		if err != nil {
+			WriteError(w, r, toAPIError(err, "Error while sending the weekly report"))
+			return
+		}
+
+		WriteJSON(w, http.StatusOK, ResponseMessage{Status: StatusCodeOk, Message: "Sent the weekly report"})
+	}
+}
+
+var weeklyReportText = template.Must(template.New("weeklyReportText").Parse(`{{.Site}} analytics
+{{.Start.Format "Jan 2"}} - {{.End.Format "Jan 2, 2006"}}
+
+Page views:      {{.Statistics.Totals.PageViews}} ({{.Change "pageViews"}})
+Visits:          {{.Statistics.Totals.Visits}} ({{.Change "visits"}})
+Unique visitors: {{.Statistics.Totals.UniqueVisitors}} ({{.Change "uniqueVisitors"}})
+{{with .Statistics.TopPages}}
+Top pages
+{{range .}}  {{.PageViews}}  {{.Key}}
+{{end}}{{end}}{{with .Statistics.TopReferrers}}
+Top referrers
+{{range .}}  {{.Visits}}  {{if .Key}}{{.Key}}{{else}}Direct{{end}}
+{{end}}{{end}}{{with .Statistics.TopCountries}}
+Top countries
+{{range .}}  {{.UniqueVisitors}}  {{if .Key}}{{.Key}}{{else}}Unknown{{end}}
+{{end}}{{end}}{{with .Statistics.Goals}}
+Goals
+{{range .}}  {{.Goal.Name}}: {{.Conversions}} conversions ({{printf "%.1f" .ConversionRate}}%), {{.Completions}} completions
+{{end}}{{end}}`))
+
+var weeklyReportHTML = htmltemplate.Must(htmltemplate.New("weeklyReportHTML").Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif; color: #222;">
+	<h1>{{.Site}} analytics</h1>
+	<p>{{.Start.Format "Jan 2"}} - {{.End.Format "Jan 2, 2006"}}</p>
+	<table cellpadding="6">
+		<tr><td>Page views</td><td><strong>{{.Statistics.Totals.PageViews}}</strong></td><td>{{.Change "pageViews"}}</td></tr>
+		<tr><td>Visits</td><td><strong>{{.Statistics.Totals.Visits}}</strong></td><td>{{.Change "visits"}}</td></tr>
+		<tr><td>Unique visitors</td><td><strong>{{.Statistics.Totals.UniqueVisitors}}</strong></td><td>{{.Change "uniqueVisitors"}}</td></tr>
+	</table>
+	{{with .Statistics.TopPages}}
+	<h2>Top pages</h2>
+	<table cellpadding="4">
+		{{range .}}<tr><td>{{.PageViews}}</td><td>{{.Key}}</td></tr>{{end}}
+	</table>
+	{{end}}
+	{{with .Statistics.TopReferrers}}
+	<h2>Top referrers</h2>
+	<table cellpadding="4">
+		{{range .}}<tr><td>{{.Visits}}</td><td>{{if .Key}}{{.Key}}{{else}}Direct{{end}}</td></tr>{{end}}
+	</table>
+	{{end}}
+	{{with .Statistics.TopCountries}}
+	<h2>Top countries</h2>
+	<table cellpadding="4">
+		{{range .}}<tr><td>{{.UniqueVisitors}}</td><td>{{if .Key}}{{.Key}}{{else}}Unknown{{end}}</td></tr>{{end}}
+	</table>
+	{{end}}
+	{{with .Statistics.Goals}}
+	<h2>Goals</h2>
+	<table cellpadding="4">
+		<tr><th align="left">Goal</th><th>Conversions</th><th>Rate</th><th>Completions</th></tr>
+		{{range .}}<tr><td>{{.Goal.Name}}</td><td>{{.Conversions}}</td><td>{{printf "%.1f" .ConversionRate}}%</td><td>{{.Completions}}</td></tr>{{end}}
+	</table>
+	{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const analyticsRollupJob = "analytics_rollup"
+const analyticsRetentionJob = "analytics_retention"
+
+const (
+	defaultRollupInterval = 5 * time.Minute
+	// Events inserted this recently may still be in flight, they're rolled up on the next run
+	rollupSettleDelay = time.Minute
+	// Caps the pages, referrers and countries kept per rollup so documents stay small
+	maxRollupEntries = 1000
+)
+
+// Rollups are computed per UTC hour and per UTC day
+type RollupInterval string
+
+const (
+	RollupIntervalHour RollupInterval = "hour"
+	RollupIntervalDay  RollupInterval = "day"
+)
+
+var analyticsRollupIndexes = []mongo.IndexModel{
+	{Keys: bson.D{{Key: "interval", Value: 1}, {Key: "bucket", Value: 1}}, Options: options.Index().SetUnique(true)},
+}
+
+// The page views of a bucket. Visits and visitors keep their keys so they can be counted once across buckets,
+// the entries only keep their counts so they overcount visitors returning in multiple buckets.
+type AnalyticsRollup struct {
+	Interval  RollupInterval
+	Bucket    time.Time
+	PageViews int
+	Visits    []interface{}
+	Visitors  []interface{}
+	Pages     []StatsEntry
+	Referrers []StatsEntry
+	Countries []StatsEntry
+}
+
+func (r *AnalyticsRollup) ToMap() map[string]interface{} {
+	return map[string]interface{}{
+		"interval":   string(r.Interval),
+		"bucket":     bson.NewDateTimeFromTime(r.Bucket),
+		"pageViews":  r.PageViews,
+		"visits":     r.Visits,
+		"visitors":   r.Visitors,
+		"pages":      r.Pages,
+		"referrers":  r.Referrers,
+		"countries":  r.Countries,
+		"computedAt": bson.NewDateTimeFromTime(time.Now()),
+	}
+}
+
+type rollupFacets struct {
+	Totals []struct {
+		PageViews int           `bson:"pageViews"`
+		Visits    []interface{} `bson:"visits"`
+		Visitors  []interface{} `bson:"visitors"`
+	} `bson:"totals"`
+	Pages     []StatsEntry `bson:"pages"`
+	Referrers []StatsEntry `bson:"referrers"`
+	Countries []StatsEntry `bson:"countries"`
+}
+
+// The rollup job runs every analytics.rollupInterval,
+// the retention job deletes raw events older than analytics.retentionDays days once a day (0 keeps them forever)
+func analyticsJobs() []Job {
+	return []Job{
+		{Name: analyticsRollupJob, Interval: appConfig.Analytics.RollupInterval, Run: rollupAnalytics},
+		{Name: analyticsRetentionJob, Interval: 24 * time.Hour, Run: enforceAnalyticsRetention},
+	}
+}
+
+// Recomputes the rollups of every hour and day that received events since the last run.
+// Events are found by their insertion order (_id), so events arriving late for an older bucket are included.
+func rollupAnalytics(ctx context.Context, db *mongo.Client) error {
+	cmsDatabase := db.Database(CMS_DATABASE)
+
+	state, err := getJobState(ctx, db, analyticsRollupJob)
+	if err != nil {
+		return err
+	}
+
+	watermark, _ := state["watermark"].(bson.ObjectID)
+	nextWatermark := bson.NewObjectIDFromTimestamp(time.Now().Add(-rollupSettleDelay))
+
+	hours, err := aggregateDBResource[struct {
+		Bucket time.Time `bson:"_id"`
+	}](ctx, cmsDatabase, CMS_C_ANALYTICS_EVENTS, bson.A{
+		bson.D{{Key: "$match", Value: bson.D{{Key: "_id", Value: bson.D{
+			{Key: "$gte", Value: watermark},
+			{Key: "$lt", Value: nextWatermark},
+		}}}}},
+		bson.D{{Key: "$group", Value: bson.D{{Key: "_id", Value: bson.D{{Key: "$dateTrunc", Value: bson.D{
+			{Key: "date", Value: "$timestamp"},
+			{Key: "unit", Value: "hour"},
+		}}}}}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	buckets := make([]time.Time, 0, len(hours))
+	for _, hour := range hours {
+		buckets = append(buckets, hour.Bucket)
+	}
+
+	days, err := recomputeRollups(ctx, db, buckets)
+	if err != nil {
+		return err
+	}
+
+	if len(hours) > 0 {
+		slog.InfoContext(ctx, "Rolled up analytics events", "hours", len(hours), "days", days)
+	}
+
+	return saveJobState(ctx, db, analyticsRollupJob, bson.M{"watermark": nextWatermark})
+}
+
+// Events inserted before the returned time are rolled up, it's zero before the first rollup
+func rollupWatermark(ctx context.Context, db *mongo.Client) (time.Time, error) {
+	state, err := getJobState(ctx, db, analyticsRollupJob)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	watermark, ok := state["watermark"].(bson.ObjectID)
+	if ok == false {
+		return time.Time{}, nil
+	}
+
+	return watermark.Timestamp(), nil
+}
+
+// Recomputes the hourly rollups of the hours and the daily rollups of their days, returning how many days were recomputed
+func recomputeRollups(ctx context.Context, db *mongo.Client, hours []time.Time) (int, error) {
+	// Buckets older than the retention period may have lost their events, recomputing them would lose data
+	cutoff := analyticsRetentionCutoff()
+	days := make(map[time.Time]bool)
+	for _, hour := range hours {
+		hour = hour.UTC()
+		if hour.Before(cutoff) {
+			slog.WarnContext(ctx, "Skipping a rollup older than the retention period", "bucket", hour)
+			continue
+		}
+
+		err := computeRollup(ctx, db, RollupIntervalHour, hour)
+		if err != nil {
+			return 0, err
+		}
+
+		days[hour.Truncate(24*time.Hour)] = true
+	}
+
+	for day := range days {
+		if day.Before(cutoff) {
+			continue
+		}
+
+		err := computeRollup(ctx, db, RollupIntervalDay, day)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(days), nil
+}
+
+// Aggregates the page views of the bucket from the raw events and replaces its rollup
+func computeRollup(ctx context.Context, db *mongo.Client, interval RollupInterval, bucket time.Time) error {
+	cmsDatabase := db.Database(CMS_DATABASE)
+
+	end := bucket.Add(time.Hour)
+	if interval == RollupIntervalDay {
+		end = bucket.AddDate(0, 0, 1)
+	}
+
+	pipeline := append(pageViewStages(bucket, end, false), bson.D{{Key: "$facet", Value: bson.D{
+		{Key: "totals", Value: bson.A{bson.D{{Key: "$group", Value: statsGroup(nil)}}}},
+		{Key: "pages", Value: statsTopEntries("$path", maxRollupEntries)},
+		{Key: "referrers", Value: statsTopEntries("$referrer", maxRollupEntries)},
+		{Key: "countries", Value: statsTopEntries("$countryCode", maxRollupEntries)},
+	}}})
+
+	facets, err := aggregateDBResource[rollupFacets](ctx, cmsDatabase, CMS_C_ANALYTICS_EVENTS, pipeline)
+	if err != nil {
+		return err
+	}
+
+	rollup := &AnalyticsRollup{
+		Interval:  interval,
+		Bucket:    bucket,
+		Visits:    make([]interface{}, 0),
+		Visitors:  make([]interface{}, 0),
+		Pages:     make([]StatsEntry, 0),
+		Referrers: make([]StatsEntry, 0),
+		Countries: make([]StatsEntry, 0),
+	}
+
+	if len(facets) > 0 {
+		rollup.Pages = facets[0].Pages
+		rollup.Referrers = facets[0].Referrers
+		rollup.Countries = facets[0].Countries
+
+		if len(facets[0].Totals) > 0 {
+			rollup.PageViews = facets[0].Totals[0].PageViews
+			rollup.Visits = facets[0].Totals[0].Visits
+			rollup.Visitors = facets[0].Totals[0].Visitors
+		}
+	}
+
+	return upsertDBResource(ctx, cmsDatabase, CMS_C_ANALYTICS_ROLLUPS,
+		bson.M{"interval": string(interval), "bucket": bson.NewDateTimeFromTime(bucket)},
+		bson.M{"$set": rollup.ToMap()},
+	)
+}
+
+// Deletes the raw events older than the retention period, only once they've been rolled up
+func enforceAnalyticsRetention(ctx context.Context, db *mongo.Client) error {
+	cutoff := analyticsRetentionCutoff()
+	if cutoff.IsZero() {
+		return nil
+	}
+
+	state, err := getJobState(ctx, db, analyticsRollupJob)
+	if err != nil {
+		return err
+	}
+
+	watermark, ok := state["watermark"].(bson.ObjectID)
+	if ok == false {
+		slog.InfoContext(ctx, "Skipping analytics retention as no events were rolled up yet")
+		return nil
+	}
+
+	deleted, err := deleteDBResources(ctx, db.Database(CMS_DATABASE), CMS_C_ANALYTICS_EVENTS, bson.D{
+		{Key: "timestamp", Value: bson.D{{Key: "$lt", Value: bson.NewDateTimeFromTime(cutoff)}}},
+		{Key: "_id", Value: bson.D{{Key: "$lt", Value: watermark}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "Deleted analytics events older than the retention period", "deleted", deleted, "cutoff", cutoff)
+	return nil
+}
+
+// Returns the time before which raw events are deleted, zero when they're kept forever
+func analyticsRetentionCutoff() time.Time {
+	days := appConfig.Analytics.RetentionDays
+	if days <= 0 {
+		return time.Time{}
+	}
+
+	return time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -days)
+}
+
+// Raw events are only kept since the retention cutoff, returns when statistics read from them really start
+// and whether the range had to be shortened
+func (s *StatsQuery) retainedStart() (time.Time, bool) {
+	cutoff := analyticsRetentionCutoff()
+	if s.Start.Before(cutoff) {
+		return cutoff, true
+	}
+
+	return s.Start, false
+}
+
+// Rollups can bucket any timezone whose offset is a whole number of hours
+func rollupsCover(stats *StatsQuery) bool {
+	_, startOffset := stats.Start.In(stats.Location).Zone()
+	_, endOffset := stats.End.In(stats.Location).Zone()
+	return startOffset%3600 == 0 && endOffset%3600 == 0
+}
+
+// Daily rollups are used when the buckets are made of whole UTC days, hourly ones otherwise
+func rollupInterval(stats *StatsQuery) RollupInterval {
+	alignedToDays := stats.Start.Equal(stats.Start.Truncate(24*time.Hour)) && stats.End.Equal(stats.End.Truncate(24*time.Hour))
+	if stats.Interval != StatsIntervalHour && stats.Location.String() == "UTC" && alignedToDays {
+		return RollupIntervalDay
+	}
+
+	return RollupIntervalHour
+}
+
+// Builds the same facets as statsPipeline out of the rollups of the range
+func rollupStatsPipeline(stats *StatsQuery, detailed bool) bson.A {
+	facets := bson.D{{Key: "totals", Value: bson.A{
+		bson.D{{Key: "$group", Value: rollupGroup(nil)}},
+		bson.D{{Key: "$project", Value: rollupProjection("")}},
+	}}}
+
+	if detailed {
+		facets = append(facets,
+			bson.E{Key: "series", Value: bson.A{
+				bson.D{{Key: "$group", Value: rollupGroup(statsBucketExpression("$bucket", stats))}},
+				bson.D{{Key: "$project", Value: rollupProjection("bucket")}},
+				bson.D{{Key: "$sort", Value: bson.D{{Key: "bucket", Value: 1}}}},
+			}},
+			bson.E{Key: "topPages", Value: rollupTopEntries("pages", stats.Limit)},
+			bson.E{Key: "topReferrers", Value: rollupTopEntries("referrers", stats.Limit)},
+			bson.E{Key: "topCountries", Value: rollupTopEntries("countries", stats.Limit)},
+		)
+	}
+
+	return bson.A{
+		bson.D{{Key: "$match", Value: bson.D{
+			{Key: "interval", Value: string(rollupInterval(stats))},
+			{Key: "bucket", Value: bson.D{
+				{Key: "$gte", Value: bson.NewDateTimeFromTime(stats.Start)},
+				{Key: "$lt", Value: bson.NewDateTimeFromTime(stats.End)},
+			}},
+		}}},
+		bson.D{{Key: "$facet", Value: facets}},
+	}
+}
+
+func rollupGroup(id any) bson.D {
+	return bson.D{
+		{Key: "_id", Value: id},
+		{Key: "pageViews", Value: bson.D{{Key: "$sum", Value: "$pageViews"}}},
+		{Key: "visits", Value: bson.D{{Key: "$push", Value: "$visits"}}},
+		{Key: "visitors", Value: bson.D{{Key: "$push", Value: "$visitors"}}},
+	}
+}
+
+// Counts the visits and visitors of a group made with rollupGroup once across all of its rollups
+func rollupProjection(key string) bson.D {
+	union := func(field string) bson.D {
+		return bson.D{{Key: "$size", Value: bson.D{{Key: "$reduce", Value: bson.D{
+			{Key: "input", Value: field},
+			{Key: "initialValue", Value: bson.A{}},
+			{Key: "in", Value: bson.D{{Key: "$setUnion", Value: bson.A{"$$value", "$$this"}}}},
+		}}}}}
+	}
+
+	projection := bson.D{
+		{Key: "_id", Value: 0},
+		{Key: "pageViews", Value: 1},
+		{Key: "visits", Value: union("$visits")},
+		{Key: "uniqueVisitors", Value: union("$visitors")},
+	}
+
+	if key != "" {
+		projection = append(projection, bson.E{Key: key, Value: "$_id"})
+	}
+
+	return projection
+}
+
+func rollupTopEntries(field string, limit int) bson.A {
+	return bson.A{
+		bson.D{{Key: "$unwind", Value: "$" + field}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$" + field + ".key"},
+			{Key: "pageViews", Value: bson.D{{Key: "$sum", Value: "$" + field + ".pageViews"}}},
+			{Key: "visits", Value: bson.D{{Key: "$sum", Value: "$" + field + ".visits"}}},
+			{Key: "uniqueVisitors", Value: bson.D{{Key: "$sum", Value: "$" + field + ".uniqueVisitors"}}},
+		}}},
+		bson.D{{Key: "$project", Value: bson.D{
+			{Key: "_id", Value: 0},
+			{Key: "key", Value: "$_id"},
+			{Key: "pageViews", Value: 1},
+			{Key: "visits", Value: 1},
+			{Key: "uniqueVisitors", Value: 1},
+		}}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "pageViews", Value: -1}, {Key: "key", Value: 1}}}},
+		bson.D{{Key: "$limit", Value: limit}},
+	}
+}
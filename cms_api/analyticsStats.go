@@ -0,0 +1,485 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+type StatsInterval string
+
+const (
+	StatsIntervalHour  StatsInterval = "hour"
+	StatsIntervalDay   StatsInterval = "day"
+	StatsIntervalWeek  StatsInterval = "week"
+	StatsIntervalMonth StatsInterval = "month"
+)
+
+var ValidStatsIntervals = map[StatsInterval]bool{
+	StatsIntervalHour:  true,
+	StatsIntervalDay:   true,
+	StatsIntervalWeek:  true,
+	StatsIntervalMonth: true,
+}
+
+// Statistics are read from the rollups whenever possible, raw events are exact up to the last second
+type StatsSource string
+
+const (
+	StatsSourceEvents  StatsSource = "events"
+	StatsSourceRollups StatsSource = "rollups"
+)
+
+const (
+	defaultStatsRange = 30 * 24 * time.Hour
+	defaultStatsLimit = 10
+	maxStatsLimit     = 100
+	// Keeps hourly stats over long ranges from producing enormous series
+	maxStatsBuckets = 2000
+)
+
+// The range [Start, End) of a statistics request, bucketed by Interval in Location
+type StatsQuery struct {
+	Start    time.Time
+	End      time.Time
+	Interval StatsInterval
+	Location *time.Location
+	Limit    int
+	Source   StatsSource
+	// Bots are excluded unless asked for, rollups only count visitors that aren't bots
+	IncludeBots bool
+}
+
+// Reads start and end (RFC3339), interval, timezone (IANA name), limit, source and includeBots.
+// The range defaults to the last 30 days bucketed by day.
+// Without a source the rollups are only read when they were rolled up past the end of the range.
+// When read from the rollups the range is widened to whole hours.
+func parseStatsQuery(ctx context.Context, db *mongo.Client, query url.Values) (*StatsQuery, Misses) {
+	misses := make(Misses, 0)
+	stats := &StatsQuery{
+		End:      time.Now(),
+		Interval: StatsIntervalDay,
+		Location: time.UTC,
+		Limit:    defaultStatsLimit,
+	}
+
+	if end := query.Get("end"); end != "" {
+		parsed, err := time.Parse(time.RFC3339, end)
+		if err != nil {
+			misses["end"] = "Must be an RFC3339 date"
+		}
+		stats.End = parsed
+	}
+
+	stats.Start = stats.End.Add(-defaultStatsRange)
+	if start := query.Get("start"); start != "" {
+		parsed, err := time.Parse(time.RFC3339, start)
+		if err != nil {
+			misses["start"] = "Must be an RFC3339 date"
+		}
+		stats.Start = parsed
+	}
+
+	if stats.Start.Before(stats.End) == false {
+		misses["start"] = "Must be before end"
+	}
+
+	if interval := query.Get("interval"); interval != "" {
+		stats.Interval = StatsInterval(interval)
+		if _, exists := ValidStatsIntervals[stats.Interval]; exists == false {
+			misses["interval"] = "Must be one of hour, day, week or month"
+		}
+	}
+
+	if timezone := query.Get("timezone"); timezone != "" {
+		location, err := time.LoadLocation(timezone)
+		if err != nil {
+			misses["timezone"] = "Must be an IANA timezone"
+		} else {
+			stats.Location = location
+		}
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		parsed, err := strconv.Atoi(limit)
+		if err != nil || parsed <= 0 || parsed > maxStatsLimit {
+			misses["limit"] = fmt.Sprintf("Must be a number between 1 and %v", maxStatsLimit)
+		}
+		stats.Limit = parsed
+	}
+
+	if includeBots := query.Get("includeBots"); includeBots != "" {
+		parsed, err := strconv.ParseBool(includeBots)
+		if err != nil {
+			misses["includeBots"] = "Must be either true or false"
+		}
+		stats.IncludeBots = parsed
+	}
+
+	switch StatsSource(query.Get("source")) {
+	case "":
+		stats.Source = StatsSourceEvents
+		if len(misses) == 0 && stats.IncludeBots == false && rollupsCover(stats) && rolledUpUntil(ctx, db, stats.End) {
+			stats.Source = StatsSourceRollups
+		}
+	case StatsSourceEvents:
+		stats.Source = StatsSourceEvents
+	case StatsSourceRollups:
+		stats.Source = StatsSourceRollups
+		if len(misses) == 0 && rollupsCover(stats) == false {
+			misses["source"] = "Rollups can only be used with timezones whose offset is a whole number of hours"
+		}
+
+		if stats.IncludeBots {
+			misses["source"] = "Rollups don't include bots"
+		}
+	default:
+		misses["source"] = "Must be either events or rollups"
+	}
+
+	if len(misses) == 0 && stats.Source == StatsSourceRollups {
+		stats.Start = stats.Start.Truncate(time.Hour)
+		stats.End = ceilHour(stats.End)
+	}
+
+	if len(misses) == 0 && len(stats.Buckets()) > maxStatsBuckets {
+		misses["interval"] = fmt.Sprintf("Too many buckets for the range, use a larger interval (max %v)", maxStatsBuckets)
+	}
+
+	return stats, misses
+}
+
+// Whether every event before end has been rolled up. Events are exact, so they're read when the watermark can't be found.
+func rolledUpUntil(ctx context.Context, db *mongo.Client, end time.Time) bool {
+	watermark, err := rollupWatermark(ctx, db)
+	if err != nil {
+		slog.WarnContext(ctx, "Couldn't find the rollup watermark, reading statistics from the events", "error", err)
+		return false
+	}
+
+	return watermark.Before(ceilHour(end)) == false
+}
+
+func ceilHour(t time.Time) time.Time {
+	if truncated := t.Truncate(time.Hour); truncated.Equal(t) == false {
+		return truncated.Add(time.Hour)
+	}
+
+	return t
+}
+
+// The range of the same length right before this one
+func (s *StatsQuery) Previous() *StatsQuery {
+	previous := *s
+	previous.End = s.Start
+	previous.Start = s.Start.Add(-s.End.Sub(s.Start))
+	return &previous
+}
+
+// Every bucket start in the range, used to fill the buckets without any event
+func (s *StatsQuery) Buckets() []time.Time {
+	buckets := make([]time.Time, 0)
+	for bucket := s.truncate(s.Start); bucket.Before(s.End); bucket = s.next(bucket) {
+		buckets = append(buckets, bucket)
+		if len(buckets) > maxStatsBuckets {
+			break
+		}
+	}
+
+	return buckets
+}
+
+// Mirrors $dateTrunc with weeks starting on monday
+func (s *StatsQuery) truncate(t time.Time) time.Time {
+	t = t.In(s.Location)
+	switch s.Interval {
+	case StatsIntervalHour:
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, s.Location)
+	case StatsIntervalWeek:
+		daysSinceMonday := (int(t.Weekday()) + 6) % 7
+		return time.Date(t.Year(), t.Month(), t.Day()-daysSinceMonday, 0, 0, 0, 0, s.Location)
+	case StatsIntervalMonth:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, s.Location)
+	default:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, s.Location)
+	}
+}
+
+func (s *StatsQuery) next(bucket time.Time) time.Time {
+	switch s.Interval {
+	case StatsIntervalHour:
+		return bucket.Add(time.Hour)
+	case StatsIntervalWeek:
+		return bucket.AddDate(0, 0, 7)
+	case StatsIntervalMonth:
+		return bucket.AddDate(0, 1, 0)
+	default:
+		return bucket.AddDate(0, 0, 1)
+	}
+}
+
+// Visits are sessions, page views are events and unique visitors are distinct visitor ids
+type StatsTotals struct {
+	PageViews      int `bson:"pageViews" json:"pageViews"`
+	Visits         int `bson:"visits" json:"visits"`
+	UniqueVisitors int `bson:"uniqueVisitors" json:"uniqueVisitors"`
+}
+
+type StatsBucket struct {
+	Bucket      time.Time `bson:"bucket" json:"bucket"`
+	StatsTotals `bson:",inline"`
+}
+
+type StatsEntry struct {
+	Key         string `bson:"key" json:"key"`
+	StatsTotals `bson:",inline"`
+}
+
+type StatsRange struct {
+	Start       time.Time     `json:"start"`
+	End         time.Time     `json:"end"`
+	Interval    StatsInterval `json:"interval"`
+	Timezone    string        `json:"timezone"`
+	Source      StatsSource   `json:"source"`
+	IncludeBots bool          `json:"includeBots"`
+}
+
+type StatsComparison struct {
+	Range  StatsRange  `json:"range"`
+	Totals StatsTotals `json:"totals"`
+	// Percentage change of each total, nil when the previous period had nothing to compare with
+	Change map[string]*float64 `json:"change"`
+}
+
+type Statistics struct {
+	Range        StatsRange       `json:"range"`
+	Totals       StatsTotals      `json:"totals"`
+	Series       []StatsBucket    `json:"series"`
+	TopPages     []StatsEntry     `json:"topPages"`
+	TopReferrers []StatsEntry     `json:"topReferrers"`
+	TopCountries []StatsEntry     `json:"topCountries"`
+	Goals        []GoalStatistics `json:"goals"`
+	// Set when the range starts before the retention cutoff, goals are read from the raw events
+	// and can only count completions since then
+	GoalsSince *time.Time       `json:"goalsSince,omitempty"`
+	Previous   *StatsComparison `json:"previous"`
+}
+
+type statsFacets struct {
+	Totals       []StatsTotals `bson:"totals"`
+	Series       []StatsBucket `bson:"series"`
+	TopPages     []StatsEntry  `bson:"topPages"`
+	TopReferrers []StatsEntry  `bson:"topReferrers"`
+	TopCountries []StatsEntry  `bson:"topCountries"`
+}
+
+func (s *StatsQuery) Range() StatsRange {
+	return StatsRange{Start: s.Start, End: s.End, Interval: s.Interval, Timezone: s.Location.String(), Source: s.Source, IncludeBots: s.IncludeBots}
+}
+
+func (s *StatsQuery) aggregate(ctx context.Context, db *mongo.Client, detailed bool) (*statsFacets, error) {
+	cmsDatabase := db.Database(CMS_DATABASE)
+
+	var facets []statsFacets
+	var err error
+	if s.Source == StatsSourceRollups {
+		facets, err = aggregateDBResource[statsFacets](ctx, cmsDatabase, CMS_C_ANALYTICS_ROLLUPS, rollupStatsPipeline(s, detailed))
+	} else {
+		facets, err = aggregateDBResource[statsFacets](ctx, cmsDatabase, CMS_C_ANALYTICS_EVENTS, statsPipeline(s, detailed))
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(facets) == 0 {
+		return nil, errors.New("Statistics aggregation returned no results")
+	}
+
+	return &facets[0], nil
+}
+
+// Computes every statistic of the range in a single aggregation, compared against the previous period
+func collectStatistics(ctx context.Context, db *mongo.Client, stats *StatsQuery) (*Statistics, error) {
+	current, err := stats.aggregate(ctx, db, true)
+	if err != nil {
+		return nil, err
+	}
+
+	previousStats := stats.Previous()
+	previous, err := previousStats.aggregate(ctx, db, false)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Statistics{
+		Range:        stats.Range(),
+		Series:       fillStatsBuckets(stats, current.Series),
+		TopPages:     current.TopPages,
+		TopReferrers: current.TopReferrers,
+		TopCountries: current.TopCountries,
+	}
+
+	if len(current.Totals) > 0 {
+		result.Totals = current.Totals[0]
+	}
+
+	// Goals aren't rolled up, they're always read from the raw events
+	result.Goals, err = collectGoalStatistics(ctx, db, stats, result)
+	if err != nil {
+		return nil, err
+	}
+
+	if start, shortened := stats.retainedStart(); shortened {
+		result.GoalsSince = &start
+	}
+
+	previousTotals := StatsTotals{}
+	if len(previous.Totals) > 0 {
+		previousTotals = previous.Totals[0]
+	}
+
+	result.Previous = &StatsComparison{
+		Range:  previousStats.Range(),
+		Totals: previousTotals,
+		Change: map[string]*float64{
+			"pageViews":      percentageChange(previousTotals.PageViews, result.Totals.PageViews),
+			"visits":         percentageChange(previousTotals.Visits, result.Totals.Visits),
+			"uniqueVisitors": percentageChange(previousTotals.UniqueVisitors, result.Totals.UniqueVisitors),
+		},
+	}
+
+	return result, nil
+}
+
+func statsPipeline(stats *StatsQuery, detailed bool) bson.A {
+	facets := bson.D{{Key: "totals", Value: bson.A{
+		bson.D{{Key: "$group", Value: statsGroup(nil)}},
+		bson.D{{Key: "$project", Value: statsProjection("")}},
+	}}}
+
+	if detailed {
+		facets = append(facets,
+			bson.E{Key: "series", Value: bson.A{
+				bson.D{{Key: "$group", Value: statsGroup(statsBucketExpression("$timestamp", stats))}},
+				bson.D{{Key: "$project", Value: statsProjection("bucket")}},
+				bson.D{{Key: "$sort", Value: bson.D{{Key: "bucket", Value: 1}}}},
+			}},
+			bson.E{Key: "topPages", Value: statsTopEntries("$path", stats.Limit)},
+			bson.E{Key: "topReferrers", Value: statsTopEntries("$referrer", stats.Limit)},
+			bson.E{Key: "topCountries", Value: statsTopEntries("$countryCode", stats.Limit)},
+		)
+	}
+
+	return append(pageViewStages(stats.Start, stats.End, stats.IncludeBots), bson.D{{Key: "$facet", Value: facets}})
+}
+
+// Selects the page views in [start, end) and gives each of them the key of the visit it belongs to
+func pageViewStages(start time.Time, end time.Time, includeBots bool) bson.A {
+	match := bson.D{
+		{Key: "type", Value: string(AnalyticsEventPageView)},
+		{Key: "timestamp", Value: bson.D{
+			{Key: "$gte", Value: bson.NewDateTimeFromTime(start)},
+			{Key: "$lt", Value: bson.NewDateTimeFromTime(end)},
+		}},
+	}
+
+	// Events recorded before bots were classified have no flag and count as people
+	if includeBots == false {
+		match = append(match, bson.E{Key: "isBot", Value: bson.D{{Key: "$ne", Value: true}}})
+	}
+
+	return bson.A{
+		bson.D{{Key: "$match", Value: match}},
+		visitKeyStage(),
+	}
+}
+
+// Migrated events have no session, so each of them counts as its own visit
+func visitKeyStage() bson.D {
+	return bson.D{{Key: "$addFields", Value: bson.D{{Key: "visitKey", Value: bson.D{{Key: "$cond", Value: bson.A{
+		bson.D{{Key: "$eq", Value: bson.A{"$sessionId", ""}}}, "$_id", "$sessionId",
+	}}}}}}}
+}
+
+// Mirrors $dateTrunc of the field into the buckets of the query
+func statsBucketExpression(field string, stats *StatsQuery) bson.D {
+	return bson.D{{Key: "$dateTrunc", Value: bson.D{
+		{Key: "date", Value: field},
+		{Key: "unit", Value: string(stats.Interval)},
+		{Key: "timezone", Value: stats.Location.String()},
+		{Key: "startOfWeek", Value: "monday"},
+	}}}
+}
+
+func statsGroup(id any) bson.D {
+	return bson.D{
+		{Key: "_id", Value: id},
+		{Key: "pageViews", Value: bson.D{{Key: "$sum", Value: 1}}},
+		{Key: "visits", Value: bson.D{{Key: "$addToSet", Value: "$visitKey"}}},
+		{Key: "visitors", Value: bson.D{{Key: "$addToSet", Value: "$userId"}}},
+	}
+}
+
+// Projects a group made with statsGroup, renaming its _id to key when it's provided
+func statsProjection(key string) bson.D {
+	projection := bson.D{
+		{Key: "_id", Value: 0},
+		{Key: "pageViews", Value: 1},
+		{Key: "visits", Value: bson.D{{Key: "$size", Value: "$visits"}}},
+		{Key: "uniqueVisitors", Value: bson.D{{Key: "$size", Value: "$visitors"}}},
+	}
+
+	if key != "" {
+		projection = append(projection, bson.E{Key: key, Value: "$_id"})
+	}
+
+	return projection
+}
+
+func statsTopEntries(field string, limit int) bson.A {
+	return bson.A{
+		bson.D{{Key: "$match", Value: bson.D{{Key: field[1:], Value: bson.D{{Key: "$nin", Value: bson.A{"", nil}}}}}}},
+		bson.D{{Key: "$group", Value: statsGroup(field)}},
+		bson.D{{Key: "$project", Value: statsProjection("key")}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "pageViews", Value: -1}, {Key: "key", Value: 1}}}},
+		bson.D{{Key: "$limit", Value: limit}},
+	}
+}
+
+// Adds empty buckets for every period without events so the series is continuous
+func fillStatsBuckets(stats *StatsQuery, series []StatsBucket) []StatsBucket {
+	existing := make(map[int64]StatsBucket)
+	for _, bucket := range series {
+		existing[bucket.Bucket.Unix()] = bucket
+	}
+
+	filled := make([]StatsBucket, 0)
+	for _, start := range stats.Buckets() {
+		bucket, exists := existing[start.Unix()]
+		if exists == false {
+			bucket = StatsBucket{Bucket: start}
+		}
+
+		bucket.Bucket = start
+		filled = append(filled, bucket)
+	}
+
+	return filled
+}
+
+func percentageChange(previous int, current int) *float64 {
+	if previous == 0 {
+		return nil
+	}
+
+	change := float64(current-previous) / float64(previous) * 100
+	return &change
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// Stable identifiers of the errors the api responds with, clients should branch on them instead of the messages
+type ErrorCode string
+
+const (
+	// The body is missing or isn't valid JSON
+	ErrorCodeInvalidBody ErrorCode = "invalid_body"
+	// The body is well formed but some of its fields aren't valid, they're listed by field
+	ErrorCodeValidationFailed ErrorCode = "validation_failed"
+	// Some query parameters aren't valid, they're listed by parameter
+	ErrorCodeInvalidQuery ErrorCode = "invalid_query"
+	ErrorCodeInvalidId    ErrorCode = "invalid_id"
+	// No credentials were sent to a route that requires them
+	ErrorCodeUnauthorized       ErrorCode = "unauthorized"
+	ErrorCodeInvalidCredentials ErrorCode = "invalid_credentials"
+	ErrorCodeCollectionNotFound ErrorCode = "collection_not_found"
+	// An entry, goal or other document doesn't exist
+	ErrorCodeResourceNotFound ErrorCode = "resource_not_found"
+	ErrorCodeRouteNotFound    ErrorCode = "route_not_found"
+	ErrorCodeRateLimited      ErrorCode = "rate_limited"
+	// Uploads whose sniffed type the attribute doesn't accept
+	ErrorCodeUnsupportedMediaType ErrorCode = "unsupported_media_type"
+	ErrorCodePayloadTooLarge      ErrorCode = "payload_too_large"
+	// A chunk doesn't start where the upload session left off
+	ErrorCodeUploadOffsetMismatch ErrorCode = "upload_offset_mismatch"
+	// The image store failed to serve stored media
+	ErrorCodeStorageUnavailable ErrorCode = "storage_unavailable"
+	// Weekly reports were requested without a notifier configured
+	ErrorCodeReportsDisabled ErrorCode = "reports_disabled"
+	ErrorCodeClientClosed    ErrorCode = "client_closed_request"
+	ErrorCodeTimeout         ErrorCode = "timeout"
+	ErrorCodeInternal        ErrorCode = "internal_error"
+)
+
+var errorCodeStatuses = map[ErrorCode]int{
+	ErrorCodeInvalidBody:          http.StatusBadRequest,
+	ErrorCodeValidationFailed:     http.StatusUnprocessableEntity,
+	ErrorCodeInvalidQuery:         http.StatusBadRequest,
+	ErrorCodeInvalidId:            http.StatusBadRequest,
+	ErrorCodeUnauthorized:         http.StatusUnauthorized,
+	ErrorCodeInvalidCredentials:   http.StatusUnauthorized,
+	ErrorCodeCollectionNotFound:   http.StatusNotFound,
+	ErrorCodeResourceNotFound:     http.StatusNotFound,
+	ErrorCodeRouteNotFound:        http.StatusNotFound,
+	ErrorCodeRateLimited:          http.StatusTooManyRequests,
+	ErrorCodeUnsupportedMediaType: http.StatusUnsupportedMediaType,
+	ErrorCodePayloadTooLarge:      http.StatusRequestEntityTooLarge,
+	ErrorCodeUploadOffsetMismatch: http.StatusConflict,
+	ErrorCodeStorageUnavailable:   http.StatusBadGateway,
+	ErrorCodeReportsDisabled:      http.StatusServiceUnavailable,
+	ErrorCodeClientClosed:         StatusClientClosedRequest,
+	ErrorCodeTimeout:              http.StatusGatewayTimeout,
+	ErrorCodeInternal:             http.StatusInternalServerError,
+}
+
+func (c ErrorCode) Status() int {
+	status, exists := errorCodeStatuses[c]
+	if exists == false {
+		return http.StatusInternalServerError
+	}
+
+	return status
+}
+
+// An error the api responds with. The cause is only logged, internal details never reach the response.
+type APIError struct {
+	Code    ErrorCode
+	Message string
+	// Problems of the request by field or query parameter
+	Fields Misses
+	Cause  error
+}
+
+func newAPIError(code ErrorCode, message string) *APIError {
+	return &APIError{Code: code, Message: message}
+}
+
+func validationError(code ErrorCode, message string, fields Misses) *APIError {
+	return &APIError{Code: code, Message: message, Fields: fields}
+}
+
+func (e *APIError) Error() string {
+	if e.Cause != nil {
+		return e.Message + ": " + e.Cause.Error()
+	}
+
+	return e.Message
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Cause
+}
+
+// Turns any error into an APIError. Errors of the database keep their meaning (missing collections and documents,
+// cancelled requests), everything else is an internal error described by the message.
+func toAPIError(err error, message string) *APIError {
+	var apiError *APIError
+	if errors.As(err, &apiError) {
+		return apiError
+	}
+
+	var cancelled *DBCancelledError
+	if errors.As(err, &cancelled) {
+		if cancelled.TimedOut() {
+			return &APIError{Code: ErrorCodeTimeout, Message: message, Cause: err}
+		}
+
+		return &APIError{Code: ErrorCodeClientClosed, Message: message, Cause: err}
+	}
+
+	var notFound *DBNotFoundError
+	if errors.As(err, &notFound) {
+		if notFound.Document {
+			return &APIError{Code: ErrorCodeResourceNotFound, Message: notFound.Error()}
+		}
+
+		return &APIError{Code: ErrorCodeCollectionNotFound, Message: notFound.Error()}
+	}
+
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return &APIError{Code: ErrorCodeResourceNotFound, Message: message}
+	}
+
+	return &APIError{Code: ErrorCodeInternal, Message: message, Cause: err}
+}
+
+// RFC 7807 problem details, sent instead of a ResponseMessage when errors.problemDetails is set
+// or the client accepts application/problem+json
+type ProblemDetails struct {
+	Type      string    `json:"type"`
+	Title     string    `json:"title"`
+	Status    int       `json:"status"`
+	Detail    string    `json:"detail,omitempty"`
+	Instance  string    `json:"instance,omitempty"`
+	Code      ErrorCode `json:"code"`
+	Errors    Misses    `json:"errors,omitempty"`
+	RequestId string    `json:"requestId,omitempty"`
+}
+
+// Titles of the statuses net/http doesn't name
+var nonStandardStatusTitles = map[int]string{
+	StatusClientClosedRequest: "Client Closed Request",
+}
+
+// The title of problems is the same for every problem of the status
+func statusTitle(status int) string {
+	if title, exists := nonStandardStatusTitles[status]; exists {
+		return title
+	}
+
+	if title := http.StatusText(status); title != "" {
+		return title
+	}
+
+	return "Error"
+}
+
+func wantsProblemDetails(r *http.Request) bool {
+	return appConfig.Errors.ProblemDetails || strings.Contains(r.Header.Get("Accept"), "application/problem+json")
+}
+
+// Responds with the error, errors that aren't APIErrors are internal errors.
+// Server errors are logged with their cause, client errors aren't.
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	apiError := toAPIError(err, "Internal server error")
+	status := apiError.Code.Status()
+
+	if status >= http.StatusInternalServerError {
+		slog.ErrorContext(r.Context(), apiError.Message, "code", apiError.Code, "error", apiError.Cause)
+	}
+
+	if wantsProblemDetails(r) == false {
+		WriteJSON(w, status, ResponseMessage{
+			Status:  StatusCodeError,
+			Code:    apiError.Code,
+			Message: apiError.Message,
+			Data:    apiError.Fields,
+		})
+		return
+	}
+
+	problemType := "about:blank"
+	if appConfig.Errors.ProblemTypeBaseURL != "" {
+		problemType = appConfig.Errors.ProblemTypeBaseURL + string(apiError.Code)
+	}
+
+	writeJSONAs(w, status, "application/problem+json", ProblemDetails{
+		Type:      problemType,
+		Title:     statusTitle(status),
+		Status:    status,
+		Detail:    apiError.Message,
+		Instance:  r.URL.Path,
+		Code:      apiError.Code,
+		Errors:    apiError.Fields,
+		RequestId: requestIdFromContext(r.Context()),
+	})
+}
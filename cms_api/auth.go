@@ -1,11 +1,9 @@
 package main
 
 import (
-	"log"
+	"crypto/sha256"
 	"maps"
 	"net/http"
-	"os"
-	"strings"
 
 	"go.mongodb.org/mongo-driver/v2/mongo"
 	"golang.org/x/crypto/bcrypt"
@@ -15,66 +13,71 @@ func handleAuthRoutes(db *mongo.Client) *http.ServeMux {
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("POST /login", login(db))
-	mux.HandleFunc("OPTIONS /login", handlePrefligh())
 
 	return mux
 }
 
 func login(db *mongo.Client) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		body, misses, err := ReadBodyJSON[LoginBody](r, db)
+		body, _, err := ReadBodyJSON[LoginBody](r, db)
 		if err != nil {
-			WriteJSON(w, http.StatusInternalServerError, ResponseMessage{
-				Status: StatusCodeError,
-				Message: err.Error(),
-				Data: misses,
-			})
+			WriteError(w, r, toAPIError(err, "Error while validating the login"))
 			return
 		}
 
-		password, ok := body["pass"].(string)
-		if ok == false {
-			WriteJSON(w, http.StatusBadRequest, ResponseMessage{
-				Status: StatusCodeError,
-				Message: "Password must be a string",
-			})
-			return
-		}
-		
+		password, _ := body["pass"].(string)
 		isValid := validatePassword(password)
 		if isValid == false {
-			WriteJSON(w, http.StatusUnauthorized, ResponseMessage{
-				Status: StatusCodeError,
-				Message: "Bad password",
-			})
+			WriteError(w, r, errBadPassword)
 			return
 		}
 
 		WriteJSON(w, http.StatusOK, ResponseMessage{
-			Status: StatusCodeOk,
+			Status:  StatusCodeOk,
 			Message: "Hello World",
 		})
 	}
 }
 
+var (
+	errNotAuthorized = newAPIError(ErrorCodeUnauthorized, "Not authorized to perform this action")
+	errBadPassword   = newAPIError(ErrorCodeInvalidCredentials, "Bad password")
+)
+
+// Whether the request carries valid credentials, for public routes that reveal more to logged in callers
+func isAuthenticated(r *http.Request) bool {
+	password := r.Header.Get("Authorization")
+	if password == "" {
+		return false
+	}
+
+	return validatePassword(password)
+}
+
+// Unlike ensureLoggedIn it also guards GET requests, for routes that are never public
+func ensureAuthenticated(next func(http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if isAuthenticated(r) == false {
+			WriteError(w, r, errNotAuthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
 func ensureLoggedIn(next func(http.ResponseWriter, *http.Request)) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			password := r.Header.Get("Authorization")
 			if password == "" {
-				WriteJSON(w, http.StatusUnauthorized, ResponseMessage{
-					Status: StatusCodeError,
-					Message: "Not authorized to perform this action",
-				})
+				WriteError(w, r, errNotAuthorized)
 				return
 			}
 
 			isValid := validatePassword(password)
 			if isValid == false {
-				WriteJSON(w, http.StatusUnauthorized, ResponseMessage{
-					Status: StatusCodeError,
-					Message: "Bad password",
-				})
+				WriteError(w, r, errBadPassword)
 				return
 			}
 		}
@@ -84,20 +87,38 @@ func ensureLoggedIn(next func(http.ResponseWriter, *http.Request)) http.HandlerF
 }
 
 func validatePassword(password string) bool {
-	expectedHash := os.Getenv("LOGIN_HASH")
-	log.Println("Authenticating against:", expectedHash)
+	expectedHash := appConfig.Auth.LoginHash
 	err := bcrypt.CompareHashAndPassword([]byte(expectedHash), []byte(password))
 	if err != nil {
-		hash, _ := bcrypt.GenerateFromPassword([]byte(password), 14)
-		log.Println("Expected", string(hash))
 		return false
 	}
 
+	validatedCredentials.Add(credentialDigest(password), true)
 	return true
 }
 
+// Digests of the credentials that passed validation, so the rate limiter can recognize authenticated
+// callers without running bcrypt on every request. They're only kept in memory.
+var validatedCredentials = newLRUCache[string, bool](16)
+
+func credentialDigest(password string) string {
+	digest := sha256.Sum256([]byte(password))
+	return string(digest[:])
+}
+
+// Whether the credentials of the request have already been validated, without validating them
+func hasValidatedCredentials(r *http.Request) bool {
+	password := r.Header.Get("Authorization")
+	if password == "" {
+		return false
+	}
+
+	_, validated := validatedCredentials.Get(credentialDigest(password))
+	return validated
+}
+
 type LoginBody map[string]interface{}
-func (l LoginBody) Validate(r *http.Request, db *mongo.Client) Misses {
+func (l LoginBody) Validate(r *http.Request, db *mongo.Client) (Misses, error) {
 	misses := make(Misses, 0)
 
 	expectOptional := map[string]bool{"pass": true}
@@ -108,10 +129,13 @@ func (l LoginBody) Validate(r *http.Request, db *mongo.Client) Misses {
 		}
 	}
 
-	if len(tooMany) > 0 {
-		misses["general.too_many_arguments"] = "The following keys are not in scope: " + strings.Join(tooMany, ", ")
-		return misses
+	for _, key := range tooMany {
+		misses[key] = "Isn't a login field"
+	}
+
+	if _, ok := l["pass"].(string); ok == false {
+		misses["pass"] = "Must be a string"
 	}
 
-	return misses
+	return misses, nil
 }
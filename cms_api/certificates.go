@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+const certificateReloadInterval = time.Minute
+
+// Serves the TLS certificate from disk, picking up renewals (e.g. by certbot) without a restart
+type CertificateReloader struct {
+	mu          sync.RWMutex
+	certFile    string
+	keyFile     string
+	certificate *tls.Certificate
+	modified    time.Time
+}
+
+func newCertificateReloader(certFile string, keyFile string) (*CertificateReloader, error) {
+	reloader := &CertificateReloader{certFile: certFile, keyFile: keyFile}
+
+	err := reloader.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return reloader, nil
+}
+
+// Reloads the certificate when either file changed since it was last read.
+// A broken renewal keeps the previous certificate in use.
+func (c *CertificateReloader) Reload() error {
+	modified, err := c.lastModified()
+	if err != nil {
+		return err
+	}
+
+	c.mu.RLock()
+	unchanged := modified.Equal(c.modified)
+	c.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Couldn't load the TLS certificate: %v", err))
+	}
+
+	c.mu.Lock()
+	c.certificate = &certificate
+	c.modified = modified
+	c.mu.Unlock()
+
+	if certificate.Leaf != nil {
+		slog.Info("Loaded the TLS certificate", "commonName", certificate.Leaf.Subject.CommonName, "notAfter", certificate.Leaf.NotAfter)
+	}
+
+	return nil
+}
+
+func (c *CertificateReloader) lastModified() (time.Time, error) {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if keyInfo.ModTime().After(certInfo.ModTime()) {
+		return keyInfo.ModTime(), nil
+	}
+
+	return certInfo.ModTime(), nil
+}
+
+// Used as tls.Config.GetCertificate so every handshake gets the latest certificate
+func (c *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.certificate, nil
+}
+
+// Periodically picks up renewed certificates
+func (c *CertificateReloader) Job() Job {
+	return Job{
+		Name:     "tls_certificate",
+		Interval: certificateReloadInterval,
+		Run: func(ctx context.Context, db *mongo.Client) error {
+			return c.Reload()
+		},
+	}
+}
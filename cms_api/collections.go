@@ -2,8 +2,9 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"maps"
 	"net/http"
 	"strconv"
@@ -13,6 +14,7 @@ import (
 	"go.mongodb.org/mongo-driver/v2/bson"
 	"go.mongodb.org/mongo-driver/v2/mongo"
 	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"go.opentelemetry.io/otel/codes"
 )
 
 type NewCollection map[string]interface{}
@@ -25,6 +27,7 @@ const (
 	CollectionAttrTypeDate   CollectionAttrType = "date"
 	CollectionAttrTypeImage  CollectionAttrType = "image"
 	CollectionAttrTypeMDX    CollectionAttrType = "mdx"
+	CollectionAttrTypeFile   CollectionAttrType = "file"
 )
 
 var ValidAttrTypes map[CollectionAttrType]bool = map[CollectionAttrType]bool{
@@ -32,6 +35,19 @@ var ValidAttrTypes map[CollectionAttrType]bool = map[CollectionAttrType]bool{
 	CollectionAttrTypeDate:   true,
 	CollectionAttrTypeImage:  true,
 	CollectionAttrTypeMDX:    true,
+	CollectionAttrTypeFile:   true,
+}
+
+// An attribute as defined in a collection's schema.
+// File attributes can restrict the mime types and size (in bytes) of their attachments.
+// Image and file attributes can be private.
+type CollectionAttribute struct {
+	Name      string
+	Type      CollectionAttrType
+	MimeTypes []string
+	MaxSize   int64
+	// Private images and files are only served through presigned urls to logged in callers
+	Private bool
 }
 
 func handleCollectionRoutes(db *mongo.Client, imageStore *ImageStore) *http.ServeMux {
@@ -41,32 +57,23 @@ func handleCollectionRoutes(db *mongo.Client, imageStore *ImageStore) *http.Serv
 	mux.HandleFunc("GET /collections/{collection}", getCollectionSingle(db))
 	mux.HandleFunc("POST /collections", ensureLoggedIn(createCollection(db)))
 	mux.HandleFunc("PUT /collections/{collection}", updateCollection(db))
-	mux.HandleFunc("DELETE /collections/{collection}", deleteCollection(db))
+	mux.HandleFunc("DELETE /collections/{collection}", deleteCollection(db, imageStore))
 
-	mux.HandleFunc("GET /{collection}", getData(db))
-	mux.HandleFunc("GET /{collection}/{id}", getDataSingle(db))
-	mux.HandleFunc("POST /{collection}", createData(db, imageStore))
+	mux.HandleFunc("GET /{collection}", getData(db, imageStore))
+	mux.HandleFunc("GET /{collection}/{id}", getDataSingle(db, imageStore))
+	mux.HandleFunc("POST /{collection}", createData(db))
 	mux.HandleFunc("PUT /{collection}/{id}", updateData(db, imageStore))
 	mux.HandleFunc("DELETE /{collection}/{id}", deleteData(db, imageStore))
 
-	mux.HandleFunc("OPTIONS /collections", handlePrefligh())
-	mux.HandleFunc("OPTIONS /collections/{collection}", handlePrefligh())
-	mux.HandleFunc("OPTIONS /{collection}", handlePrefligh())
-	mux.HandleFunc("OPTIONS /{collection}/{id}", handlePrefligh())
-
 	return mux
 }
 
 func getCollections(db *mongo.Client) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		cmsDB := db.Database(CMS_DATABASE)
-		results, err := getDBResource(cmsDB, CMS_C_COLLECTIONS, bson.D{}, options.Find().SetProjection(publicProjection))
+		results, err := getDBResource(r.Context(), cmsDB, CMS_C_COLLECTIONS, bson.D{}, options.Find().SetProjection(publicProjection))
 		if err != nil {
-			WriteJSON(w, http.StatusInternalServerError, ResponseMessage{
-				Status:  StatusCodeError,
-				Message: err.Error(),
-			})
-			log.Println(err.Error())
+			WriteError(w, r, toAPIError(err, "Error while getting collections"))
 			return
 		}
 
@@ -81,24 +88,20 @@ func getCollectionSingle(db *mongo.Client) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		cmsDB := db.Database(CMS_DATABASE)
 		collectionPath := r.PathValue("collection")
-		results, err := getDBResource(cmsDB, CMS_C_COLLECTIONS, bson.M{"path": collectionPath})
+		results, err := getDBResource(r.Context(), cmsDB, CMS_C_COLLECTIONS, bson.M{"path": collectionPath})
 		if err != nil {
-			WriteJSON(w, http.StatusInternalServerError, ResponseMessage{
-				Status:  StatusCodeError,
-				Message: err.Error(),
-			})
-			log.Println(err.Error())
+			WriteError(w, r, toAPIError(err, "Error while getting collection"))
 			return
 		}
 
-		var data any
-		if len(results) > 0 {
-			data = results[0]
+		if len(results) == 0 {
+			WriteError(w, r, collectionNotFound(collectionPath))
+			return
 		}
 
 		WriteJSON(w, http.StatusOK, ResponseMessage{
 			Status: StatusCodeOk,
-			Data:   data,
+			Data:   results[0],
 		})
 	}
 }
@@ -106,32 +109,28 @@ func getCollectionSingle(db *mongo.Client) http.HandlerFunc {
 func createCollection(db *mongo.Client) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		cmsDatabase := db.Database(CMS_DATABASE)
-		newCollection, misses, err := ReadBodyJSON[NewCollection](r, db)
+		newCollection, _, err := ReadBodyJSON[NewCollection](r, db)
 		if err != nil {
-			response := ResponseMessage{Status: StatusCodeError, Message: err.Error(), Data: misses}
-			WriteJSON(w, http.StatusBadRequest, response)
-			log.Println("Error while creating new collection:", err)
+			WriteError(w, r, toAPIError(err, "Error while validating the new collection"))
 			return
 		}
 
 		name, _ := (newCollection["name"]).(string)
 		newCollection["path"] = StringToPath(name)
 		newCollection["modifiedAt"] = time.Now()
-		insertedCollection, err := createDBResource(cmsDatabase, CMS_C_COLLECTIONS, newCollection)
+		insertedCollection, err := createDBResource(r.Context(), cmsDatabase, CMS_C_COLLECTIONS, newCollection)
 		if err != nil {
-			WriteJSON(w, http.StatusBadRequest, ResponseMessage{Status: StatusCodeError, Message: "Invalid Syntax: " + err.Error()})
-			log.Println("Error while creating new collection:", err)
+			WriteError(w, r, toAPIError(err, "Error while creating collection"))
 			return
 		}
 
-		err = createDBCollection(cmsDatabase, (insertedCollection["path"]).(string))
+		err = createDBCollection(r.Context(), cmsDatabase, (insertedCollection["path"]).(string))
 		if err != nil {
-			WriteJSON(w, http.StatusBadRequest, ResponseMessage{Status: StatusCodeError, Message: "Error while creating collection: " + err.Error()})
-			log.Println("Error while creating new collection:", err)
+			WriteError(w, r, toAPIError(err, "Error while creating collection"))
 			return
 		}
 
-		WriteJSON(w, http.StatusOK, ResponseMessage{Status: StatusCodeOk, Message: "Created collection successfully", Data: insertedCollection})
+		WriteJSON(w, http.StatusCreated, ResponseMessage{Status: StatusCodeOk, Message: "Created collection successfully", Data: insertedCollection})
 	}
 }
 
@@ -140,11 +139,21 @@ func updateCollection(db *mongo.Client) http.HandlerFunc {
 		cmsAdminDatabase := db.Database("admin")
 		cmsDatabase := db.Database(CMS_DATABASE)
 		collectionPath := r.PathValue("collection")
-		collectionChanges, misses, err := ReadBodyJSON[Collection](r, db)
+		collectionChanges, _, err := ReadBodyJSON[Collection](r, db)
 		if err != nil {
-			response := ResponseMessage{Status: StatusCodeError, Message: err.Error(), Data: misses}
-			WriteJSON(w, http.StatusBadRequest, response)
-			log.Println("Error while updating collection:", err)
+			WriteError(w, r, toAPIError(err, "Error while validating the collection changes"))
+			return
+		}
+
+		// Renaming the entries of a collection that doesn't exist would fail with a database error instead of a 404
+		collections, err := getDBResource(r.Context(), cmsDatabase, CMS_C_COLLECTIONS, bson.M{"path": collectionPath})
+		if err != nil {
+			WriteError(w, r, toAPIError(err, "Error while getting collection"))
+			return
+		}
+
+		if len(collections) == 0 {
+			WriteError(w, r, collectionNotFound(collectionPath))
 			return
 		}
 
@@ -155,26 +164,21 @@ func updateCollection(db *mongo.Client) http.HandlerFunc {
 
 		if collectionPath != newCollectionPath {
 			collectionChanges["path"] = newCollectionPath
-			err := renameDBCollection(cmsAdminDatabase, CMS_DATABASE, collectionPath, newCollectionPath)
+			err := renameDBCollection(r.Context(), cmsAdminDatabase, CMS_DATABASE, collectionPath, newCollectionPath)
 			if err != nil {
-				errorMessage := fmt.Sprintf("Error while updating collections: %v", err.Error())
-				WriteJSON(w, http.StatusInternalServerError, ResponseMessage{
-					Status:  StatusCodeError,
-					Message: errorMessage,
-				})
-				log.Println(errorMessage)
+				WriteError(w, r, toAPIError(err, "Error while renaming collection"))
 				return
 			}
 		}
 
-		updatedResource, err := updateDBResource(cmsDatabase, CMS_C_COLLECTIONS, bson.D{{Key: "name", Value: collectionPath}}, bson.M{"$set": collectionChanges})
+		updatedResource, err := updateDBResource(r.Context(), cmsDatabase, CMS_C_COLLECTIONS, bson.D{{Key: "path", Value: collectionPath}}, bson.M{"$set": collectionChanges})
+		if errors.As(err, new(*DBNotFoundError)) {
+			WriteError(w, r, collectionNotFound(collectionPath))
+			return
+		}
+
 		if err != nil {
-			errorMessage := fmt.Sprintf("Error while updating collections: %v", err.Error())
-			WriteJSON(w, http.StatusInternalServerError, ResponseMessage{
-				Status:  StatusCodeError,
-				Message: errorMessage,
-			})
-			log.Println(errorMessage)
+			WriteError(w, r, toAPIError(err, "Error while updating collection"))
 			return
 		}
 
@@ -186,72 +190,79 @@ func updateCollection(db *mongo.Client) http.HandlerFunc {
 	}
 }
 
-func deleteCollection(db *mongo.Client) http.HandlerFunc {
+func deleteCollection(db *mongo.Client, imageStore *ImageStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		cmsDatabase := db.Database(CMS_DATABASE)
 		collectionPath := r.PathValue("collection")
-		err := deleteDBResource(cmsDatabase, CMS_C_COLLECTIONS, bson.M{"path": collectionPath})
+		err := deleteDBResource(r.Context(), cmsDatabase, CMS_C_COLLECTIONS, bson.M{"path": collectionPath})
+		if errors.As(err, new(*DBNotFoundError)) {
+			WriteError(w, r, collectionNotFound(collectionPath))
+			return
+		}
+
 		if err != nil {
-			WriteJSON(w, http.StatusBadRequest, ResponseMessage{Status: StatusCodeError, Message: err.Error()})
-			log.Println("Error while deleting collection:", err)
+			WriteError(w, r, toAPIError(err, "Error while deleting collection"))
 			return
 		}
 
-		deleteDBCollection(cmsDatabase, collectionPath)
+		entries, err := getDBResource(r.Context(), cmsDatabase, collectionPath, bson.D{})
 		if err != nil {
-			WriteJSON(w, http.StatusBadRequest, ResponseMessage{Status: StatusCodeError, Message: err.Error()})
-			log.Println("Error while deleting collection:", err)
+			slog.ErrorContext(r.Context(), "Error while collecting entries of deleted collection", "error", err)
+		}
+
+		err = deleteDBCollection(r.Context(), cmsDatabase, collectionPath)
+		if err != nil {
+			WriteError(w, r, toAPIError(err, "Error while deleting collection"))
 			return
 		}
+
+		deleteReferencedImages(context.WithoutCancel(r.Context()), db, imageStore, entries...)
 		WriteJSON(w, http.StatusOK, ResponseMessage{Status: StatusCodeOk, Message: fmt.Sprintf("Deleted collection %q sucessfully", collectionPath)})
 	}
 }
 
-func getData(db *mongo.Client) http.HandlerFunc {
+func getData(db *mongo.Client, imageStore *ImageStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		cmsDatabase := db.Database(CMS_DATABASE)
 		collectionPath := r.PathValue("collection")
+		ctx, cancel := context.WithTimeout(r.Context(), appConfig.Database.RequestTimeout)
+		defer cancel()
 
-		list, err := cmsDatabase.ListCollectionNames(context.TODO(), bson.M{"name": collectionPath})
+		list, err := cmsDatabase.ListCollectionNames(ctx, bson.M{"name": collectionPath})
 		if err != nil {
-			message := fmt.Sprintf("Error while getting data from collection (%v): %v", collectionPath, err.Error())
-			WriteJSON(w, http.StatusBadRequest, ResponseMessage{Status: StatusCodeError, Message: message})
-			log.Println(message)
+			WriteError(w, r, toAPIError(wrapDBError(ctx, collectionPath, err), "Error while getting entries"))
 			return
 		}
 
 		if len(list) == 0 {
-			message := fmt.Sprintf("Couldn't find collection (%v)", collectionPath)
-			WriteJSON(w, http.StatusBadRequest, ResponseMessage{Status: StatusCodeError, Message: message})
+			WriteError(w, r, collectionNotFound(collectionPath))
 			return
 		}
 
 		cmsCollectionData := db.Database(CMS_DATABASE).Collection(collectionPath)
-		response, err := cmsCollectionData.Find(context.TODO(), bson.D{})
+		response, err := cmsCollectionData.Find(ctx, bson.D{})
 		if err != nil {
-			message := fmt.Sprintf("Error while getting data from collection (%v): %v", collectionPath, err.Error())
-			WriteJSON(w, http.StatusInternalServerError, ResponseMessage{
-				Status:  StatusCodeError,
-				Message: message,
-			})
-			log.Println(message)
+			WriteError(w, r, toAPIError(wrapDBError(ctx, collectionPath, err), "Error while getting entries"))
 			return
 		}
 
 		results := []bson.M{}
-		for response.Next(context.TODO()) {
+		for response.Next(ctx) {
 			result := bson.M{}
 			err = response.Decode(&result)
 			if err != nil && (mongo.IsNetworkError(err) || mongo.IsTimeout(err)) {
-				message := fmt.Sprintf("Error while searching for entries in collection (%v): %v", collectionPath, err.Error())
-				WriteJSON(w, http.StatusInternalServerError, ResponseMessage{Status: StatusCodeError, Message: message})
-				log.Println(message)
+				WriteError(w, r, toAPIError(wrapDBError(ctx, collectionPath, err), "Error while getting entries"))
 				return
 			}
 
 			results = append(results, result)
 		}
 
+		authenticated := isAuthenticated(r)
+		for _, result := range results {
+			resolvePrivateAssets(r.Context(), imageStore, result, authenticated)
+		}
+
 		WriteJSON(w, http.StatusOK, ResponseMessage{
 			Status: StatusCodeOk,
 			Data:   results,
@@ -259,101 +270,73 @@ func getData(db *mongo.Client) http.HandlerFunc {
 	}
 }
 
-func getDataSingle(db *mongo.Client) http.HandlerFunc {
+// Private assets are resolved to presigned urls for logged in callers, published ones keep their public urls
+func getDataSingle(db *mongo.Client, imageStore *ImageStore) http.HandlerFunc {
 	cmsDatabase := db.Database(CMS_DATABASE)
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		collectionPath := r.PathValue("collection")
+		ctx, cancel := context.WithTimeout(r.Context(), appConfig.Database.RequestTimeout)
+		defer cancel()
 
-		list, err := cmsDatabase.ListCollectionNames(context.TODO(), bson.M{"name": collectionPath})
+		list, err := cmsDatabase.ListCollectionNames(ctx, bson.M{"name": collectionPath})
 		if err != nil {
-			message := fmt.Sprintf("Error while getting data from collection (%v): %v", collectionPath, err.Error())
-			WriteJSON(w, http.StatusBadRequest, ResponseMessage{Status: StatusCodeError, Message: message})
-			log.Println(message)
+			WriteError(w, r, toAPIError(wrapDBError(ctx, collectionPath, err), "Error while getting entry"))
 			return
 		}
 
 		if len(list) == 0 {
-			message := fmt.Sprintf("Couldn't find collection (%v)", collectionPath)
-			WriteJSON(w, http.StatusBadRequest, ResponseMessage{Status: StatusCodeError, Message: message})
+			WriteError(w, r, collectionNotFound(collectionPath))
 			return
 		}
 
-		cmsCollectionData := db.Database(CMS_DATABASE).Collection(collectionPath)
 		dataHexId := r.PathValue("id")
 		dataObjectId, err := bson.ObjectIDFromHex(dataHexId)
 		if err != nil {
-			message := fmt.Sprintf("Error while searching for (%v) in collection (%v): %v", dataHexId, collectionPath, err.Error())
-			WriteJSON(w, http.StatusBadRequest, ResponseMessage{Status: StatusCodeError, Message: message})
-			log.Println(message)
+			WriteError(w, r, invalidEntryId(dataHexId))
 			return
 		}
 
-		response := cmsCollectionData.FindOne(context.TODO(), bson.M{"_id": dataObjectId})
+		cmsCollectionData := db.Database(CMS_DATABASE).Collection(collectionPath)
+		response := cmsCollectionData.FindOne(ctx, bson.M{"_id": dataObjectId})
 		result := bson.M{}
 		err = response.Decode(&result)
-		if err != nil && (mongo.IsNetworkError(err) || mongo.IsTimeout(err)) {
-			message := fmt.Sprintf("Error while searching for (%v) in collection (%v): %v", dataHexId, collectionPath, err.Error())
-			WriteJSON(w, http.StatusInternalServerError, ResponseMessage{Status: StatusCodeError, Message: message})
-			log.Println(message)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			WriteError(w, r, entryNotFound(dataHexId, collectionPath))
 			return
 		}
 
-		status := StatusCodeOk
-		message := ""
-		if _, exists := result["_id"]; exists == false {
-			status = StatusCodeError
-			message = fmt.Sprintf("Couldn't find (%v) in collection (%v)", dataHexId, collectionPath)
+		if err != nil {
+			WriteError(w, r, toAPIError(wrapDBError(ctx, collectionPath, err), "Error while getting entry"))
+			return
 		}
 
+		resolvePrivateAssets(r.Context(), imageStore, result, isAuthenticated(r))
+
 		WriteJSON(w, http.StatusOK, ResponseMessage{
-			Status:  status,
-			Message: message,
-			Data:    result,
+			Status: StatusCodeOk,
+			Data:   result,
 		})
 	}
 }
 
-func createData(db *mongo.Client, imageStore *ImageStore) http.HandlerFunc {
+func createData(db *mongo.Client) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		cmsDatabase := db.Database(CMS_DATABASE)
 		collectionPath := r.PathValue("collection")
-		newCollectionData, misses, err := ReadBodyJSON[CollectionData](r, db)
+		newCollectionData, _, err := ReadBodyJSON[CollectionData](r, db)
 		if err != nil {
-			response := ResponseMessage{Status: StatusCodeError, Message: err.Error(), Data: misses}
-			WriteJSON(w, http.StatusBadRequest, response)
-			log.Println("Error while creating new data:", err)
+			WriteError(w, r, toAPIError(err, "Error while validating the new entry"))
 			return
 		}
 
-		for key, value := range newCollectionData {
-			valueStringAsserted, ok := value.(string)
-			if ok == false {
-				continue
-			}
-
-			if strings.HasPrefix(valueStringAsserted, "data:image/") == false {
-				continue
-			}
-
-			url, err := uploadBase64ImageToImageStore(imageStore, valueStringAsserted)
-			if err != nil {
-				log.Println("Error while uploading b64 image to image store:", err)
-				continue
-			}
-
-			newCollectionData[key] = url
-		}
-
-		data, err := createDBResource(cmsDatabase, collectionPath, newCollectionData)
+		data, err := createDBResource(r.Context(), cmsDatabase, collectionPath, newCollectionData)
 		if err != nil {
-			message := fmt.Sprintf("Error while creating data in collection (%v): %v", collectionPath, err.Error())
-			WriteJSON(w, http.StatusInternalServerError, ResponseMessage{Status: StatusCodeError, Message: message})
-			log.Println(message)
+			WriteError(w, r, toAPIError(err, "Error while creating entry"))
 			return
 		}
 
-		WriteJSON(w, http.StatusOK, ResponseMessage{Status: StatusCodeOk, Message: "Created collection successfully", Data: data})
+		WriteJSON(w, http.StatusCreated, ResponseMessage{Status: StatusCodeOk, Message: "Created collection successfully", Data: data})
 	}
 }
 
@@ -362,57 +345,44 @@ func updateData(db *mongo.Client, imageStore *ImageStore) http.HandlerFunc {
 		cmsDatabase := db.Database(CMS_DATABASE)
 		collectionPath := r.PathValue("collection")
 
-		newCollectionData, misses, err := ReadBodyJSON[CollectionData](r, db)
+		dataHexId := r.PathValue("id")
+		dataObjectId, err := bson.ObjectIDFromHex(dataHexId)
 		if err != nil {
-			response := ResponseMessage{Status: StatusCodeError, Message: err.Error(), Data: misses}
-			WriteJSON(w, http.StatusBadRequest, response)
-			log.Println("Error while updating data:", err)
+			WriteError(w, r, invalidEntryId(dataHexId))
 			return
 		}
 
-		dataHexId := r.PathValue("id")
-		dataObjectId, _ := bson.ObjectIDFromHex(dataHexId)
-
-		oldCollectionData, err := getDBResource(cmsDatabase, collectionPath, bson.M{"_id": dataObjectId})
+		newCollectionData, _, err := ReadBodyJSON[CollectionData](r, db)
 		if err != nil {
-			message := fmt.Sprintf("Error while updating data for (%v) in collection (%v): %v", dataHexId, collectionPath, err.Error())
-			WriteJSON(w, http.StatusInternalServerError, ResponseMessage{Status: StatusCodeError, Message: message})
-			log.Println(message)
+			WriteError(w, r, toAPIError(err, "Error while validating the entry changes"))
 			return
 		}
 
-		for key, value := range newCollectionData {
-			valueStringAsserted, ok := value.(string)
-			if ok == false {
-				continue
-			}
-
-			if strings.HasPrefix(valueStringAsserted, "data:image/") == false {
-				continue
-			}
-
-			oldImgUrl, _ := oldCollectionData[0][key]
-			if strings.HasPrefix(oldImgUrl.(string), "data:image/") == true {
-				imageStore.Delete(oldImgUrl.(string))
-			}
-
-			url, err := uploadBase64ImageToImageStore(imageStore, valueStringAsserted)
-			if err != nil {
-				log.Println("Error while uploading b64 image to image store:", err)
-				continue
-			}
+		oldCollectionData, err := getDBResource(r.Context(), cmsDatabase, collectionPath, bson.M{"_id": dataObjectId})
+		if err != nil {
+			WriteError(w, r, toAPIError(err, "Error while updating entry"))
+			return
+		}
 
-			newCollectionData[key] = url
+		if len(oldCollectionData) == 0 {
+			WriteError(w, r, entryNotFound(dataHexId, collectionPath))
+			return
 		}
 
-		response, err := updateDBResource(cmsDatabase, collectionPath, bson.M{"_id": dataObjectId}, bson.M{"$set": newCollectionData})
+		response, err := updateDBResource(r.Context(), cmsDatabase, collectionPath, bson.M{"_id": dataObjectId}, bson.M{"$set": newCollectionData})
 		if err != nil {
-			message := fmt.Sprintf("Error while updating data for (%v) in collection (%v): %v", dataHexId, collectionPath, err.Error())
-			WriteJSON(w, http.StatusInternalServerError, ResponseMessage{Status: StatusCodeError, Message: message})
-			log.Println(message)
+			WriteError(w, r, toAPIError(err, "Error while updating entry"))
 			return
 		}
 
+		// Images are only removed once the entry no longer references them, so a failed update never loses one
+		replacedImages := make(map[string]any)
+		for key := range newCollectionData {
+			replacedImages[key] = oldCollectionData[0][key]
+		}
+
+		deleteReferencedImages(context.WithoutCancel(r.Context()), db, imageStore, replacedImages)
+
 		WriteJSON(w, http.StatusOK, ResponseMessage{
 			Status:  StatusCodeOk,
 			Message: "Updated data successfully",
@@ -427,40 +397,47 @@ func deleteData(db *mongo.Client, imageStore *ImageStore) http.HandlerFunc {
 		collectionPath := r.PathValue("collection")
 
 		dataHexId := r.PathValue("id")
-		dataObjectId, _ := bson.ObjectIDFromHex(dataHexId)
-
-		oldCollectionData, err := getDBResource(cmsDatabase, collectionPath, bson.M{"_id": dataObjectId})
+		dataObjectId, err := bson.ObjectIDFromHex(dataHexId)
 		if err != nil {
-			message := fmt.Sprintf("Error while updating data for (%v) in collection (%v): %v", dataHexId, collectionPath, err.Error())
-			WriteJSON(w, http.StatusInternalServerError, ResponseMessage{Status: StatusCodeError, Message: message})
-			log.Println(message)
+			WriteError(w, r, invalidEntryId(dataHexId))
 			return
 		}
 
-		for _, value := range oldCollectionData[0] {
-			valueStringAsserted, ok := value.(string)
-			if ok == false {
-				continue
-			}
-
-			if strings.HasPrefix(valueStringAsserted, imageStore.ResourceBaseUrl) == false {
-				continue
-			}
+		oldCollectionData, err := getDBResource(r.Context(), cmsDatabase, collectionPath, bson.M{"_id": dataObjectId})
+		if err != nil {
+			WriteError(w, r, toAPIError(err, "Error while deleting entry"))
+			return
+		}
 
-			imageStore.Delete(valueStringAsserted)
+		if len(oldCollectionData) == 0 {
+			WriteError(w, r, entryNotFound(dataHexId, collectionPath))
+			return
 		}
 
-		err = deleteDBResource(cmsDatabase, collectionPath, bson.M{"_id": dataObjectId})
+		err = deleteDBResource(r.Context(), cmsDatabase, collectionPath, bson.M{"_id": dataObjectId})
 		if err != nil {
-			WriteJSON(w, http.StatusBadRequest, ResponseMessage{Status: StatusCodeError, Message: err.Error()})
-			log.Println("Error while deleting collection:", err)
+			WriteError(w, r, toAPIError(err, "Error while deleting entry"))
 			return
 		}
 
+		deleteReferencedImages(context.WithoutCancel(r.Context()), db, imageStore, oldCollectionData[0])
+
 		WriteJSON(w, http.StatusOK, ResponseMessage{Status: StatusCodeOk, Message: fmt.Sprintf("Deleted document with id (%v) in collection (%v)", dataHexId, collectionPath)})
 	}
 }
 
+func collectionNotFound(collectionPath string) *APIError {
+	return newAPIError(ErrorCodeCollectionNotFound, fmt.Sprintf("Couldn't find collection (%v)", collectionPath))
+}
+
+func entryNotFound(dataHexId string, collectionPath string) *APIError {
+	return newAPIError(ErrorCodeResourceNotFound, fmt.Sprintf("Couldn't find (%v) in collection (%v)", dataHexId, collectionPath))
+}
+
+func invalidEntryId(dataHexId string) *APIError {
+	return newAPIError(ErrorCodeInvalidId, fmt.Sprintf("(%v) isn't a valid entry id", dataHexId))
+}
+
 var publicProjection = bson.M{
 	"_id":        true,
 	"createdAt":  bson.M{"$toDate": "$_id"},
@@ -470,7 +447,7 @@ var publicProjection = bson.M{
 	"attributes": true,
 }
 
-func (c Collection) Validate(r *http.Request, db *mongo.Client) Misses {
+func (c Collection) Validate(r *http.Request, db *mongo.Client) (Misses, error) {
 	misses := make(Misses, 0)
 
 	expectOptional := map[string]bool{"name": true, "attributes": true}
@@ -482,8 +459,10 @@ func (c Collection) Validate(r *http.Request, db *mongo.Client) Misses {
 	}
 
 	if len(tooMany) > 0 {
-		misses["general.too_many_arguments"] = "The following keys are not in scope: " + strings.Join(tooMany, ", ")
-		return misses
+		for _, key := range tooMany {
+			misses[key] = "Isn't an attribute of a collection"
+		}
+		return misses, nil
 	}
 
 	if attrs, exists := c["attributes"]; exists == true {
@@ -496,7 +475,7 @@ func (c Collection) Validate(r *http.Request, db *mongo.Client) Misses {
 
 		for i, attr := range listAttrs {
 			mappedAttr, ok := attr.(map[string]interface{})
-			if ok == false || len(mappedAttr) != 2 {
+			if ok == false {
 				misses["attributes."+strconv.Itoa(i)] = "Must be an array of {name: string, type string}"
 				continue
 			}
@@ -505,7 +484,6 @@ func (c Collection) Validate(r *http.Request, db *mongo.Client) Misses {
 			_, okType := mappedAttr["type"]
 			if okName == false || okType == false {
 				misses["attributes."+strconv.Itoa(i)] = "Must be an array of {name: string, type string}"
-				fmt.Println("Exists problem:", okName, okType)
 				continue
 			}
 
@@ -513,7 +491,6 @@ func (c Collection) Validate(r *http.Request, db *mongo.Client) Misses {
 			attrType, okTypeString := mappedAttr["type"].(string)
 			if okNameString == false || okTypeString == false {
 				misses["attributes."+strconv.Itoa(i)] = "Must be an array of {name: string, type string}"
-				fmt.Println("Type problem:", okNameString, okTypeString)
 				continue
 			}
 
@@ -527,47 +504,88 @@ func (c Collection) Validate(r *http.Request, db *mongo.Client) Misses {
 				continue
 			}
 
+			if miss := validateAttrOptions(CollectionAttrType(attrType), mappedAttr); miss != "" {
+				misses["attributes."+strconv.Itoa(i)] = fmt.Sprintf("Attribute %q %v", name, miss)
+				continue
+			}
+
 			uniqueAttrs[name] = true
 		}
 	}
 
-	return misses
+	return misses, nil
 }
 
-func (n NewCollection) Validate(r *http.Request, db *mongo.Client) Misses {
-	misses := Collection(n).Validate(r, db)
-	results, err := getDBResource(db.Database(CMS_DATABASE), CMS_C_COLLECTIONS, bson.M{"name": n["name"]})
+func (n NewCollection) Validate(r *http.Request, db *mongo.Client) (Misses, error) {
+	misses, err := Collection(n).Validate(r, db)
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := getDBResource(r.Context(), db.Database(CMS_DATABASE), CMS_C_COLLECTIONS, bson.M{"name": n["name"]})
 	if err != nil && err != mongo.ErrNoDocuments {
-		misses["general.other"] = err.Error()
-		return misses
+		return nil, err
 	}
 
 	if len(results) != 0 {
 		misses["name"] = "Must be unique"
 	}
 
-	return misses
+	return misses, nil
 }
 
 type CollectionData map[string]any
 
-func (d CollectionData) Validate(r *http.Request, db *mongo.Client) Misses {
+func (d CollectionData) Validate(r *http.Request, db *mongo.Client) (Misses, error) {
+	ctx, span := tracer.Start(r.Context(), "CollectionData.Validate")
+	defer span.End()
+
 	misses := make(Misses, 0)
 
-	collection := db.Database(CMS_DATABASE).Collection(CMS_C_COLLECTIONS)
-	response := collection.FindOne(context.TODO(), bson.M{"path": r.PathValue("collection")})
-	result := bson.M{}
-	err := response.Decode(&result)
+	attributes, err := getCollectionAttributes(ctx, db, r.PathValue("collection"))
 	if err != nil {
-		misses["general.other"] = err.Error()
-		return misses
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
 	}
 
 	expectOptional := map[string]bool{}
-	for _, value := range (result["attributes"]).(bson.A) {
-		data := (value).(bson.D)
-		column := (data[0].Value).(string)
-		expectOptional[column] = true
+	for _, attribute := range attributes {
+		expectOptional[attribute.Name] = true
+
+		value, exists := d[attribute.Name]
+		if exists == false {
+			continue
+		}
+
+		// Media is uploaded to /v1/api/media/upload first, entries only reference it
+		text, _ := value.(string)
+		if attribute.Type == CollectionAttrTypeImage && strings.HasPrefix(text, "data:") {
+			misses[attribute.Name] = "Can't be a data url, upload the image and use its url instead"
+		}
+
+		if attribute.Type != CollectionAttrTypeFile {
+			continue
+		}
+
+		url, ok := value.(string)
+		if ok == false && value != nil {
+			misses[attribute.Name] = "Must be the url of an uploaded file"
+		}
+
+		if url == "" {
+			continue
+		}
+
+		rule, _ := uploadRuleOf(attribute)
+		reason, err := checkUploadedMedia(ctx, db, rule, url)
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+			return nil, err
+		}
+
+		if reason != "" {
+			misses[attribute.Name] = reason
+		}
 	}
 
 	tooMany := make([]string, 0, 0)
@@ -577,26 +595,183 @@ func (d CollectionData) Validate(r *http.Request, db *mongo.Client) Misses {
 		}
 	}
 
-	if len(tooMany) > 0 {
-		misses["general.too_many_arguments"] = "The following keys are not in scope: " + strings.Join(tooMany, ", ")
-		return misses
+	for _, key := range tooMany {
+		misses[key] = "Isn't an attribute of the collection"
+	}
+
+	if len(misses) > 0 {
+		span.SetStatus(codes.Error, "Invalid collection data")
+	}
+
+	return misses, nil
+}
+
+// Only image and file attributes accept options besides a name and a type
+func validateAttrOptions(attrType CollectionAttrType, attr map[string]interface{}) string {
+	for key, value := range attr {
+		switch key {
+		case "name", "type":
+			continue
+		case "mimeTypes":
+			if attrType != CollectionAttrTypeFile {
+				return "can't restrict mime types unless it's a file"
+			}
+
+			mimeTypes, ok := value.([]interface{})
+			if ok == false {
+				return "must have mimeTypes as an array of strings"
+			}
+
+			for _, mimeType := range mimeTypes {
+				if _, ok := mimeType.(string); ok == false {
+					return "must have mimeTypes as an array of strings"
+				}
+			}
+		case "private":
+			if attrType != CollectionAttrTypeFile && attrType != CollectionAttrTypeImage {
+				return "can't be private unless it's an image or a file"
+			}
+
+			if _, ok := value.(bool); ok == false {
+				return "must have private as a boolean"
+			}
+		case "maxSize":
+			if attrType != CollectionAttrTypeFile {
+				return "can't restrict the size unless it's a file"
+			}
+
+			maxSize, ok := value.(float64)
+			if ok == false || maxSize <= 0 || maxSize != float64(int64(maxSize)) {
+				return "must have maxSize as a positive number of bytes"
+			}
+		default:
+			return fmt.Sprintf("has an unknown option %q", key)
+		}
 	}
 
-	return misses
+	return ""
 }
 
-func uploadBase64ImageToImageStore(imageStore *ImageStore, value string) (string, error) {
-	image, err := NewImage(value, ImageHeights{})
+func getCollectionAttributes(ctx context.Context, db *mongo.Client, collectionPath string) ([]CollectionAttribute, error) {
+	ctx, cancel := context.WithTimeout(ctx, appConfig.Database.RequestTimeout)
+	defer cancel()
+
+	collection := db.Database(CMS_DATABASE).Collection(CMS_C_COLLECTIONS)
+	response := collection.FindOne(ctx, bson.M{"path": collectionPath})
+	result := bson.M{}
+	err := response.Decode(&result)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, &DBNotFoundError{Collection: collectionPath}
+	}
+
 	if err != nil {
-		return "", err
+		return nil, wrapDBError(ctx, CMS_C_COLLECTIONS, err)
+	}
+
+	rawAttributes, _ := (result["attributes"]).(bson.A)
+	attributes := make([]CollectionAttribute, 0, len(rawAttributes))
+	for _, value := range rawAttributes {
+		data, ok := (value).(bson.D)
+		if ok == false {
+			continue
+		}
+
+		attribute := CollectionAttribute{}
+		for _, element := range data {
+			switch element.Key {
+			case "name":
+				attribute.Name, _ = element.Value.(string)
+			case "type":
+				attrType, _ := element.Value.(string)
+				attribute.Type = CollectionAttrType(attrType)
+			case "mimeTypes":
+				mimeTypes, _ := element.Value.(bson.A)
+				for _, mimeType := range mimeTypes {
+					if mimeTypeString, ok := mimeType.(string); ok {
+						attribute.MimeTypes = append(attribute.MimeTypes, mimeTypeString)
+					}
+				}
+			case "private":
+				attribute.Private, _ = element.Value.(bool)
+			case "maxSize":
+				switch maxSize := element.Value.(type) {
+				case int32:
+					attribute.MaxSize = int64(maxSize)
+				case int64:
+					attribute.MaxSize = maxSize
+				case float64:
+					attribute.MaxSize = int64(maxSize)
+				}
+			}
+		}
+
+		attributes = append(attributes, attribute)
+	}
+
+	return attributes, nil
+}
+
+// Replaces private references with presigned urls for logged in callers and hides them from everyone else
+func resolvePrivateAssets(ctx context.Context, imageStore *ImageStore, document map[string]any, authenticated bool) {
+	for key, value := range document {
+		document[key] = resolvePrivateValue(ctx, imageStore, value, authenticated)
+	}
+}
+
+// Walks nested objects and arrays (variants, galleries, ...) and the text of mdx bodies.
+// A value that is only a private reference becomes nil when it can't be shared,
+// references embedded in text are removed from it instead.
+func resolvePrivateValue(ctx context.Context, imageStore *ImageStore, value any, authenticated bool) any {
+	switch typed := value.(type) {
+	case string:
+		if strings.Contains(typed, privateAssetScheme) == false {
+			return typed
+		}
+
+		if privateAssetPattern.FindString(typed) == typed {
+			presignedUrl := presignPrivateAsset(ctx, imageStore, typed, authenticated)
+			if presignedUrl == "" {
+				return nil
+			}
+
+			return presignedUrl
+		}
+
+		return privateAssetPattern.ReplaceAllStringFunc(typed, func(url string) string {
+			return presignPrivateAsset(ctx, imageStore, url, authenticated)
+		})
+	case map[string]any:
+		resolvePrivateAssets(ctx, imageStore, typed, authenticated)
+	case bson.M:
+		resolvePrivateAssets(ctx, imageStore, typed, authenticated)
+	case bson.D:
+		for i := range typed {
+			typed[i].Value = resolvePrivateValue(ctx, imageStore, typed[i].Value, authenticated)
+		}
+	case bson.A:
+		for i := range typed {
+			typed[i] = resolvePrivateValue(ctx, imageStore, typed[i], authenticated)
+		}
+	case []any:
+		for i := range typed {
+			typed[i] = resolvePrivateValue(ctx, imageStore, typed[i], authenticated)
+		}
 	}
 
-	image.Name = bson.NewObjectID().Hex()
+	return value
+}
+
+// Returns an empty string when the caller may not see the asset or it couldn't be presigned
+func presignPrivateAsset(ctx context.Context, imageStore *ImageStore, url string, authenticated bool) string {
+	if authenticated == false {
+		return ""
+	}
 
-	url, err := imageStore.Store(image)
+	presignedUrl, err := imageStore.PresignedUrl(ctx, url)
 	if err != nil {
-		return "", err
+		slog.ErrorContext(ctx, "Error while presigning", "url", url, "error", err)
+		return ""
 	}
 
-	return url, nil
+	return presignedUrl
 }
@@ -0,0 +1,701 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultAddress = ":9000"
+	// Uploads and image processing run within the read and write timeouts
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultReadTimeout       = 2 * time.Minute
+	defaultWriteTimeout      = 2 * time.Minute
+	defaultIdleTimeout       = 2 * time.Minute
+	defaultShutdownTimeout   = 30 * time.Second
+	defaultConfigFile        = "config.yaml"
+	redactedConfigValue      = "[redacted]"
+	defaultDatabaseName      = "portfolio-cms"
+	defaultRequestTimeout    = 10 * time.Second
+	// Exports walk whole collections, so they get longer than a single request
+	defaultStreamTimeout = 5 * time.Minute
+	defaultCORSMaxAge    = 10 * time.Minute
+)
+
+// The effective configuration, loaded once at startup before anything else runs
+var appConfig = defaultConfig()
+
+// Every setting is read, from lowest to highest precedence, from its default, the config file (yaml path),
+// the environment (env) and the command line (flag named after the yaml path).
+// Secrets are redacted when the configuration is printed.
+type Config struct {
+	Server    ServerConfig    `yaml:"server"`
+	Database  DatabaseConfig  `yaml:"database"`
+	Auth      AuthConfig      `yaml:"auth"`
+	Storage   StorageConfig   `yaml:"storage"`
+	Uploads   UploadLimits    `yaml:"uploads"`
+	Images    ImagesConfig    `yaml:"images"`
+	Analytics AnalyticsConfig `yaml:"analytics"`
+	GeoIP     GeoIPConfig     `yaml:"geoip"`
+	Reports   ReportsConfig   `yaml:"reports"`
+	Logging   LoggingConfig   `yaml:"logging"`
+	Metrics   MetricsConfig   `yaml:"metrics"`
+	Tracing   TracingConfig   `yaml:"tracing"`
+	Health    HealthConfig    `yaml:"health"`
+	CORS      CORSConfig      `yaml:"cors"`
+	RateLimit RateLimitConfig `yaml:"rateLimit"`
+	Errors    ErrorsConfig    `yaml:"errors"`
+}
+
+// Timeouts of 0 disable them, TLS is served when a certificate is set
+type ServerConfig struct {
+	Address           string        `yaml:"address" env:"ADDRESS"`
+	ReadHeaderTimeout time.Duration `yaml:"readHeaderTimeout" env:"SERVER_READ_HEADER_TIMEOUT"`
+	ReadTimeout       time.Duration `yaml:"readTimeout" env:"SERVER_READ_TIMEOUT"`
+	WriteTimeout      time.Duration `yaml:"writeTimeout" env:"SERVER_WRITE_TIMEOUT"`
+	IdleTimeout       time.Duration `yaml:"idleTimeout" env:"SERVER_IDLE_TIMEOUT"`
+	// How long in-flight requests get to finish once a shutdown signal is received
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout" env:"SERVER_SHUTDOWN_TIMEOUT"`
+	// PEM files, reloaded when they change on disk
+	TLSCertFile string `yaml:"tlsCertFile" env:"TLS_CERT_FILE"`
+	TLSKeyFile  string `yaml:"tlsKeyFile" env:"TLS_KEY_FILE"`
+	// Addresses, CIDR ranges or cloudflare for Cloudflare's ranges. Only requests from them may set the client's
+	// address (Cf-Connecting-Ip) and location, everyone else is identified by the address they connect from.
+	TrustedProxies []string `yaml:"trustedProxies" env:"SERVER_TRUSTED_PROXIES"`
+}
+
+type DatabaseConfig struct {
+	URI            string        `yaml:"uri" env:"MONGODB_URI" secret:"true"`
+	Name           string        `yaml:"name" env:"MONGODB_DATABASE"`
+	RequestTimeout time.Duration `yaml:"requestTimeout" env:"MONGODB_REQUEST_TIMEOUT"`
+	StreamTimeout  time.Duration `yaml:"streamTimeout" env:"MONGODB_STREAM_TIMEOUT"`
+}
+
+type AuthConfig struct {
+	// Bcrypt hash of the admin password
+	LoginHash string `yaml:"loginHash" env:"LOGIN_HASH" secret:"true"`
+}
+
+// Cloudflare R2, the url is formatted with the account id
+type StorageConfig struct {
+	URL           string `yaml:"url" env:"R2_STORE_URL"`
+	AccountId     string `yaml:"accountId" env:"R2_ACCOUNT_ID"`
+	AccessKey     string `yaml:"accessKey" env:"R2_ACCESS_KEY" secret:"true"`
+	SecretKey     string `yaml:"secretKey" env:"R2_ACCESS_SECRET_KEY" secret:"true"`
+	Bucket        string `yaml:"bucket" env:"R2_BUCKET"`
+	PrivateBucket string `yaml:"privateBucket" env:"R2_PRIVATE_BUCKET"`
+	ExternalURL   string `yaml:"externalUrl" env:"R2_EXTERNAL_URL"`
+	// How long presigned urls of private objects stay valid
+	PrivateURLLifetime time.Duration `yaml:"privateUrlLifetime" env:"PRIVATE_URL_LIFETIME"`
+}
+
+type ImagesConfig struct {
+	// Metadata such as the GPS location and camera details is stripped unless set.
+	// Jpeg images are rotated upright either way, rotated ones lose their metadata.
+	KeepMetadata bool `yaml:"keepMetadata" env:"IMAGE_KEEP_METADATA"`
+}
+
+type AnalyticsConfig struct {
+	PrivacyMode    bool          `yaml:"privacyMode" env:"ANALYTICS_PRIVACY_MODE"`
+	RollupInterval time.Duration `yaml:"rollupInterval" env:"ANALYTICS_ROLLUP_INTERVAL"`
+	// Raw events older than this many days are deleted once rolled up, 0 keeps them forever
+	RetentionDays   int    `yaml:"retentionDays" env:"ANALYTICS_RETENTION_DAYS"`
+	BotPatternsFile string `yaml:"botPatternsFile" env:"BOT_PATTERNS_FILE"`
+}
+
+type GeoIPConfig struct {
+	// mmdb, ipinfo or none, defaults to mmdb when a database is set and to none otherwise.
+	// ipinfo sends visitor IPs to ipinfo.io, so it's never picked unless set.
+	Provider    string `yaml:"provider" env:"GEOIP_PROVIDER"`
+	Database    string `yaml:"database" env:"GEOIP_DATABASE"`
+	IPInfoToken string `yaml:"ipinfoToken" env:"IPINFO_TOKEN" secret:"true"`
+	CacheSize   int    `yaml:"cacheSize" env:"GEOIP_CACHE_SIZE"`
+}
+
+type ReportsConfig struct {
+	// smtp, webhook or file, reports are disabled when empty
+	Notifier   string     `yaml:"notifier" env:"REPORT_NOTIFIER"`
+	SiteName   string     `yaml:"siteName" env:"REPORT_SITE_NAME"`
+	Recipients []string   `yaml:"recipients" env:"REPORT_RECIPIENTS"`
+	WebhookURL string     `yaml:"webhookUrl" env:"REPORT_WEBHOOK_URL" secret:"true"`
+	Directory  string     `yaml:"directory" env:"REPORT_DIRECTORY"`
+	SMTP       SMTPConfig `yaml:"smtp"`
+}
+
+type SMTPConfig struct {
+	Host     string `yaml:"host" env:"SMTP_HOST"`
+	Port     int    `yaml:"port" env:"SMTP_PORT"`
+	Username string `yaml:"username" env:"SMTP_USERNAME"`
+	Password string `yaml:"password" env:"SMTP_PASSWORD" secret:"true"`
+	From     string `yaml:"from" env:"SMTP_FROM"`
+}
+
+type LoggingConfig struct {
+	// debug, info, warn or error, debug also logs the (redacted) request headers
+	Level string `yaml:"level" env:"LOG_LEVEL"`
+	// json or text
+	Format string `yaml:"format" env:"LOG_FORMAT"`
+}
+
+type MetricsConfig struct {
+	// Bearer token required by /metrics, it's public when empty
+	Token string `yaml:"token" env:"METRICS_TOKEN" secret:"true"`
+}
+
+// The OTLP exporter also reads the standard OTEL_EXPORTER_OTLP_* variables (headers, certificates, ...)
+type TracingConfig struct {
+	// otlp or stdout, tracing is disabled when empty
+	Exporter string `yaml:"exporter" env:"TRACING_EXPORTER"`
+	// OTLP/HTTP traces url, e.g. http://localhost:4318/v1/traces
+	Endpoint    string `yaml:"endpoint" env:"TRACING_ENDPOINT"`
+	ServiceName string `yaml:"serviceName" env:"TRACING_SERVICE_NAME"`
+	// Percentage of new traces recorded, traces continued from a caller follow its decision
+	SamplePercent int `yaml:"samplePercent" env:"TRACING_SAMPLE_PERCENT"`
+}
+
+func (t TracingConfig) SampleRatio() float64 {
+	return float64(t.SamplePercent) / 100
+}
+
+type HealthConfig struct {
+	// Readiness checks are reused for this long, so frequent probes don't hammer the dependencies
+	CacheTTL     time.Duration `yaml:"cacheTtl" env:"HEALTH_CACHE_TTL"`
+	CheckTimeout time.Duration `yaml:"checkTimeout" env:"HEALTH_CHECK_TIMEOUT"`
+}
+
+// Lists are comma separated in the environment
+type CORSConfig struct {
+	// Exact origins (scheme://host[:port]) or * for any origin. None are allowed unless listed,
+	// the site and the admin frontend have to be listed when they're served from other origins.
+	AllowedOrigins []string `yaml:"allowedOrigins" env:"CORS_ALLOWED_ORIGINS"`
+	AllowedMethods []string `yaml:"allowedMethods" env:"CORS_ALLOWED_METHODS"`
+	AllowedHeaders []string `yaml:"allowedHeaders" env:"CORS_ALLOWED_HEADERS"`
+	// Response headers scripts of other origins may read
+	ExposedHeaders []string `yaml:"exposedHeaders" env:"CORS_EXPOSED_HEADERS"`
+	// Lets browsers send cookies, e.g. the analytics visitor cookies, it requires listing the origins
+	AllowCredentials bool `yaml:"allowCredentials" env:"CORS_ALLOW_CREDENTIALS"`
+	// How long browsers cache preflight responses
+	MaxAge time.Duration `yaml:"maxAge" env:"CORS_MAX_AGE"`
+}
+
+// Limits are in requests per minute per client, 0 lifts the limit of the group.
+// Bursts are how many requests a client can make at once, a minute's worth when 0.
+type RateLimitConfig struct {
+	// memory, mongo (shared by every instance) or none
+	Store string `yaml:"store" env:"RATE_LIMIT_STORE"`
+	// Clients tracked by the memory store, the least recently seen are forgotten first
+	CacheSize int `yaml:"cacheSize" env:"RATE_LIMIT_CACHE_SIZE"`
+	// Collections and media read by the site
+	Public      int `yaml:"public" env:"RATE_LIMIT_PUBLIC"`
+	PublicBurst int `yaml:"publicBurst" env:"RATE_LIMIT_PUBLIC_BURST"`
+	// Visitors identified and events sent by the site
+	Analytics      int `yaml:"analytics" env:"RATE_LIMIT_ANALYTICS"`
+	AnalyticsBurst int `yaml:"analyticsBurst" env:"RATE_LIMIT_ANALYTICS_BURST"`
+	// Login attempts, kept low against password guessing
+	Login      int `yaml:"login" env:"RATE_LIMIT_LOGIN"`
+	LoginBurst int `yaml:"loginBurst" env:"RATE_LIMIT_LOGIN_BURST"`
+	// Requests with valid credentials, wherever they're sent
+	Authenticated      int `yaml:"authenticated" env:"RATE_LIMIT_AUTHENTICATED"`
+	AuthenticatedBurst int `yaml:"authenticatedBurst" env:"RATE_LIMIT_AUTHENTICATED_BURST"`
+}
+
+type ErrorsConfig struct {
+	// Always responds to errors with RFC 7807 problem details, otherwise only clients accepting application/problem+json get them
+	ProblemDetails bool `yaml:"problemDetails" env:"ERRORS_PROBLEM_DETAILS"`
+	// The error code is appended to it to form the type of problems, they're about:blank when empty
+	ProblemTypeBaseURL string `yaml:"problemTypeBaseUrl" env:"ERRORS_PROBLEM_TYPE_BASE_URL"`
+}
+
+func (c RateLimitConfig) Limits() map[RateLimitGroup]RateLimit {
+	return map[RateLimitGroup]RateLimit{
+		RateLimitGroupPublic:        {Requests: c.Public, Burst: c.PublicBurst},
+		RateLimitGroupAnalytics:     {Requests: c.Analytics, Burst: c.AnalyticsBurst},
+		RateLimitGroupLogin:         {Requests: c.Login, Burst: c.LoginBurst},
+		RateLimitGroupAuthenticated: {Requests: c.Authenticated, Burst: c.AuthenticatedBurst},
+	}
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Address:           defaultAddress,
+			ReadHeaderTimeout: defaultReadHeaderTimeout,
+			ReadTimeout:       defaultReadTimeout,
+			WriteTimeout:      defaultWriteTimeout,
+			IdleTimeout:       defaultIdleTimeout,
+			ShutdownTimeout:   defaultShutdownTimeout,
+		},
+		Database: DatabaseConfig{
+			Name:           defaultDatabaseName,
+			RequestTimeout: defaultRequestTimeout,
+			StreamTimeout:  defaultStreamTimeout,
+		},
+		Storage: StorageConfig{PrivateURLLifetime: defaultPrivateUrlLifetime},
+		Uploads: UploadLimits{
+			MaxSize:          defaultUploadMaxSize,
+			MaxChunkSize:     defaultUploadMaxChunkSize,
+			MaxResumableSize: defaultUploadMaxResumableSize,
+		},
+		Analytics: AnalyticsConfig{RollupInterval: defaultRollupInterval},
+		GeoIP:     GeoIPConfig{CacheSize: defaultGeoCacheSize},
+		Reports: ReportsConfig{
+			SiteName: "Portfolio",
+			SMTP:     SMTPConfig{Port: defaultSMTPPort},
+		},
+		Logging: LoggingConfig{Level: "info", Format: "json"},
+		Tracing: TracingConfig{ServiceName: defaultServiceName, SamplePercent: 100},
+		Health:  HealthConfig{CacheTTL: defaultHealthCacheTTL, CheckTimeout: defaultHealthCheckTimeout},
+		CORS: CORSConfig{
+			AllowedMethods: []string{"GET", "POST", "PUT", "DELETE"},
+			AllowedHeaders: []string{"Authorization", "Content-Type", "Content-Range", "X-Request-Id", "Traceparent", "Tracestate"},
+			ExposedHeaders: []string{"X-Request-Id", "Content-Disposition", "X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset", "Retry-After"},
+			MaxAge:         defaultCORSMaxAge,
+		},
+		RateLimit: RateLimitConfig{
+			Store:              "memory",
+			CacheSize:          defaultRateLimitCacheSize,
+			Public:             120,
+			PublicBurst:        60,
+			Analytics:          60,
+			AnalyticsBurst:     30,
+			Login:              5,
+			LoginBurst:         5,
+			Authenticated:      600,
+			AuthenticatedBurst: 200,
+		},
+	}
+}
+
+// A single setting of the configuration
+type configField struct {
+	Path   string
+	Env    string
+	Secret bool
+	Value  reflect.Value
+}
+
+// Lists the settings of the configuration in declaration order
+func (c *Config) fields() []configField {
+	fields := make([]configField, 0)
+
+	var walk func(prefix string, value reflect.Value)
+	walk = func(prefix string, value reflect.Value) {
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Type().Field(i)
+			path := prefix + field.Tag.Get("yaml")
+
+			if field.Type.Kind() == reflect.Struct {
+				walk(path+".", value.Field(i))
+				continue
+			}
+
+			fields = append(fields, configField{
+				Path:   path,
+				Env:    field.Tag.Get("env"),
+				Secret: field.Tag.Get("secret") == "true",
+				Value:  value.Field(i),
+			})
+		}
+	}
+
+	walk("", reflect.ValueOf(c).Elem())
+	return fields
+}
+
+// Parses the raw value into the setting. Durations without a unit are read as seconds.
+func (f *configField) Set(raw string) error {
+	raw = strings.TrimSpace(raw)
+
+	switch f.Value.Interface().(type) {
+	case string:
+		f.Value.SetString(raw)
+	case bool:
+		parsed, err := strconv.ParseBool(raw)
+		if err != nil {
+			return errors.New(fmt.Sprintf("%v must be true or false, got %q", f.Path, raw))
+		}
+		f.Value.SetBool(parsed)
+	case int, int64:
+		parsed, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return errors.New(fmt.Sprintf("%v must be a whole number, got %q", f.Path, raw))
+		}
+		f.Value.SetInt(parsed)
+	case time.Duration:
+		if seconds, err := strconv.ParseInt(raw, 10, 64); err == nil {
+			f.Value.SetInt(int64(time.Duration(seconds) * time.Second))
+			return nil
+		}
+
+		parsed, err := time.ParseDuration(raw)
+		if err != nil {
+			return errors.New(fmt.Sprintf("%v must be a duration such as 30s or 5m, got %q", f.Path, raw))
+		}
+		f.Value.SetInt(int64(parsed))
+	case []string:
+		values := make([]string, 0)
+		for _, value := range strings.Split(raw, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+		f.Value.Set(reflect.ValueOf(values))
+	default:
+		return errors.New(fmt.Sprintf("%v has an unsupported type %v", f.Path, f.Value.Type()))
+	}
+
+	return nil
+}
+
+// flag.Value of a setting, the flag package only calls Set for flags given on the command line
+type configFlag struct {
+	field *configField
+}
+
+func (f configFlag) String() string {
+	if f.field == nil {
+		return ""
+	}
+
+	return fmt.Sprint(f.field.Value.Interface())
+}
+
+func (f configFlag) Set(raw string) error {
+	return f.field.Set(raw)
+}
+
+func (f configFlag) IsBoolFlag() bool {
+	return f.field != nil && f.field.Value.Kind() == reflect.Bool
+}
+
+// Loads the configuration from the arguments (without the program name).
+// The config file is picked with -config or CONFIG_FILE, config.yaml is read when it exists.
+func loadConfig(args []string, output io.Writer) (*Config, error) {
+	config := defaultConfig()
+	fields := config.fields()
+
+	flags := flag.NewFlagSet("server", flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.String("config", "", "Path to a YAML config file (env CONFIG_FILE)")
+	for i := range fields {
+		usage := "Sets " + fields[i].Path
+		if fields[i].Env != "" {
+			usage += " (env " + fields[i].Env + ")"
+		}
+		flags.Var(configFlag{field: &fields[i]}, fields[i].Path, usage)
+	}
+
+	// Flags are applied last, but the config file has to be known before anything else is read
+	path := configFileArgument(args)
+	if path == "" {
+		path = os.Getenv("CONFIG_FILE")
+	}
+
+	err := config.loadFile(path, fields)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range fields {
+		if fields[i].Env == "" {
+			continue
+		}
+
+		value, exists := os.LookupEnv(fields[i].Env)
+		if exists == false {
+			continue
+		}
+
+		err := fields[i].Set(value)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%v (from %v)", err, fields[i].Env))
+		}
+	}
+
+	err = flags.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if flags.NArg() > 0 {
+		return nil, errors.New(fmt.Sprintf("Unexpected arguments: %v", strings.Join(flags.Args(), " ")))
+	}
+
+	return config, config.Validate()
+}
+
+// Finds the value of -config (or --config) without parsing the other flags
+func configFileArgument(args []string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if strings.HasPrefix(arg, "-") == false || name != "config" {
+			continue
+		}
+
+		if hasValue {
+			return value
+		}
+
+		if i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+
+	return ""
+}
+
+// Reads the settings of the YAML file, an empty path reads config.yaml only when it exists
+func (c *Config) loadFile(path string, fields []configField) error {
+	optional := path == ""
+	if optional {
+		path = defaultConfigFile
+	}
+
+	content, err := os.ReadFile(path)
+	if optional && errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return errors.New(fmt.Sprintf("Couldn't read the config file: %v", err))
+	}
+
+	document := map[string]any{}
+	err = yaml.Unmarshal(content, &document)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Couldn't parse the config file %v: %v", path, err))
+	}
+
+	values := make(map[string]string)
+	flattenConfigDocument("", document, values)
+
+	byPath := make(map[string]*configField)
+	for i := range fields {
+		byPath[fields[i].Path] = &fields[i]
+	}
+
+	problems := make([]error, 0)
+	for key, value := range values {
+		field, exists := byPath[key]
+		if exists == false {
+			problems = append(problems, errors.New(fmt.Sprintf("%v: unknown setting %q", path, key)))
+			continue
+		}
+
+		err := field.Set(value)
+		if err != nil {
+			problems = append(problems, errors.New(fmt.Sprintf("%v: %v", path, err)))
+		}
+	}
+
+	return errors.Join(problems...)
+}
+
+// Turns nested mappings into dotted paths, lists are joined like they're written in the environment
+func flattenConfigDocument(prefix string, document map[string]any, values map[string]string) {
+	for key, value := range document {
+		switch value := value.(type) {
+		case map[string]any:
+			flattenConfigDocument(prefix+key+".", value, values)
+		case []any:
+			items := make([]string, 0, len(value))
+			for _, item := range value {
+				items = append(items, fmt.Sprint(item))
+			}
+			values[prefix+key] = strings.Join(items, ",")
+		case nil:
+			values[prefix+key] = ""
+		default:
+			values[prefix+key] = fmt.Sprint(value)
+		}
+	}
+}
+
+// Reports every invalid setting at once
+func (c *Config) Validate() error {
+	problems := make([]string, 0)
+	require := func(value string, path string, env string) {
+		if strings.TrimSpace(value) == "" {
+			problems = append(problems, fmt.Sprintf("%v must be set (env %v)", path, env))
+		}
+	}
+
+	require(c.Server.Address, "server.address", "ADDRESS")
+	require(c.Database.URI, "database.uri", "MONGODB_URI")
+	require(c.Database.Name, "database.name", "MONGODB_DATABASE")
+	require(c.Auth.LoginHash, "auth.loginHash", "LOGIN_HASH")
+	require(c.Storage.URL, "storage.url", "R2_STORE_URL")
+	require(c.Storage.AccountId, "storage.accountId", "R2_ACCOUNT_ID")
+	require(c.Storage.AccessKey, "storage.accessKey", "R2_ACCESS_KEY")
+	require(c.Storage.SecretKey, "storage.secretKey", "R2_ACCESS_SECRET_KEY")
+	require(c.Storage.Bucket, "storage.bucket", "R2_BUCKET")
+	require(c.Storage.ExternalURL, "storage.externalUrl", "R2_EXTERNAL_URL")
+
+	if (c.Server.TLSCertFile == "") != (c.Server.TLSKeyFile == "") {
+		problems = append(problems, "server.tlsCertFile and server.tlsKeyFile must be set together (env TLS_CERT_FILE and TLS_KEY_FILE)")
+	}
+
+	if _, err := parseTrustedProxies(c.Server.TrustedProxies); err != nil {
+		problems = append(problems, fmt.Sprintf("server.trustedProxies: %v", err))
+	}
+
+	notNegative := map[string]time.Duration{
+		"server.readHeaderTimeout": c.Server.ReadHeaderTimeout,
+		"server.readTimeout":       c.Server.ReadTimeout,
+		"server.writeTimeout":      c.Server.WriteTimeout,
+		"server.idleTimeout":       c.Server.IdleTimeout,
+	}
+
+	positive := map[string]int64{
+		"server.shutdownTimeout":     int64(c.Server.ShutdownTimeout),
+		"database.requestTimeout":    int64(c.Database.RequestTimeout),
+		"database.streamTimeout":     int64(c.Database.StreamTimeout),
+		"storage.privateUrlLifetime": int64(c.Storage.PrivateURLLifetime),
+		"uploads.maxSize":            c.Uploads.MaxSize,
+		"uploads.maxChunkSize":       c.Uploads.MaxChunkSize,
+		"uploads.maxResumableSize":   c.Uploads.MaxResumableSize,
+		"analytics.rollupInterval":   int64(c.Analytics.RollupInterval),
+		"geoip.cacheSize":            int64(c.GeoIP.CacheSize),
+		"health.cacheTtl":            int64(c.Health.CacheTTL),
+		"health.checkTimeout":        int64(c.Health.CheckTimeout),
+		"rateLimit.cacheSize":        int64(c.RateLimit.CacheSize),
+	}
+
+	for _, field := range c.fields() {
+		if value, exists := positive[field.Path]; exists && value <= 0 {
+			problems = append(problems, fmt.Sprintf("%v must be greater than 0", field.Path))
+		}
+
+		if value, exists := notNegative[field.Path]; exists && value < 0 {
+			problems = append(problems, fmt.Sprintf("%v can't be negative, use 0 to disable it", field.Path))
+		}
+	}
+
+	if c.Uploads.MaxChunkSize > c.Uploads.MaxResumableSize {
+		problems = append(problems, "uploads.maxChunkSize can't be larger than uploads.maxResumableSize")
+	}
+
+	if c.Analytics.RetentionDays < 0 {
+		problems = append(problems, "analytics.retentionDays can't be negative, use 0 to keep events forever")
+	}
+
+	switch c.GeoIP.Provider {
+	case "", "ipinfo", "none":
+	case "mmdb":
+		require(c.GeoIP.Database, "geoip.database", "GEOIP_DATABASE")
+	default:
+		problems = append(problems, fmt.Sprintf("geoip.provider must be mmdb, ipinfo or none, got %q", c.GeoIP.Provider))
+	}
+
+	switch c.Reports.Notifier {
+	case "":
+	case "smtp":
+		require(c.Reports.SMTP.Host, "reports.smtp.host", "SMTP_HOST")
+		require(c.Reports.SMTP.From, "reports.smtp.from", "SMTP_FROM")
+		require(strings.Join(c.Reports.Recipients, ","), "reports.recipients", "REPORT_RECIPIENTS")
+		if c.Reports.SMTP.Port <= 0 || c.Reports.SMTP.Port > 65535 {
+			problems = append(problems, fmt.Sprintf("reports.smtp.port must be a port number, got %v", c.Reports.SMTP.Port))
+		}
+	case "webhook":
+		require(c.Reports.WebhookURL, "reports.webhookUrl", "REPORT_WEBHOOK_URL")
+	case "file":
+		require(c.Reports.Directory, "reports.directory", "REPORT_DIRECTORY")
+	default:
+		problems = append(problems, fmt.Sprintf("reports.notifier must be smtp, webhook or file, got %q", c.Reports.Notifier))
+	}
+
+	switch strings.ToLower(c.Logging.Level) {
+	case "debug", "info", "warn", "error":
+	default:
+		problems = append(problems, fmt.Sprintf("logging.level must be debug, info, warn or error, got %q", c.Logging.Level))
+	}
+
+	if c.Logging.Format != "json" && c.Logging.Format != "text" {
+		problems = append(problems, fmt.Sprintf("logging.format must be json or text, got %q", c.Logging.Format))
+	}
+
+	if c.Tracing.Exporter != "" && c.Tracing.Exporter != "otlp" && c.Tracing.Exporter != "stdout" {
+		problems = append(problems, fmt.Sprintf("tracing.exporter must be otlp or stdout, got %q", c.Tracing.Exporter))
+	}
+
+	for _, origin := range c.CORS.AllowedOrigins {
+		if origin == "*" {
+			if c.CORS.AllowCredentials {
+				problems = append(problems, "cors.allowCredentials can't be used with the * origin, list the allowed origins instead")
+			}
+			continue
+		}
+
+		parsed, err := url.Parse(origin)
+		if err != nil || parsed.Scheme == "" || parsed.Host == "" || strings.TrimSuffix(origin, "/") != parsed.Scheme+"://"+parsed.Host {
+			problems = append(problems, fmt.Sprintf("cors.allowedOrigins must be origins like https://example.com, got %q", origin))
+		}
+	}
+
+	if c.RateLimit.Store != "memory" && c.RateLimit.Store != "mongo" && c.RateLimit.Store != "none" {
+		problems = append(problems, fmt.Sprintf("rateLimit.store must be memory, mongo or none, got %q", c.RateLimit.Store))
+	}
+
+	limits := c.RateLimit.Limits()
+	for _, group := range rateLimitGroups {
+		if limit := limits[group]; limit.Requests < 0 || limit.Burst < 0 {
+			problems = append(problems, fmt.Sprintf("rateLimit.%v and rateLimit.%vBurst can't be negative, use 0 to lift the limit", group, group))
+		}
+	}
+
+	if c.Tracing.SamplePercent < 0 || c.Tracing.SamplePercent > 100 {
+		problems = append(problems, fmt.Sprintf("tracing.samplePercent must be between 0 and 100, got %v", c.Tracing.SamplePercent))
+	}
+
+	if len(problems) > 0 {
+		return errors.New("Invalid configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+
+	return nil
+}
+
+// Returns a copy of the configuration with every secret that's set replaced
+func (c *Config) Redacted() *Config {
+	redacted := *c
+	redacted.Reports.Recipients = append([]string{}, c.Reports.Recipients...)
+
+	for _, field := range redacted.fields() {
+		if field.Secret && field.Value.String() != "" {
+			field.Value.SetString(redactedConfigValue)
+		}
+	}
+
+	return &redacted
+}
+
+// Handles `config print`, which writes the effective configuration as YAML with its secrets redacted.
+// It's printed even when invalid, followed by the problems, so a broken setup can be inspected.
+func printConfig(args []string, output io.Writer) error {
+	config, err := loadConfig(args, output)
+	if config == nil {
+		return err
+	}
+
+	encoder := yaml.NewEncoder(output)
+	encoder.SetIndent(2)
+	encodeErr := encoder.Encode(config.Redacted())
+	if encodeErr != nil {
+		return encodeErr
+	}
+
+	return err
+}
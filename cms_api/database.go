@@ -5,230 +5,579 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"maps"
-	"os"
-	"time"
 
 	"go.mongodb.org/mongo-driver/v2/bson"
 	"go.mongodb.org/mongo-driver/v2/mongo"
 	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
-const CMS_DATABASE = "portfolio-cms"
+// Set from database.name when the database is initialized
+var CMS_DATABASE = defaultDatabaseName
+
 const CMS_C_COLLECTIONS = "collections"
 const CMS_C_ANALYTICS_USERS = "analytics_users"
+const CMS_C_MEDIA = "media"
+const CMS_C_ANALYTICS_EVENTS = "analytics_events"
+const CMS_C_MIGRATIONS = "migrations"
+const CMS_C_ANALYTICS_ROLLUPS = "analytics_rollups"
+const CMS_C_JOBS = "jobs"
+const CMS_C_ANALYTICS_SALTS = "analytics_salts"
+const CMS_C_ANALYTICS_GOALS = "analytics_goals"
+const CMS_C_RATE_LIMITS = "rate_limits"
+
+func initializeDB(database DatabaseConfig) (*mongo.Client, error) {
+	CMS_DATABASE = database.Name
+	ctx := context.Background()
+
+	client, err := mongo.Connect(options.Client().ApplyURI(database.URI))
+	if err != nil {
+		return nil, err
+	}
 
-const db_max_request_timeout = 10 * time.Second
+	createDBCollection(ctx, client.Database(CMS_DATABASE), CMS_C_COLLECTIONS)
+	createDBCollection(ctx, client.Database(CMS_DATABASE), CMS_C_ANALYTICS_USERS)
+	createDBCollection(ctx, client.Database(CMS_DATABASE), CMS_C_MEDIA)
+	createDBCollection(ctx, client.Database(CMS_DATABASE), CMS_C_ANALYTICS_EVENTS)
+	createDBCollection(ctx, client.Database(CMS_DATABASE), CMS_C_MIGRATIONS)
+	createDBCollection(ctx, client.Database(CMS_DATABASE), CMS_C_ANALYTICS_ROLLUPS)
+	createDBCollection(ctx, client.Database(CMS_DATABASE), CMS_C_JOBS)
+	createDBCollection(ctx, client.Database(CMS_DATABASE), CMS_C_ANALYTICS_SALTS)
+	createDBCollection(ctx, client.Database(CMS_DATABASE), CMS_C_ANALYTICS_GOALS)
+	createDBCollection(ctx, client.Database(CMS_DATABASE), CMS_C_RATE_LIMITS)
+
+	err = createDBIndexes(ctx, client.Database(CMS_DATABASE), CMS_C_ANALYTICS_EVENTS, analyticsEventIndexes)
+	if err != nil {
+		slog.Error("Error while creating analytics event indexes", "error", err)
+	}
 
-func initializeDB() (*mongo.Client, error) {
-	uri := os.Getenv("MONGODB_URI")
-	if uri == "" {
-		return nil, errors.New("No MongoDB connection URI found. Set the 'MONGODB_URI' environment variable.")
+	err = createDBIndexes(ctx, client.Database(CMS_DATABASE), CMS_C_ANALYTICS_ROLLUPS, analyticsRollupIndexes)
+	if err != nil {
+		slog.Error("Error while creating analytics rollup indexes", "error", err)
 	}
 
-	client, err := mongo.Connect(options.Client().ApplyURI(uri))
+	err = createDBIndexes(ctx, client.Database(CMS_DATABASE), CMS_C_ANALYTICS_SALTS, analyticsSaltIndexes)
 	if err != nil {
-		return nil, err
+		slog.Error("Error while creating analytics salt indexes", "error", err)
 	}
 
-	createDBCollection(client.Database(CMS_DATABASE), CMS_C_COLLECTIONS)
-	createDBCollection(client.Database(CMS_DATABASE), CMS_C_ANALYTICS_USERS)
+	err = createDBIndexes(ctx, client.Database(CMS_DATABASE), CMS_C_RATE_LIMITS, rateLimitIndexes)
+	if err != nil {
+		slog.Error("Error while creating rate limit indexes", "error", err)
+	}
 
 	return client, nil
 }
 
+// Waits for the pending operations to finish, up to the request timeout
+func disconnectDB(db *mongo.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), appConfig.Database.RequestTimeout)
+	defer cancel()
+
+	err := db.Disconnect(ctx)
+	if err != nil {
+		slog.Error("Error while disconnecting from the database", "error", err)
+		return
+	}
+
+	slog.Info("Disconnected from the database")
+}
+
 func getDBResource(
+	ctx context.Context,
 	db *mongo.Database,
 	collection string,
 	filter interface{},
 	opts ...options.Lister[options.FindOptions],
 ) ([]map[string]interface{}, error) {
-	context, cancel := context.WithTimeout(context.Background(), db_max_request_timeout)
+	ctx, done := startDBOperation(ctx, "find", collection)
+	defer done()
+
+	ctx, cancel := context.WithTimeout(ctx, appConfig.Database.RequestTimeout)
 	defer cancel()
 
-	err := checkCollectionExistence(db, collection)
+	err := checkCollectionExistence(ctx, db, collection)
 	if err != nil {
-		return nil, err
+		return nil, wrapDBError(ctx, collection, err)
 	}
 
-	response, err := db.Collection(collection).Find(context, filter, opts...)
+	response, err := db.Collection(collection).Find(ctx, filter, opts...)
 	if err != nil {
-		return nil, err
+		return nil, wrapDBError(ctx, collection, err)
 	}
 
 	results := make([]map[string]interface{}, 0)
-	for response.Next(context) {
+	for response.Next(ctx) {
 		result := make(map[string]interface{})
 		err = response.Decode(&result)
 		if err != nil {
-			return nil, err
+			return nil, wrapDBError(ctx, collection, err)
 		}
 
 		results = append(results, result)
 	}
 
-	log.Printf("Total collected resources for %q: %v", collection, results)
+	slog.DebugContext(ctx, "Collected resources", "collection", collection, "count", len(results))
+	return results, nil
+}
+
+// Decodes every matching document into T and calls fn with it without loading them all in memory.
+// Stops at the first error.
+func forEachDBResource[T any](
+	ctx context.Context,
+	db *mongo.Database,
+	collection string,
+	filter interface{},
+	fn func(T) error,
+	opts ...options.Lister[options.FindOptions],
+) error {
+	ctx, done := startDBOperation(ctx, "find_stream", collection)
+	defer done()
+
+	ctx, cancel := context.WithTimeout(ctx, appConfig.Database.StreamTimeout)
+	defer cancel()
+
+	err := checkCollectionExistence(ctx, db, collection)
+	if err != nil {
+		return wrapDBError(ctx, collection, err)
+	}
+
+	response, err := db.Collection(collection).Find(ctx, filter, opts...)
+	if err != nil {
+		return wrapDBError(ctx, collection, err)
+	}
+	defer response.Close(ctx)
+
+	for response.Next(ctx) {
+		var result T
+		err = response.Decode(&result)
+		if err != nil {
+			return wrapDBError(ctx, collection, err)
+		}
+
+		err = fn(result)
+		if err != nil {
+			return wrapDBError(ctx, collection, err)
+		}
+	}
+
+	return wrapDBError(ctx, collection, response.Err())
+}
+
+// Runs an aggregation pipeline and decodes every resulting document into T
+func aggregateDBResource[T any](
+	ctx context.Context,
+	db *mongo.Database,
+	collection string,
+	pipeline interface{},
+	opts ...options.Lister[options.AggregateOptions],
+) ([]T, error) {
+	ctx, done := startDBOperation(ctx, "aggregate", collection)
+	defer done()
+
+	ctx, cancel := context.WithTimeout(ctx, appConfig.Database.RequestTimeout)
+	defer cancel()
+
+	err := checkCollectionExistence(ctx, db, collection)
+	if err != nil {
+		return nil, wrapDBError(ctx, collection, err)
+	}
+
+	response, err := db.Collection(collection).Aggregate(ctx, pipeline, opts...)
+	if err != nil {
+		return nil, wrapDBError(ctx, collection, err)
+	}
+
+	results := make([]T, 0)
+	err = response.All(ctx, &results)
+	if err != nil {
+		return nil, wrapDBError(ctx, collection, err)
+	}
+
 	return results, nil
 }
 
 func createDBResource(
+	ctx context.Context,
 	db *mongo.Database,
 	collection string,
 	document map[string]any,
 	opts ...options.Lister[options.InsertOneOptions],
 ) (map[string]interface{}, error) {
-	err := checkCollectionExistence(db, collection)
+	ctx, done := startDBOperation(ctx, "insert", collection)
+	defer done()
+
+	err := checkCollectionExistence(ctx, db, collection)
 	if err != nil {
-		return nil, err
+		return nil, wrapDBError(ctx, collection, err)
 	}
 
 	var orderedCollection bson.D
 	stringifiedCollection, err := json.Marshal(document)
 	err = bson.UnmarshalExtJSON(stringifiedCollection, true, &orderedCollection)
 	if err != nil {
-		return nil, err
+		return nil, wrapDBError(ctx, collection, err)
 	}
 
-	context, cancel := context.WithTimeout(context.Background(), db_max_request_timeout)
+	ctx, cancel := context.WithTimeout(ctx, appConfig.Database.RequestTimeout)
 	defer cancel()
 
-	result, err := db.Collection(collection).InsertOne(context, document, opts...)
+	result, err := db.Collection(collection).InsertOne(ctx, document, opts...)
 	if err != nil {
-		return nil, err
+		return nil, wrapDBError(ctx, collection, err)
 	}
 
 	// TODO: Consider either deep cloning or getting a new entry from the database if this is used in the future
 	databaseCollection := maps.Clone(document)
 	databaseCollection["_id"] = result.InsertedID
 
-	log.Printf("Inserted resource in %q: %v", collection, databaseCollection)
+	slog.DebugContext(ctx, "Inserted resource", "collection", collection, "id", result.InsertedID)
 	return databaseCollection, nil
 }
 
+// Inserts documents in bulk, returning how many were inserted
+func createDBResources(
+	ctx context.Context,
+	db *mongo.Database,
+	collection string,
+	documents []interface{},
+	opts ...options.Lister[options.InsertManyOptions],
+) (int, error) {
+	ctx, done := startDBOperation(ctx, "insert_many", collection)
+	defer done()
+
+	err := checkCollectionExistence(ctx, db, collection)
+	if err != nil {
+		return 0, wrapDBError(ctx, collection, err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, appConfig.Database.RequestTimeout)
+	defer cancel()
+
+	result, err := db.Collection(collection).InsertMany(ctx, documents, opts...)
+	if err != nil {
+		return 0, wrapDBError(ctx, collection, err)
+	}
+
+	slog.DebugContext(ctx, "Inserted resources", "collection", collection, "count", len(result.InsertedIDs))
+	return len(result.InsertedIDs), nil
+}
+
 func updateDBResource(
+	ctx context.Context,
 	db *mongo.Database,
 	collection string,
 	filter interface{},
 	update interface{},
 	opts ...options.Lister[options.UpdateOneOptions],
 ) (map[string]interface{}, error) {
-	context, cancel := context.WithTimeout(context.Background(), db_max_request_timeout)
+	ctx, done := startDBOperation(ctx, "update", collection)
+	defer done()
+
+	ctx, cancel := context.WithTimeout(ctx, appConfig.Database.RequestTimeout)
 	defer cancel()
 
-	err := checkCollectionExistence(db, collection)
+	err := checkCollectionExistence(ctx, db, collection)
 	if err != nil {
-		return nil, err
+		return nil, wrapDBError(ctx, collection, err)
 	}
 
-	record, err := getDBResource(db, collection, filter)
+	record, err := getDBResource(ctx, db, collection, filter)
 	if err != nil {
-		return nil, err
+		return nil, wrapDBError(ctx, collection, err)
 	}
 
 	if len(record) == 0 {
-		return nil, errors.New("Updated record cannot be shown")
+		return nil, &DBNotFoundError{Collection: collection, Document: true}
 	}
 
-	response, err := db.Collection(collection).UpdateByID(context, record[0]["_id"], update, opts...)
+	response, err := db.Collection(collection).UpdateByID(ctx, record[0]["_id"], update, opts...)
 	if err != nil {
-		return nil, err
+		return nil, wrapDBError(ctx, collection, err)
 	}
 
 	if response.ModifiedCount == 0 {
 		return nil, errors.New("No record was updated")
 	}
 
-	newRecord, err := getDBResource(db, collection, filter)
+	newRecord, err := getDBResource(ctx, db, collection, filter)
 	if err != nil {
-		return nil, err
+		return nil, wrapDBError(ctx, collection, err)
 	}
 
 	if len(newRecord) == 0 {
 		return nil, errors.New("Updated record cannot be shown")
 	}
 
-	log.Printf("Updated resource in %q: %v %v", collection, record, newRecord)
+	slog.DebugContext(ctx, "Updated resource", "collection", collection, "id", record[0]["_id"])
 	return newRecord[0], nil
 }
 
+// Updates every document matching the filter, returning how many were modified
+func updateDBResources(
+	ctx context.Context,
+	db *mongo.Database,
+	collection string,
+	filter interface{},
+	update interface{},
+	opts ...options.Lister[options.UpdateManyOptions],
+) (int64, error) {
+	ctx, done := startDBOperation(ctx, "update_many", collection)
+	defer done()
+
+	ctx, cancel := context.WithTimeout(ctx, appConfig.Database.RequestTimeout)
+	defer cancel()
+
+	err := checkCollectionExistence(ctx, db, collection)
+	if err != nil {
+		return 0, wrapDBError(ctx, collection, err)
+	}
+
+	result, err := db.Collection(collection).UpdateMany(ctx, filter, update, opts...)
+	if err != nil {
+		return 0, wrapDBError(ctx, collection, err)
+	}
+
+	slog.DebugContext(ctx, "Updated resources", "collection", collection, "count", result.ModifiedCount)
+	return result.ModifiedCount, nil
+}
+
+// Updates the document matching the filter, creating it when there's none
+func upsertDBResource(
+	ctx context.Context,
+	db *mongo.Database,
+	collection string,
+	filter interface{},
+	update interface{},
+) error {
+	ctx, done := startDBOperation(ctx, "upsert", collection)
+	defer done()
+
+	ctx, cancel := context.WithTimeout(ctx, appConfig.Database.RequestTimeout)
+	defer cancel()
+
+	err := checkCollectionExistence(ctx, db, collection)
+	if err != nil {
+		return wrapDBError(ctx, collection, err)
+	}
+
+	_, err = db.Collection(collection).UpdateOne(ctx, filter, update, options.UpdateOne().SetUpsert(true))
+	return wrapDBError(ctx, collection, err)
+}
+
+// Atomically updates the document matching the filter, creating it when there's none, and decodes it as updated.
+// It runs on every rate limited request, so the collection (created on startup) isn't checked first.
+func upsertAndGetDBResource[T any](
+	ctx context.Context,
+	db *mongo.Database,
+	collection string,
+	filter interface{},
+	update interface{},
+) (T, error) {
+	ctx, done := startDBOperation(ctx, "find_and_modify", collection)
+	defer done()
+
+	ctx, cancel := context.WithTimeout(ctx, appConfig.Database.RequestTimeout)
+	defer cancel()
+
+	var result T
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	err := db.Collection(collection).FindOneAndUpdate(ctx, filter, update, opts).Decode(&result)
+	if err != nil {
+		return result, wrapDBError(ctx, collection, err)
+	}
+
+	return result, nil
+}
+
 func deleteDBResource(
+	ctx context.Context,
 	db *mongo.Database,
 	collection string,
 	filter interface{},
 	opts ...options.Lister[options.DeleteOneOptions],
 ) error {
-	context, cancel := context.WithTimeout(context.Background(), db_max_request_timeout)
+	ctx, done := startDBOperation(ctx, "delete", collection)
+	defer done()
+
+	ctx, cancel := context.WithTimeout(ctx, appConfig.Database.RequestTimeout)
 	defer cancel()
 
-	err := checkCollectionExistence(db, collection)
+	err := checkCollectionExistence(ctx, db, collection)
 	if err != nil {
-		return err
+		return wrapDBError(ctx, collection, err)
 	}
 
-	result, err := db.Collection(collection).DeleteOne(context, filter, opts...)
+	result, err := db.Collection(collection).DeleteOne(ctx, filter, opts...)
 	if err != nil {
-		return err
+		return wrapDBError(ctx, collection, err)
 	}
 
 	if result.DeletedCount == 0 {
-		return errors.New("No record was deleted")
+		return &DBNotFoundError{Collection: collection, Document: true}
 	}
 
-	log.Printf("Deleted resource in %q: %v", collection, filter)
+	slog.DebugContext(ctx, "Deleted resource", "collection", collection)
 	return nil
 }
 
-func createDBCollection(db *mongo.Database, collection string) error {
-	context, cancel := context.WithTimeout(context.Background(), db_max_request_timeout)
+// Deletes every document matching the filter, returning how many were deleted
+func deleteDBResources(
+	ctx context.Context,
+	db *mongo.Database,
+	collection string,
+	filter interface{},
+	opts ...options.Lister[options.DeleteManyOptions],
+) (int64, error) {
+	ctx, done := startDBOperation(ctx, "delete_many", collection)
+	defer done()
+
+	ctx, cancel := context.WithTimeout(ctx, appConfig.Database.RequestTimeout)
+	defer cancel()
+
+	err := checkCollectionExistence(ctx, db, collection)
+	if err != nil {
+		return 0, wrapDBError(ctx, collection, err)
+	}
+
+	result, err := db.Collection(collection).DeleteMany(ctx, filter, opts...)
+	if err != nil {
+		return 0, wrapDBError(ctx, collection, err)
+	}
+
+	slog.DebugContext(ctx, "Deleted resources", "collection", collection, "count", result.DeletedCount)
+	return result.DeletedCount, nil
+}
+
+func createDBCollection(ctx context.Context, db *mongo.Database, collection string) error {
+	ctx, cancel := context.WithTimeout(ctx, appConfig.Database.RequestTimeout)
 	defer cancel()
 
-	err := db.CreateCollection(context, collection)
-	return err
+	err := db.CreateCollection(ctx, collection)
+	return wrapDBError(ctx, collection, err)
+}
+
+func createDBIndexes(ctx context.Context, db *mongo.Database, collection string, indexes []mongo.IndexModel) error {
+	ctx, cancel := context.WithTimeout(ctx, appConfig.Database.RequestTimeout)
+	defer cancel()
+
+	_, err := db.Collection(collection).Indexes().CreateMany(ctx, indexes)
+	return wrapDBError(ctx, collection, err)
 }
 
 func renameDBCollection(
+	ctx context.Context,
 	db *mongo.Database,
 	database,
 	oldCollection,
 	newCollection string,
 ) error {
-	context, cancel := context.WithTimeout(context.Background(), db_max_request_timeout)
+	ctx, done := startDBOperation(ctx, "rename_collection", oldCollection)
+	defer done()
+
+	ctx, cancel := context.WithTimeout(ctx, appConfig.Database.RequestTimeout)
 	defer cancel()
 
-	renameResult := db.RunCommand(context, bson.D{
+	renameResult := db.RunCommand(ctx, bson.D{
 		{Key: "renameCollection", Value: database + "." + oldCollection},
 		{Key: "to", Value: database + "." + newCollection},
 	})
 
-	return renameResult.Err()
+	return wrapDBError(ctx, oldCollection, renameResult.Err())
 }
 
 func deleteDBCollection(
+	ctx context.Context,
 	db *mongo.Database,
 	collection string,
 ) error {
-	context, cancel := context.WithTimeout(context.Background(), db_max_request_timeout)
+	ctx, done := startDBOperation(ctx, "drop_collection", collection)
+	defer done()
+
+	ctx, cancel := context.WithTimeout(ctx, appConfig.Database.RequestTimeout)
 	defer cancel()
 
-	return db.Collection(collection).Drop(context)
+	return wrapDBError(ctx, collection, db.Collection(collection).Drop(ctx))
 }
 
 func checkCollectionExistence(
+	ctx context.Context,
 	db *mongo.Database,
 	collection string,
 ) error {
-	context, cancel := context.WithTimeout(context.Background(), db_max_request_timeout)
+	ctx, cancel := context.WithTimeout(ctx, appConfig.Database.RequestTimeout)
 	defer cancel()
 
-	list, err := db.ListCollectionNames(context, bson.M{"name": collection})
+	list, err := db.ListCollectionNames(ctx, bson.M{"name": collection})
+	if ctx.Err() != nil {
+		return wrapDBError(ctx, collection, err)
+	}
+
 	if err != nil {
 		return errors.New(fmt.Sprintf("Error while getting data from collection (%v): %v", collection, err.Error()))
 	}
 
 	if len(list) == 0 {
-		return errors.New(fmt.Sprintf("Couldn't find collection (%v)", collection))
+		return &DBNotFoundError{Collection: collection}
 	}
 
 	return nil
 }
+
+// Returned when the collection, or the document of an update or delete, doesn't exist
+type DBNotFoundError struct {
+	Collection string
+	// The collection exists, the document doesn't
+	Document bool
+}
+
+func (e *DBNotFoundError) Error() string {
+	if e.Document {
+		return fmt.Sprintf("Couldn't find the document in collection (%v)", e.Collection)
+	}
+
+	return fmt.Sprintf("Couldn't find collection (%v)", e.Collection)
+}
+
+// Returned instead of the driver's error when the operation's context ended,
+// either because the client went away (Canceled) or it ran out of time (DeadlineExceeded)
+type DBCancelledError struct {
+	Collection string
+	Cause      error
+}
+
+func (e *DBCancelledError) Error() string {
+	if e.TimedOut() {
+		return fmt.Sprintf("Database request on %q timed out", e.Collection)
+	}
+
+	return fmt.Sprintf("Database request on %q was cancelled", e.Collection)
+}
+
+func (e *DBCancelledError) Unwrap() error {
+	return e.Cause
+}
+
+func (e *DBCancelledError) TimedOut() bool {
+	return errors.Is(e.Cause, context.DeadlineExceeded)
+}
+
+// Records the error on the span of the operation, cancelled and timed out requests become a DBCancelledError
+func wrapDBError(ctx context.Context, collection string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	span := trace.SpanFromContext(ctx)
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+
+	if ctx.Err() == nil {
+		return err
+	}
+
+	return &DBCancelledError{Collection: collection, Cause: ctx.Err()}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"mime"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// Attachments accepted by file attributes that don't restrict their mime types
+var defaultFileMimeTypes = map[string]bool{
+	"application/pdf": true,
+	"application/zip": true,
+	"video/mp4":       true,
+	"video/webm":      true,
+	"audio/mpeg":      true,
+	"audio/wave":      true,
+	"audio/ogg":       true,
+	"application/ogg": true,
+}
+
+// Details of a stored attachment, stored in the media collection under the file name
+type FileMetadata struct {
+	Name     string `json:"name"`
+	Url      string `json:"url"`
+	MimeType string `json:"mimeType"`
+	Size     int64  `json:"size"`
+	Filename string `json:"filename"`
+	// Url of a frame extracted from videos, stored like any other image
+	Poster    string    `json:"poster,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func (m *FileMetadata) ToMap() map[string]interface{} {
+	return map[string]interface{}{
+		"kind":      string(CollectionAttrTypeFile),
+		"name":      m.Name,
+		"url":       m.Url,
+		"mimeType":  m.MimeType,
+		"size":      m.Size,
+		"filename":  m.Filename,
+		"poster":    m.Poster,
+		"createdAt": bson.NewDateTimeFromTime(m.CreatedAt),
+	}
+}
+
+// Streams an attachment to the store through a local file.
+// The original filename is only kept to be sent back on download, the key is always generated.
+func (s *ImageStore) StoreFile(ctx context.Context, reader io.Reader, mimeType string, filename string, private bool) (*FileMetadata, error) {
+	bucket, err := s.bucket(private)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := &FileMetadata{
+		Name:      bson.NewObjectID().Hex(),
+		MimeType:  mimeType,
+		Filename:  filename,
+		CreatedAt: time.Now(),
+	}
+
+	key := metadata.Name + fileExtension(mimeType, filename)
+	f, err := os.OpenFile(key, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(key)
+
+	metadata.Size, err = io.Copy(f, reader)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasPrefix(mimeType, "video/") {
+		poster, err := s.storePoster(ctx, key, metadata.Name, private)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error while extracting the poster", "key", key, "error", err)
+		} else {
+			metadata.Poster = poster
+		}
+	}
+
+	f, err = os.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	disposition := contentDisposition("attachment", filename)
+	putCtx, span := startStorageSpan(ctx, "put", key, private)
+	_, err = s.store.PutObject(putCtx, &s3.PutObjectInput{
+		Bucket:             bucket,
+		Key:                &key,
+		ContentType:        &mimeType,
+		ContentDisposition: &disposition,
+		Body:               f,
+	})
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	imageUploadedBytes.WithLabelValues(bucketLabel(private)).Add(float64(metadata.Size))
+
+	metadata.Url = s.objectUrl(key, private)
+	return metadata, nil
+}
+
+// Extracts a frame of the video and stores it as an image named after the video
+func (s *ImageStore) storePoster(ctx context.Context, videoFilename string, name string, private bool) (string, error) {
+	img := &Image{MimeType: "image/jpeg", Name: name + "-poster", AvailableHeights: ImageHeights{0, 320}, Private: private}
+
+	// Skipping the first second avoids black intro frames, short videos fall back to their first frame
+	_, span := tracer.Start(ctx, "video.poster")
+	// Videos can carry a recording location, the poster doesn't inherit it
+	err := exec.Command("ffmpeg", "-y", "-ss", "1", "-i", videoFilename, "-frames:v", "1", "-q:v", "2", "-map_metadata", "-1", img.GetFilename()).Run()
+	if err != nil || fileIsEmpty(img.GetFilename()) {
+		err = exec.Command("ffmpeg", "-y", "-i", videoFilename, "-frames:v", "1", "-q:v", "2", "-map_metadata", "-1", img.GetFilename()).Run()
+	}
+	endSpan(span, err)
+
+	if err != nil {
+		img.removeInstances(img.AvailableHeights)
+		return "", err
+	}
+
+	return s.storeFromDisk(ctx, img)
+}
+
+// Streams an object from the store by its public url or private reference, the caller must close the body
+func (s *ImageStore) Open(ctx context.Context, url string) (*s3.GetObjectOutput, error) {
+	key, private := s.locate(url)
+	bucket, err := s.bucket(private)
+	if err != nil {
+		return nil, err
+	}
+
+	// The span covers the request, not the streaming of the body
+	ctx, span := startStorageSpan(ctx, "get", key, private)
+	object, err := s.store.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: bucket,
+		Key:    &key,
+	})
+	endSpan(span, err)
+
+	return object, err
+}
+
+// Builds a Content-Disposition header, encoding non ASCII filenames as described in RFC 6266
+func contentDisposition(dispositionType string, filename string) string {
+	if filename == "" {
+		return dispositionType
+	}
+
+	disposition := mime.FormatMediaType(dispositionType, map[string]string{"filename": filename})
+	if disposition == "" {
+		return dispositionType
+	}
+
+	return disposition
+}
+
+func fileExtension(mimeType string, filename string) string {
+	exts, err := mime.ExtensionsByType(mimeType)
+	if err == nil && len(exts) > 0 {
+		return exts[0]
+	}
+
+	extension := strings.ToLower(filepath.Ext(filename))
+	if fileExtensionPattern.MatchString(extension) {
+		return extension
+	}
+
+	return ""
+}
+
+var fileExtensionPattern = regexp.MustCompile(`^\.[a-z0-9]{1,8}$`)
+
+func fileIsEmpty(filename string) bool {
+	info, err := os.Stat(filename)
+	return err != nil || info.Size() == 0
+}
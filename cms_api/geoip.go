@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+const (
+	defaultGeoCacheSize = 10000
+	ipInfoTimeout       = 2 * time.Second
+)
+
+type GeoLocation struct {
+	CountryCode string
+	Region      string
+	City        string
+}
+
+// Resolves where an IP is located. A nil location without an error means the IP is unknown (e.g. private ranges).
+// Providers are closed once the server shuts down.
+type GeoProvider interface {
+	Lookup(ctx context.Context, ip netip.Addr) (*GeoLocation, error)
+	Close() error
+}
+
+// Picks the configured provider (mmdb, ipinfo or none).
+// It defaults to mmdb when a MaxMind format database is configured and to none otherwise,
+// ipinfo sends the IP of every visitor to a third party so it has to be picked explicitly.
+// Lookups are cached, the cache size sets how many are kept.
+func initializeGeoProvider(geoip GeoIPConfig) (GeoProvider, error) {
+	databasePath := geoip.Database
+	providerName := geoip.Provider
+	if providerName == "" {
+		providerName = "none"
+		if databasePath != "" {
+			providerName = "mmdb"
+		}
+	}
+
+	var provider GeoProvider
+	switch providerName {
+	case "mmdb":
+		mmdb, err := newMMDBGeoProvider(databasePath)
+		if err != nil {
+			return nil, err
+		}
+		provider = mmdb
+	case "ipinfo":
+		provider = newIPInfoGeoProvider(geoip.IPInfoToken)
+	case "none":
+		provider = NoGeoProvider{}
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown GeoIP provider %q, use mmdb, ipinfo or none", providerName))
+	}
+
+	slog.Info("Locating visitors with a GeoIP provider", "provider", providerName)
+	return newCachedGeoProvider(provider, geoip.CacheSize), nil
+}
+
+// Looks the IP up, treating unparsable IPs and provider errors as unknown locations
+func locateIp(ctx context.Context, provider GeoProvider, ip string) *GeoLocation {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return &GeoLocation{}
+	}
+
+	location, err := provider.Lookup(ctx, addr.Unmap())
+	if err != nil {
+		slog.WarnContext(ctx, "Error while locating a visitor", "error", err)
+		return &GeoLocation{}
+	}
+
+	if location == nil {
+		return &GeoLocation{}
+	}
+
+	return location
+}
+
+// Reads a MaxMind format (GeoLite2, GeoIP2 or compatible) City or Country database
+type MMDBGeoProvider struct {
+	reader *maxminddb.Reader
+}
+
+type mmdbRecord struct {
+	Country struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+}
+
+func newMMDBGeoProvider(path string) (*MMDBGeoProvider, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MMDBGeoProvider{reader: reader}, nil
+}
+
+func (p *MMDBGeoProvider) Lookup(ctx context.Context, ip netip.Addr) (*GeoLocation, error) {
+	var record mmdbRecord
+	_, found, err := p.reader.LookupNetwork(net.IP(ip.AsSlice()), &record)
+	if err != nil {
+		return nil, err
+	}
+
+	if found == false || record.Country.IsoCode == "" {
+		return nil, nil
+	}
+
+	location := &GeoLocation{CountryCode: record.Country.IsoCode, City: record.City.Names["en"]}
+	if len(record.Subdivisions) > 0 {
+		location.Region = record.Subdivisions[0].Names["en"]
+	}
+
+	return location, nil
+}
+
+func (p *MMDBGeoProvider) Close() error {
+	return p.reader.Close()
+}
+
+// Queries ipinfo.io, the token is optional but raises the rate limit
+type IPInfoGeoProvider struct {
+	client *http.Client
+	token  string
+}
+
+func newIPInfoGeoProvider(token string) *IPInfoGeoProvider {
+	return &IPInfoGeoProvider{client: &http.Client{Timeout: ipInfoTimeout}, token: token}
+}
+
+func (p *IPInfoGeoProvider) Lookup(ctx context.Context, ip netip.Addr) (*GeoLocation, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("https://ipinfo.io/%s/json", ip), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.token != "" {
+		request.Header.Set("Authorization", "Bearer "+p.token)
+	}
+
+	response, err := p.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("ipinfo responded with %v", response.Status))
+	}
+
+	var responseBody map[string]any
+	err = json.NewDecoder(response.Body).Decode(&responseBody)
+	if err != nil {
+		return nil, err
+	}
+
+	if isBogon, _ := responseBody["bogon"].(bool); isBogon {
+		return nil, nil
+	}
+
+	location := &GeoLocation{}
+	location.CountryCode, _ = responseBody["country"].(string)
+	location.Region, _ = responseBody["region"].(string)
+	location.City, _ = responseBody["city"].(string)
+	return location, nil
+}
+
+func (p *IPInfoGeoProvider) Close() error {
+	p.client.CloseIdleConnections()
+	return nil
+}
+
+// Never locates anyone, used when geolocation is disabled
+type NoGeoProvider struct{}
+
+func (NoGeoProvider) Lookup(ctx context.Context, ip netip.Addr) (*GeoLocation, error) {
+	return nil, nil
+}
+
+func (NoGeoProvider) Close() error {
+	return nil
+}
+
+// Keeps the most recent lookups of the wrapped provider in memory, unknown IPs included.
+// Failed lookups aren't cached so they're retried.
+type CachedGeoProvider struct {
+	provider GeoProvider
+	cache    *LRUCache[netip.Addr, *GeoLocation]
+}
+
+func newCachedGeoProvider(provider GeoProvider, size int) *CachedGeoProvider {
+	return &CachedGeoProvider{provider: provider, cache: newLRUCache[netip.Addr, *GeoLocation](size)}
+}
+
+func (p *CachedGeoProvider) Lookup(ctx context.Context, ip netip.Addr) (*GeoLocation, error) {
+	if location, exists := p.cache.Get(ip); exists {
+		return location, nil
+	}
+
+	location, err := p.provider.Lookup(ctx, ip)
+	if err != nil {
+		return nil, err
+	}
+
+	p.cache.Add(ip, location)
+	return location, nil
+}
+
+func (p *CachedGeoProvider) Close() error {
+	return p.provider.Close()
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/readpref"
+)
+
+const (
+	defaultHealthCacheTTL     = 10 * time.Second
+	defaultHealthCheckTimeout = 3 * time.Second
+)
+
+// A dependency the service can't work without
+type HealthCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+type DependencyStatus struct {
+	Status    StatusCode `json:"status"`
+	LatencyMs float64    `json:"latencyMs"`
+	// Only shown to authenticated callers, errors can reveal hosts and versions of the dependencies
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+// Runs the checks at most once per health.cacheTtl, however often readiness is probed
+type HealthChecker struct {
+	mu        sync.Mutex
+	checks    []HealthCheck
+	cacheTTL  time.Duration
+	timeout   time.Duration
+	results   map[string]DependencyStatus
+	checkedAt time.Time
+}
+
+func newHealthChecker(config HealthConfig, checks ...HealthCheck) *HealthChecker {
+	return &HealthChecker{checks: checks, cacheTTL: config.CacheTTL, timeout: config.CheckTimeout}
+}
+
+// Returns the status of every dependency and whether they're all healthy.
+// Concurrent callers wait for the same run instead of starting their own.
+func (h *HealthChecker) Check(ctx context.Context) (map[string]DependencyStatus, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.results == nil || time.Since(h.checkedAt) >= h.cacheTTL {
+		h.results = h.run(ctx)
+		h.checkedAt = time.Now()
+	}
+
+	healthy := true
+	for _, result := range h.results {
+		if result.Status != StatusCodeOk {
+			healthy = false
+		}
+	}
+
+	return h.results, healthy
+}
+
+// Checks every dependency in parallel, each within the check timeout
+func (h *HealthChecker) run(ctx context.Context) map[string]DependencyStatus {
+	// The results are shared with the callers that come after, so they shouldn't fail because this one left
+	ctx = context.WithoutCancel(ctx)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]DependencyStatus, len(h.checks))
+	for _, check := range h.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			checkCtx, cancel := context.WithTimeout(ctx, h.timeout)
+			defer cancel()
+
+			start := time.Now()
+			err := check.Check(checkCtx)
+			result := DependencyStatus{
+				Status:    StatusCodeOk,
+				LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+				CheckedAt: start,
+			}
+
+			if err != nil {
+				result.Status = StatusCodeError
+				result.Error = err.Error()
+				slog.WarnContext(ctx, "Dependency health check failed", "dependency", check.Name, "error", err)
+			}
+
+			mu.Lock()
+			results[check.Name] = result
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
+
+func mongoHealthCheck(db *mongo.Client) HealthCheck {
+	return HealthCheck{
+		Name: "mongo",
+		Check: func(ctx context.Context) error {
+			return db.Ping(ctx, readpref.Primary())
+		},
+	}
+}
+
+func storageHealthCheck(imageStore *ImageStore) HealthCheck {
+	return HealthCheck{
+		Name:  "storage",
+		Check: imageStore.Ping,
+	}
+}
+
+// Images can't be processed without ffmpeg and ffprobe, and pngs are converted with libwebp
+func ffmpegHealthCheck() HealthCheck {
+	return HealthCheck{
+		Name: "ffmpeg",
+		Check: func(ctx context.Context) error {
+			_, err := exec.LookPath("ffprobe")
+			if err != nil {
+				return err
+			}
+
+			encoders, err := exec.CommandContext(ctx, "ffmpeg", "-hide_banner", "-encoders").Output()
+			if err != nil {
+				return err
+			}
+
+			if strings.Contains(string(encoders), "libwebp") == false {
+				return errors.New("ffmpeg was built without the libwebp encoder")
+			}
+
+			return nil
+		},
+	}
+}
+
+// Answers as long as the process can serve requests, it never checks dependencies
+func getLiveness(w http.ResponseWriter, r *http.Request) {
+	WriteJSON(w, http.StatusOK, ResponseMessage{
+		Status:  StatusCodeOk,
+		Message: "Service healthy",
+	})
+}
+
+// Reports whether every dependency is reachable, with 503 when one isn't so traffic is routed elsewhere.
+// The errors of failed checks are logged and only included for authenticated callers.
+func getReadiness(health *HealthChecker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		results, healthy := health.Check(r.Context())
+		if isAuthenticated(r) == false {
+			redacted := make(map[string]DependencyStatus, len(results))
+			for name, result := range results {
+				result.Error = ""
+				redacted[name] = result
+			}
+			results = redacted
+		}
+		if healthy == false {
+			WriteJSON(w, http.StatusServiceUnavailable, ResponseMessage{
+				Status:  StatusCodeError,
+				Message: "Service not ready",
+				Data:    results,
+			})
+			return
+		}
+
+		WriteJSON(w, http.StatusOK, ResponseMessage{
+			Status:  StatusCodeOk,
+			Message: "Service ready",
+			Data:    results,
+		})
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// Objects younger than this are never collected, so media uploaded for an entry that hasn't been saved yet survives
+const imageGCGracePeriod = time.Hour
+
+type ImageGCRequest struct {
+	Confirm bool `json:"confirm"`
+}
+
+func (g ImageGCRequest) Validate(r *http.Request, db *mongo.Client) (Misses, error) {
+	return make(Misses, 0), nil
+}
+
+type ImageGCReport struct {
+	DryRun           bool            `json:"dryRun"`
+	ScannedObjects   int             `json:"scannedObjects"`
+	ReferencedImages int             `json:"referencedImages"`
+	Orphans          []OrphanedImage `json:"orphans"`
+	OrphanedBytes    int64           `json:"orphanedBytes"`
+	DeletedObjects   int             `json:"deletedObjects"`
+}
+
+// An orphaned image groups every stored variant (original and downscaled heights) of an unreferenced image
+type OrphanedImage struct {
+	Name    string   `json:"name"`
+	Keys    []string `json:"keys"`
+	Size    int64    `json:"size"`
+	Private bool     `json:"private"`
+}
+
+// Reports the images in the store that no collection entry references.
+// Nothing is deleted unless the body is {"confirm": true}.
+func collectOrphanedImages(db *mongo.Client, imageStore *ImageStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, _, err := ReadBodyJSON[ImageGCRequest](r, db)
+		if err != nil && errors.Is(err, io.EOF) == false {
+			WriteError(w, r, toAPIError(err, "Error while validating the image GC request"))
+			return
+		}
+
+		report, err := runImageGC(r.Context(), db, imageStore, body.Confirm == false)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Image GC stopped early", "report", report)
+			WriteError(w, r, toAPIError(err, "Error while collecting orphaned images"))
+			return
+		}
+
+		message := fmt.Sprintf("Found %v orphaned images", len(report.Orphans))
+		if report.DryRun == false {
+			message = fmt.Sprintf("Deleted %v objects of %v orphaned images", report.DeletedObjects, len(report.Orphans))
+		}
+
+		WriteJSON(w, http.StatusOK, ResponseMessage{Status: StatusCodeOk, Message: message, Data: report})
+	}
+}
+
+func runImageGC(ctx context.Context, db *mongo.Client, imageStore *ImageStore, dryRun bool) (*ImageGCReport, error) {
+	report := &ImageGCReport{DryRun: dryRun, Orphans: make([]OrphanedImage, 0)}
+
+	// Public urls can't be recognized without the base url, every public object would look orphaned
+	if imageStore.ResourceBaseUrl == "" {
+		return report, errors.New("No resource base url configured. Set the 'R2_EXTERNAL_URL' environment variable.")
+	}
+
+	referenced, err := getReferencedImageNames(ctx, db, imageStore)
+	if err != nil {
+		return report, err
+	}
+	report.ReferencedImages = len(referenced)
+
+	buckets := []bool{false}
+	if imageStore.HasPrivateBucket() {
+		buckets = append(buckets, true)
+	}
+
+	orphans := make(map[string]*OrphanedImage)
+	for _, private := range buckets {
+		objects, err := imageStore.listObjects(ctx, "", private)
+		if err != nil {
+			return report, err
+		}
+		report.ScannedObjects += len(objects)
+
+		for _, object := range objects {
+			name := imageNameFromKey(*object.Key)
+			if _, exists := referenced[name]; exists {
+				continue
+			}
+
+			if object.LastModified != nil && time.Since(*object.LastModified) < imageGCGracePeriod {
+				continue
+			}
+
+			orphanKey := imageStore.objectUrl(name, private)
+			orphan, exists := orphans[orphanKey]
+			if exists == false {
+				orphan = &OrphanedImage{Name: name, Keys: make([]string, 0), Private: private}
+				orphans[orphanKey] = orphan
+			}
+
+			orphan.Keys = append(orphan.Keys, *object.Key)
+			if object.Size != nil {
+				orphan.Size += *object.Size
+				report.OrphanedBytes += *object.Size
+			}
+		}
+	}
+
+	for _, orphan := range orphans {
+		report.Orphans = append(report.Orphans, *orphan)
+	}
+	sort.Slice(report.Orphans, func(i, j int) bool { return report.Orphans[i].Name < report.Orphans[j].Name })
+
+	if dryRun {
+		return report, nil
+	}
+
+	for _, orphan := range report.Orphans {
+		bucket, err := imageStore.bucket(orphan.Private)
+		if err != nil {
+			return report, err
+		}
+
+		for _, key := range orphan.Keys {
+			deleteCtx, span := startStorageSpan(ctx, "delete", key, orphan.Private)
+			_, err := imageStore.store.DeleteObject(deleteCtx, &s3.DeleteObjectInput{
+				Bucket: bucket,
+				Key:    &key,
+			})
+			endSpan(span, err)
+			if err != nil {
+				return report, err
+			}
+
+			report.DeletedObjects++
+		}
+
+		err = deleteDBResource(ctx, db.Database(CMS_DATABASE), CMS_C_MEDIA, bson.M{"name": orphan.Name})
+		if err != nil {
+			slog.WarnContext(ctx, "No media metadata deleted for orphaned image", "name", orphan.Name, "error", err)
+		}
+	}
+
+	slog.InfoContext(ctx, "Image GC deleted orphaned objects", "objects", report.DeletedObjects, "bytes", report.OrphanedBytes)
+	return report, nil
+}
+
+// Scans every entry of every collection for store urls, including ones embedded in text like mdx
+func getReferencedImageNames(ctx context.Context, db *mongo.Client, imageStore *ImageStore) (map[string]bool, error) {
+	cmsDatabase := db.Database(CMS_DATABASE)
+	collections, err := getDBResource(ctx, cmsDatabase, CMS_C_COLLECTIONS, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+
+	referenced := make(map[string]bool)
+	for _, collection := range collections {
+		path, ok := collection["path"].(string)
+		if ok == false {
+			continue
+		}
+
+		entries, err := getDBResource(ctx, cmsDatabase, path, bson.D{})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			for _, url := range findImageUrls(imageStore, entry) {
+				referenced[imageNameFromUrl(imageStore, url)] = true
+			}
+		}
+	}
+
+	return referenced, nil
+}
+
+// Recursively collects every url pointing to the image store inside a document, including private references
+func findImageUrls(imageStore *ImageStore, value any) []string {
+	urls := make([]string, 0)
+	pattern := imageStore.urlPattern()
+
+	var walk func(value any)
+	walk = func(value any) {
+		switch typed := value.(type) {
+		case string:
+			urls = append(urls, pattern.FindAllString(typed, -1)...)
+		case map[string]any:
+			for _, child := range typed {
+				walk(child)
+			}
+		case bson.M:
+			for _, child := range typed {
+				walk(child)
+			}
+		case bson.D:
+			for _, element := range typed {
+				walk(element.Value)
+			}
+		case bson.A:
+			for _, child := range typed {
+				walk(child)
+			}
+		case []any:
+			for _, child := range typed {
+				walk(child)
+			}
+		}
+	}
+
+	walk(value)
+	return urls
+}
+
+// Deletes the images referenced in the documents that no entry of any collection references anymore,
+// logging failures instead of stopping. Urls can be shared between entries and embedded in mdx,
+// so the documents must already be deleted or updated when it's called.
+func deleteReferencedImages(ctx context.Context, db *mongo.Client, imageStore *ImageStore, documents ...map[string]any) {
+	urls := make([]string, 0)
+	for _, document := range documents {
+		urls = append(urls, findImageUrls(imageStore, document)...)
+	}
+
+	if len(urls) == 0 {
+		return
+	}
+
+	referenced, err := getReferencedImageNames(ctx, db, imageStore)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error while checking image references, no image was deleted", "error", err)
+		return
+	}
+
+	deleted := make(map[string]bool)
+	for _, url := range urls {
+		if referenced[imageNameFromUrl(imageStore, url)] || deleted[url] {
+			continue
+		}
+
+		err := deleteImage(ctx, db, imageStore, url)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error while deleting image", "url", url, "error", err)
+			continue
+		}
+
+		deleted[url] = true
+	}
+}
+
+// Deletes every stored variant of an image along with its metadata
+func deleteImage(ctx context.Context, db *mongo.Client, imageStore *ImageStore, url string) error {
+	err := imageStore.Delete(ctx, url)
+	if err != nil {
+		return err
+	}
+
+	err = deleteDBResource(ctx, db.Database(CMS_DATABASE), CMS_C_MEDIA, bson.M{"name": imageNameFromUrl(imageStore, url)})
+	if err != nil {
+		slog.WarnContext(ctx, "No media metadata deleted for image", "url", url, "error", err)
+	}
+
+	return nil
+}
+
+// Matches the urls of the store (and private references) inside any text, compiled once per store
+func (s *ImageStore) urlPattern() *regexp.Regexp {
+	s.urlPatternOnce.Do(func() {
+		prefixes := regexp.QuoteMeta(privateAssetScheme)
+		if s.ResourceBaseUrl != "" {
+			prefixes += "|" + regexp.QuoteMeta(s.ResourceBaseUrl+"/")
+		}
+
+		s.urlRegexp = regexp.MustCompile(`(?:` + prefixes + `)[^` + urlTerminators + `]+`)
+	})
+
+	return s.urlRegexp
+}
+
+func imageNameFromUrl(imageStore *ImageStore, url string) string {
+	key, _ := imageStore.locate(url)
+	return imageNameFromKey(key)
+}
+
+// Maps a store key of any image variant (eg name.webp or name-320.webp) to the image name
+func imageNameFromKey(key string) string {
+	name, _, _ := strings.Cut(key, ".")
+	name, _, _ = strings.Cut(name, "-")
+	return name
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// Width of the low quality image placeholder, it's meant to be blurred and stretched by the client
+const placeholderWidth = 16
+
+// Details extracted while processing an image, stored in the media collection under the image name
+type ImageMetadata struct {
+	Name          string     `json:"name"`
+	Url           string     `json:"url"`
+	MimeType      string     `json:"mimeType"`
+	Width         int        `json:"width"`
+	Height        int        `json:"height"`
+	DominantColor string     `json:"dominantColor"`
+	Placeholder   string     `json:"placeholder"`
+	FocalPoint    FocalPoint `json:"focalPoint"`
+	Variants      []string   `json:"variants"`
+	CreatedAt     time.Time  `json:"createdAt"`
+}
+
+func (m *ImageMetadata) ToMap() map[string]interface{} {
+	return map[string]interface{}{
+		"kind":          string(CollectionAttrTypeImage),
+		"name":          m.Name,
+		"url":           m.Url,
+		"mimeType":      m.MimeType,
+		"width":         m.Width,
+		"height":        m.Height,
+		"dominantColor": m.DominantColor,
+		"placeholder":   m.Placeholder,
+		"focalPoint":    m.FocalPoint.ToMap(),
+		"variants":      m.Variants,
+		"createdAt":     bson.NewDateTimeFromTime(m.CreatedAt),
+	}
+}
+
+// The point of interest of an image relative to its size, {0.5, 0.5} being the center
+type FocalPoint struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+var defaultFocalPoint = FocalPoint{X: 0.5, Y: 0.5}
+
+func (f FocalPoint) ToMap() map[string]interface{} {
+	return map[string]interface{}{"x": f.X, "y": f.Y}
+}
+
+func (f FocalPoint) Validate() Misses {
+	misses := make(Misses, 0)
+
+	if f.X < 0 || f.X > 1 {
+		misses["x"] = "Must be between 0 and 1"
+	}
+
+	if f.Y < 0 || f.Y > 1 {
+		misses["y"] = "Must be between 0 and 1"
+	}
+
+	return misses
+}
+
+// A crop is a variant with a fixed aspect ratio cut around the focal point, stored as name-{Name}.ext
+type ImageCrop struct {
+	Name         string
+	AspectWidth  int
+	AspectHeight int
+	Height       Height
+}
+
+var imageCrops = []ImageCrop{
+	{Name: "square", AspectWidth: 1, AspectHeight: 1, Height: 320},
+	{Name: "wide", AspectWidth: 16, AspectHeight: 9, Height: 720},
+}
+
+// Metadata such as the GPS location and camera details is stripped unless images.keepMetadata is set.
+// Variants and crops never carry it.
+func keepImageMetadata() bool {
+	return appConfig.Images.KeepMetadata
+}
+
+// Rotates jpeg images according to their EXIF orientation whether their metadata is kept or not,
+// rotated images lose it as their orientation tag wouldn't be true anymore.
+// Unless images.keepMetadata is set, jpeg, webp and gif images are re-encoded without their metadata,
+// png images lose it when converted to webp.
+func (img *Image) normalize() error {
+	args := []string{"-y"}
+	switch img.MimeType {
+	case "image/jpeg":
+		orientation, err := readExifOrientation(img.GetFilename())
+		if err != nil {
+			orientation = 1
+		}
+
+		filter := orientationFilters[orientation]
+		if filter == "" && keepImageMetadata() {
+			return nil
+		}
+
+		args = append(args, "-noautorotate", "-i", img.GetFilename(), "-map_metadata", "-1", "-q:v", "2")
+		if filter != "" {
+			args = append(args, "-vf", filter)
+		}
+	case "image/webp":
+		if keepImageMetadata() {
+			return nil
+		}
+
+		args = append(args, "-i", img.GetFilename(), "-map_metadata", "-1", "-c:v", "libwebp", "-lossless", "1")
+	case "image/gif":
+		if keepImageMetadata() {
+			return nil
+		}
+
+		// Copying the frames keeps the palette and animation, comments and application extensions are dropped
+		args = append(args, "-i", img.GetFilename(), "-map_metadata", "-1", "-c", "copy")
+	default:
+		return nil
+	}
+
+	normalizedName := img.GetFilenameWithPostfix("normalized")
+	args = append(args, normalizedName)
+
+	err := exec.Command("ffmpeg", args...).Run()
+	if err != nil {
+		os.Remove(normalizedName)
+		return err
+	}
+
+	return os.Rename(normalizedName, img.GetFilename())
+}
+
+// ffmpeg filters undoing each EXIF orientation
+var orientationFilters = map[int]string{
+	2: "hflip",
+	3: "hflip,vflip",
+	4: "vflip",
+	5: "transpose=0",
+	6: "transpose=1",
+	7: "transpose=3",
+	8: "transpose=2",
+}
+
+// Reads the orientation tag (0x0112) from the EXIF segment of a jpeg
+func readExifOrientation(filename string) (int, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	// The EXIF segment has to be among the first segments, so a small prefix is enough
+	header := make([]byte, 64*1024)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return 0, err
+	}
+	header = header[:n]
+
+	if len(header) < 4 || header[0] != 0xFF || header[1] != 0xD8 {
+		return 0, errors.New("Not a jpeg")
+	}
+
+	for offset := 2; offset+4 <= len(header); {
+		if header[offset] != 0xFF {
+			return 0, errors.New("Malformed jpeg segment")
+		}
+
+		marker := header[offset+1]
+		segmentLength := int(binary.BigEndian.Uint16(header[offset+2:]))
+		segmentStart := offset + 4
+		segmentEnd := offset + 2 + segmentLength
+		if segmentEnd > len(header) {
+			break
+		}
+
+		if marker == 0xE1 && bytes.HasPrefix(header[segmentStart:segmentEnd], []byte("Exif\x00\x00")) {
+			return parseTiffOrientation(header[segmentStart+6 : segmentEnd])
+		}
+
+		// Start of scan, no metadata follows
+		if marker == 0xDA {
+			break
+		}
+
+		offset = segmentEnd
+	}
+
+	return 0, errors.New("No EXIF orientation found")
+}
+
+func parseTiffOrientation(tiff []byte) (int, error) {
+	if len(tiff) < 8 {
+		return 0, errors.New("Truncated EXIF data")
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0, errors.New("Invalid EXIF byte order")
+	}
+
+	ifdOffset := int(order.Uint32(tiff[4:]))
+	if ifdOffset+2 > len(tiff) {
+		return 0, errors.New("Truncated EXIF data")
+	}
+
+	entries := int(order.Uint16(tiff[ifdOffset:]))
+	for i := 0; i < entries; i++ {
+		entry := ifdOffset + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			return int(order.Uint16(tiff[entry+8:])), nil
+		}
+	}
+
+	return 0, errors.New("No EXIF orientation found")
+}
+
+// Extracts the dimensions, the dominant color and a tiny base64 placeholder of the image on disk
+func (img *Image) extractMetadata() (*ImageMetadata, error) {
+	probe, err := exec.Command("ffprobe", "-v", "error", "-select_streams", "v:0",
+		"-show_entries", "stream=width,height", "-of", "csv=p=0:s=x", img.GetFilename()).Output()
+	if err != nil {
+		return nil, err
+	}
+
+	widthString, heightString, _ := strings.Cut(strings.TrimSpace(string(probe)), "x")
+	width, errWidth := strconv.Atoi(widthString)
+	height, errHeight := strconv.Atoi(heightString)
+	if errWidth != nil || errHeight != nil {
+		return nil, errors.New(fmt.Sprintf("Couldn't read the dimensions of %v", img.GetFilename()))
+	}
+
+	// Averaging every pixel into one is a cheap approximation of the dominant color
+	pixel, err := exec.Command("ffmpeg", "-v", "error", "-i", img.GetFilename(), "-frames:v", "1",
+		"-vf", "scale=1:1:flags=area", "-f", "rawvideo", "-pix_fmt", "rgb24", "-").Output()
+	if err != nil || len(pixel) < 3 {
+		return nil, errors.New(fmt.Sprintf("Couldn't read the dominant color of %v", img.GetFilename()))
+	}
+
+	placeholder, err := exec.Command("ffmpeg", "-v", "error", "-i", img.GetFilename(), "-frames:v", "1",
+		"-vf", fmt.Sprintf("scale=%d:-2", placeholderWidth), "-f", "image2pipe", "-c:v", "png", "-").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ImageMetadata{
+		Name:          img.Name,
+		MimeType:      img.MimeType,
+		Width:         width,
+		Height:        height,
+		DominantColor: fmt.Sprintf("#%02x%02x%02x", pixel[0], pixel[1], pixel[2]),
+		Placeholder:   "data:image/png;base64," + base64.StdEncoding.EncodeToString(placeholder),
+		FocalPoint:    defaultFocalPoint,
+		Variants:      make([]string, 0),
+		CreatedAt:     time.Now(),
+	}, nil
+}
+
+// Cuts the largest area of the crop's aspect ratio around the focal point and scales it to the crop's height.
+// Returns the filename of the cropped image
+func (img *Image) crop(crop ImageCrop, width int, height int, focalPoint FocalPoint) (string, error) {
+	aspectRatio := float64(crop.AspectWidth) / float64(crop.AspectHeight)
+
+	cropWidth, cropHeight := width, height
+	if float64(width)/float64(height) > aspectRatio {
+		cropWidth = int(math.Round(float64(height) * aspectRatio))
+	} else {
+		cropHeight = int(math.Round(float64(width) / aspectRatio))
+	}
+
+	x := clampInt(int(math.Round(focalPoint.X*float64(width)))-cropWidth/2, 0, width-cropWidth)
+	y := clampInt(int(math.Round(focalPoint.Y*float64(height)))-cropHeight/2, 0, height-cropHeight)
+
+	croppedName := img.GetFilenameWithPostfix(crop.Name)
+	filter := fmt.Sprintf("crop=%d:%d:%d:%d,scale=-2:'min(%d,ih)'", cropWidth, cropHeight, x, y, crop.Height)
+	err := exec.Command("ffmpeg", "-y", "-i", img.GetFilename(), "-vf", filter, "-map_metadata", "-1", croppedName).Run()
+	if err != nil {
+		os.Remove(croppedName)
+		return "", err
+	}
+
+	return croppedName, nil
+}
+
+func (img *Image) removeCrops() {
+	for _, crop := range imageCrops {
+		os.Remove(img.GetFilenameWithPostfix(crop.Name))
+	}
+}
+
+func clampInt(value, minimum, maximum int) int {
+	return max(minimum, min(value, maximum))
+}
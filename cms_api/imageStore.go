@@ -2,27 +2,50 @@ package main
 
 import (
 	"context"
-	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"mime"
+	"net/http"
 	"os"
 	"os/exec"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type ImageStore struct {
 	ResourceBaseUrl string
 	store           *s3.Client
+	presigner       *s3.PresignClient
 	bucketName      string
+	// Objects in this bucket are never public and are only shared through presigned urls
+	privateBucketName string
+	urlPatternOnce    sync.Once
+	urlRegexp         *regexp.Regexp
 }
 
+// Private objects are referenced as private://key instead of a public url
+const privateAssetScheme = "private://"
+
+// Characters ending a url embedded in text, markdown links and html attributes
+const urlTerminators = `\s"'()<>\[\]`
+
+var privateAssetPattern = regexp.MustCompile(regexp.QuoteMeta(privateAssetScheme) + `[^` + urlTerminators + `]+`)
+
+const defaultPrivateUrlLifetime = 15 * time.Minute
+
 // An image represents a collection of store objects represented by a name, height and mimeType (extension)
 
 // We're using the height as the identifier as resolutions (eg HD and FHD) are represented by the pixel height in their naming convention.
@@ -32,22 +55,19 @@ type ImageStore struct {
 type Image struct {
 	MimeType string
 	Name     string
-	Data     []byte
 	AvailableHeights ImageHeights
+	// Private images are stored in the private bucket
+	Private bool
+	// Filled in once the image is stored
+	Metadata *ImageMetadata
 }
 
 type Height int
 type ImageHeights []Height
 
-func initializeImageStore() (*ImageStore, error) {
-	r2StoreUrl := os.Getenv("R2_STORE_URL")
-	r2AccountId := os.Getenv("R2_ACCOUNT_ID")
-	r2AccessKey := os.Getenv("R2_ACCESS_KEY")
-	r2SecretKey := os.Getenv("R2_ACCESS_SECRET_KEY")
-	r2BucketName := os.Getenv("R2_BUCKET")
-
+func initializeImageStore(storage StorageConfig) (*ImageStore, error) {
 	cfg, err := config.LoadDefaultConfig(context.TODO(),
-		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(r2AccessKey, r2SecretKey, "")),
+		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(storage.AccessKey, storage.SecretKey, "")),
 		config.WithRegion("apac"),
 	)
 	if err != nil {
@@ -55,102 +75,257 @@ func initializeImageStore() (*ImageStore, error) {
 	}
 
 	client := s3.NewFromConfig(cfg, func(opts *s3.Options) {
-		opts.BaseEndpoint = aws.String(fmt.Sprintf(r2StoreUrl, r2AccountId))
+		opts.BaseEndpoint = aws.String(fmt.Sprintf(storage.URL, storage.AccountId))
 	})
 
 	return &ImageStore{
-		store:           client,
-		bucketName:      r2BucketName,
-		ResourceBaseUrl: os.Getenv("R2_EXTERNAL_URL"),
+		store:             client,
+		presigner:         s3.NewPresignClient(client),
+		bucketName:        storage.Bucket,
+		privateBucketName: storage.PrivateBucket,
+		ResourceBaseUrl:   storage.ExternalURL,
 	}, nil
 }
 
-func NewImage(b64Image string, heights ImageHeights) (*Image, error) {
-	parts := strings.Split(b64Image, ",")
-	img, err := base64.StdEncoding.DecodeString(parts[1])
+// Streams the image into a file on disk and stores it without holding the whole image in memory.
+// The reader is expected to be already limited to an acceptable size.
+func (s *ImageStore) StoreFromReader(ctx context.Context, reader io.Reader, mimeType string, private bool) (*Image, error) {
+	img := &Image{
+		MimeType:         mimeType,
+		Name:             bson.NewObjectID().Hex(),
+		AvailableHeights: ImageHeights{0, 320},
+		Private:          private,
+	}
+
+	f, err := os.OpenFile(img.GetFilename(), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
 	if err != nil {
 		return nil, err
 	}
 
-	dirtyImgType := strings.Replace(parts[0], "data:", "", 1)
-	imgType := strings.Replace(dirtyImgType, ";base64", "", 1)
+	_, err = io.Copy(f, reader)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
 
-	if len(heights) == 0 {
-		heights = append(heights, 0, 320)
+	if err != nil {
+		img.removeInstances(img.AvailableHeights)
+		return nil, err
 	}
 
-	return &Image{
-		MimeType: imgType,
-		Data:     img,
-		AvailableHeights: heights,
-	}, nil
+	_, err = s.storeFromDisk(ctx, img)
+	if err != nil {
+		return nil, err
+	}
+
+	return img, nil
 }
 
-func (s *ImageStore) Store(img *Image) (string, error) {
-	images := make(map[string][]byte)
+// Generates every available height and crop of an image that's already saved to disk and uploads them to the store.
+// Every local instance of the image is removed once done.
+func (s *ImageStore) storeFromDisk(ctx context.Context, img *Image) (string, error) {
+	ctx, span := tracer.Start(ctx, "image.store", trace.WithAttributes(
+		attribute.String("image.name", img.Name),
+		attribute.String("image.mimeType", img.MimeType),
+	))
+	defer span.End()
+
+	defer img.removeInstances(img.AvailableHeights)
+	defer img.removeCrops()
 
-	err := img.saveToDisk()
+	_, err := s.bucket(img.Private)
+	if err != nil {
+		return "", err
+	}
+
+	processingStart := time.Now()
+	_, stepSpan := tracer.Start(ctx, "image.normalize")
+	err = img.normalize()
+	endSpan(stepSpan, err)
 	if err != nil {
 		return "", err
 	}
 
 	if img.MimeType == "image/png" {
-		img.convert("image/webp")
+		_, stepSpan := tracer.Start(ctx, "image.convert")
+		_, err := img.convert("image/webp")
+		endSpan(stepSpan, err)
+		if err != nil {
+			return "", err
+		}
+
 		img.MimeType = "image/webp"
 	}
 
+	_, stepSpan = tracer.Start(ctx, "image.metadata")
+	metadata, err := img.extractMetadata()
+	endSpan(stepSpan, err)
+	if err != nil {
+		return "", err
+	}
+
+	variants := make([]string, 0, len(img.AvailableHeights)+len(imageCrops))
 	for _, height := range img.AvailableHeights {
-		var imgName string
-		var imgBytes []byte
+		if height == 0 {
+			variants = append(variants, img.GetFilename())
+			continue
+		}
 
-		if height != 0 {
-			downscaled, err := img.downscale(height)
-			if err != nil {
-				return "", err
-			}
+		_, stepSpan := tracer.Start(ctx, "image.downscale", trace.WithAttributes(attribute.Int("image.height", int(height))))
+		downscaledName, err := img.downscale(height)
+		endSpan(stepSpan, err)
+		if err != nil {
+			return "", err
+		}
 
-			imgBytes = downscaled
-			imgName = img.GetFilenameWithPostfix(strconv.Itoa(int(height)))
-		} else {
-			imgName = img.GetFilename()
-			imgBytes = img.Data
+		variants = append(variants, downscaledName)
+	}
+
+	for _, crop := range imageCrops {
+		_, stepSpan := tracer.Start(ctx, "image.crop", trace.WithAttributes(attribute.String("image.crop", crop.Name)))
+		croppedName, err := img.crop(crop, metadata.Width, metadata.Height, metadata.FocalPoint)
+		endSpan(stepSpan, err)
+		if err != nil {
+			return "", err
 		}
 
-		images[imgName] = imgBytes
+		variants = append(variants, croppedName)
+	}
+	observeImageProcessing("process", processingStart)
+
+	uploadStart := time.Now()
+	for _, variant := range variants {
+		err := s.upload(ctx, variant, img.MimeType, img.Private)
+		if err != nil {
+			return "", err
+		}
 	}
+	observeImageProcessing("upload", uploadStart)
+
+	metadata.Url = s.objectUrl(img.GetFilename(), img.Private)
+	metadata.Variants = variants
+	img.Metadata = metadata
+
+	return metadata.Url, nil
+}
+
+// Regenerates the crops of a stored image around a new focal point
+func (s *ImageStore) Recrop(ctx context.Context, metadata *ImageMetadata, focalPoint FocalPoint) error {
+	defer observeImageProcessing("recrop", time.Now())
+	ctx, span := tracer.Start(ctx, "image.recrop", trace.WithAttributes(attribute.String("image.name", metadata.Name)))
+	defer span.End()
+
+	_, private := s.locate(metadata.Url)
+	img := &Image{MimeType: metadata.MimeType, Name: metadata.Name, AvailableHeights: ImageHeights{0}, Private: private}
+	defer img.removeInstances(img.AvailableHeights)
+	defer img.removeCrops()
 
-	err = img.removeInstances(img.AvailableHeights)
+	err := s.download(ctx, img.GetFilename(), img.Private)
 	if err != nil {
+		return err
 	}
 
-	for name, image := range images {
-		bodyReader := strings.NewReader(string(image))
-		_, err := s.store.PutObject(context.TODO(), &s3.PutObjectInput{
-			Bucket:      &s.bucketName,
-			Key:         &name,
-			ContentType: &img.MimeType,
-			Body:        bodyReader,
-		})
+	for _, crop := range imageCrops {
+		_, stepSpan := tracer.Start(ctx, "image.crop", trace.WithAttributes(attribute.String("image.crop", crop.Name)))
+		croppedName, err := img.crop(crop, metadata.Width, metadata.Height, focalPoint)
+		endSpan(stepSpan, err)
 		if err != nil {
-			return "", err
+			return err
 		}
+
+		err = s.upload(ctx, croppedName, img.MimeType, img.Private)
+		if err != nil {
+			return err
+		}
+	}
+
+	metadata.FocalPoint = focalPoint
+	return nil
+}
+
+// Streams an object from the store to a local file using its key as the filename
+func (s *ImageStore) download(ctx context.Context, key string, private bool) (err error) {
+	ctx, span := startStorageSpan(ctx, "get", key, private)
+	defer func() { endSpan(span, err) }()
+
+	bucket, err := s.bucket(private)
+	if err != nil {
+		return err
+	}
+
+	out, err := s.store.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return err
+	}
+	defer out.Body.Close()
+
+	f, err := os.OpenFile(key, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, out.Body)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// Streams a local file to the store using its filename as the key
+func (s *ImageStore) upload(ctx context.Context, filename string, mimeType string, private bool) (err error) {
+	ctx, span := startStorageSpan(ctx, "put", filename, private)
+	defer func() { endSpan(span, err) }()
+
+	bucket, err := s.bucket(private)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
 	}
+	defer f.Close()
 
-	imgUrl := s.ResourceBaseUrl + "/" + img.GetFilename()
+	_, err = s.store.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      bucket,
+		Key:         &filename,
+		ContentType: &mimeType,
+		Body:        f,
+	})
+	if err != nil {
+		return err
+	}
 
-	return imgUrl, nil
+	if info, err := f.Stat(); err == nil {
+		imageUploadedBytes.WithLabelValues(bucketLabel(private)).Add(float64(info.Size()))
+	}
+
+	return nil
 }
 
-func (s *ImageStore) Delete(imgUrl string) error {
-	identifier := strings.TrimPrefix(imgUrl, s.ResourceBaseUrl+"/")
+func (s *ImageStore) Delete(ctx context.Context, imgUrl string) error {
+	identifier, private := s.locate(imgUrl)
+	bucket, err := s.bucket(private)
+	if err != nil {
+		return err
+	}
+
 	identifierChunks := strings.Split(identifier, ".")
-	names, err := s.getAllImageNames(identifierChunks[0])
+	names, err := s.getAllImageNames(ctx, identifierChunks[0], private)
 
 	for _, name := range names {
-		_, deleteErr := s.store.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
-			Bucket: &s.bucketName,
+		deleteCtx, span := startStorageSpan(ctx, "delete", name, private)
+		_, deleteErr := s.store.DeleteObject(deleteCtx, &s3.DeleteObjectInput{
+			Bucket: bucket,
 			Key:    &name,
 		})
+		endSpan(span, deleteErr)
 		if deleteErr != nil {
 			err = deleteErr
 		}
@@ -159,6 +334,84 @@ func (s *ImageStore) Delete(imgUrl string) error {
 	return err
 }
 
+// Lists a single object of each bucket, enough to know the store is reachable with our credentials
+func (s *ImageStore) Ping(ctx context.Context) error {
+	buckets := []bool{false}
+	if s.HasPrivateBucket() {
+		buckets = append(buckets, true)
+	}
+
+	for _, private := range buckets {
+		bucket, err := s.bucket(private)
+		if err != nil {
+			return err
+		}
+
+		_, err = s.store.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: bucket, MaxKeys: aws.Int32(1)})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *ImageStore) bucket(private bool) (*string, error) {
+	if private == false {
+		return &s.bucketName, nil
+	}
+
+	if s.privateBucketName == "" {
+		return nil, errors.New("No private bucket configured. Set the 'R2_PRIVATE_BUCKET' environment variable.")
+	}
+
+	return &s.privateBucketName, nil
+}
+
+func (s *ImageStore) HasPrivateBucket() bool {
+	return s.privateBucketName != ""
+}
+
+func (s *ImageStore) objectUrl(key string, private bool) string {
+	if private {
+		return privateAssetScheme + key
+	}
+
+	return s.ResourceBaseUrl + "/" + key
+}
+
+// Maps a public url or a private reference back to its key
+func (s *ImageStore) locate(url string) (string, bool) {
+	if key, private := strings.CutPrefix(url, privateAssetScheme); private {
+		return key, true
+	}
+
+	return strings.TrimPrefix(url, s.ResourceBaseUrl+"/"), false
+}
+
+// Generates a time limited url to a private object, public urls are returned as they are
+func (s *ImageStore) PresignedUrl(ctx context.Context, url string) (string, error) {
+	key, private := s.locate(url)
+	if private == false {
+		return url, nil
+	}
+
+	bucket, err := s.bucket(true)
+	if err != nil {
+		return "", err
+	}
+
+	request, err := s.presigner.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: bucket,
+		Key:    &key,
+	}, s3.WithPresignExpires(appConfig.Storage.PrivateURLLifetime))
+	if err != nil {
+		return "", err
+	}
+
+	return request.URL, nil
+}
+
 func (img *Image) GetFilename() string {
 	exts, err := mime.ExtensionsByType(img.MimeType)
 	if err != nil {
@@ -177,31 +430,46 @@ func (img *Image) GetFilenameWithPostfix(namePostfix string) string {
 	return img.Name + "-" + namePostfix + exts[0]
 }
 
-func (s *ImageStore) getAllImageNames(imgName string) ([]string, error) {
-	out, err := s.store.ListObjectsV2(context.TODO(), &s3.ListObjectsV2Input{
-		Bucket: &s.bucketName,
-		Prefix: &imgName,
-	})
-
+func (s *ImageStore) getAllImageNames(ctx context.Context, imgName string, private bool) ([]string, error) {
+	objects, err := s.listObjects(ctx, imgName, private)
 	if err != nil {
 		return []string{}, err
 	}
 
-	names := make([]string, 0, len(out.Contents))
-	for i := range out.Contents {
-		names = append(names, *out.Contents[i].Key)
+	names := make([]string, 0, len(objects))
+	for i := range objects {
+		names = append(names, *objects[i].Key)
 	}
 
 	return names, nil
 }
 
-func (img *Image) saveToDisk() error {
-	err := os.WriteFile(img.GetFilename(), img.Data, 0600)
+// Lists every object under the prefix, following continuation tokens past the 1000 keys returned per page
+func (s *ImageStore) listObjects(ctx context.Context, prefix string, private bool) (objects []types.Object, err error) {
+	ctx, span := startStorageSpan(ctx, "list", prefix, private)
+	defer func() { endSpan(span, err) }()
+
+	bucket, err := s.bucket(private)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	paginator := s3.NewListObjectsV2Paginator(s.store, &s3.ListObjectsV2Input{
+		Bucket: bucket,
+		Prefix: &prefix,
+	})
+
+	objects = make([]types.Object, 0)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		objects = append(objects, page.Contents...)
+	}
+
+	return objects, nil
 }
 
 func (img *Image) removeInstances(heights ImageHeights) error {
@@ -225,57 +493,66 @@ func (img *Image) removeInstances(heights ImageHeights) error {
 }
 
 // Attempt to losslessly convert an image to webp
-func (img *Image) convert(newMimeType string) ([]byte, error) {
+// Returns the filename of the converted image
+func (img *Image) convert(newMimeType string) (string, error) {
 	extensions, err := mime.ExtensionsByType(newMimeType)
-	if err != nil {
-		return []byte{}, errors.New("Mime type should be a legal mime type")
+	if err != nil || len(extensions) == 0 {
+		return "", errors.New("Mime type should be a legal mime type")
 	}
 
 	f, err := os.OpenFile(img.GetFilename(), os.O_RDONLY, 0600)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 	f.Close()
 
-	cmd := exec.Command("ffmpeg", "-i", img.GetFilename(), "-c:v", "libwebp", "-lossless", "1", img.Name+extensions[0])
+	convertedName := img.Name + extensions[0]
+	cmd := exec.Command("ffmpeg", "-i", img.GetFilename(), "-map_metadata", "-1", "-c:v", "libwebp", "-lossless", "1", convertedName)
 	err = cmd.Run()
 	if err != nil {
-		return nil, err
-	}
-
-	converted, err := os.ReadFile(img.Name+extensions[0])
-	if err != nil {
-		return nil, err
+		return "", err
 	}
 
 	img.removeInstances(img.AvailableHeights)
 
-	return converted, nil
-	
-
+	return convertedName, nil
 }
 
-func (img *Image) downscale(height Height) ([]byte, error) {
+// Returns the filename of the downscaled image
+func (img *Image) downscale(height Height) (string, error) {
 	if height == 0 {
-		return nil, errors.New("Height cannot be zero")
+		return "", errors.New("Height cannot be zero")
 	}
 
 	f, err := os.OpenFile(img.GetFilename(), os.O_RDONLY, 0600)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 	f.Close()
 
-	cmd := exec.Command("ffmpeg", "-i", img.GetFilename(), "-vf", fmt.Sprintf("scale=%d:-1", height), img.GetFilenameWithPostfix(strconv.Itoa(int(height))))
+	downscaledName := img.GetFilenameWithPostfix(strconv.Itoa(int(height)))
+	cmd := exec.Command("ffmpeg", "-i", img.GetFilename(), "-vf", fmt.Sprintf("scale=%d:-1", height), "-map_metadata", "-1", downscaledName)
 	err = cmd.Run()
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	thumbnail, err := os.ReadFile(img.GetFilenameWithPostfix(strconv.Itoa(int(height))))
+	return downscaledName, nil
+}
+
+var allowedImageMimeTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// Detects the mime type of a file from its first bytes, ignoring any parameters like the charset
+func sniffMimeType(header []byte) string {
+	mimeType, _, err := mime.ParseMediaType(http.DetectContentType(header))
 	if err != nil {
-		return nil, err
+		return "application/octet-stream"
 	}
 
-	return thumbnail, nil
+	return mimeType
 }
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const requestIdHeader = "X-Request-Id"
+
+// Incoming request ids are kept only when they can't break the log lines or headers they're copied into
+var requestIdPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// Attributes with these keys (case insensitive) never reach the logs, wherever they're logged from
+var sensitiveLogKeys = map[string]bool{
+	"authorization": true,
+	"cookie":        true,
+	"set-cookie":    true,
+	"pass":          true,
+	"password":      true,
+	"loginhash":     true,
+	"token":         true,
+	"secret":        true,
+}
+
+type requestIdKey struct{}
+
+// Replaces the default logger, the standard log package writes through it as well
+func initializeLogger(config LoggingConfig, output io.Writer) {
+	options := &slog.HandlerOptions{
+		Level:       parseLogLevel(config.Level),
+		ReplaceAttr: redactLogAttr,
+	}
+
+	var handler slog.Handler
+	if config.Format == "text" {
+		handler = slog.NewTextHandler(output, options)
+	} else {
+		handler = slog.NewJSONHandler(output, options)
+	}
+
+	slog.SetDefault(slog.New(&requestContextHandler{handler}))
+}
+
+func parseLogLevel(level string) slog.Level {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+func redactLogAttr(groups []string, attr slog.Attr) slog.Attr {
+	if sensitiveLogKeys[strings.ToLower(attr.Key)] {
+		return slog.String(attr.Key, redactedConfigValue)
+	}
+
+	return attr
+}
+
+// Adds the request and trace ids of the context to every record logged with it
+type requestContextHandler struct {
+	slog.Handler
+}
+
+func (h *requestContextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if requestId := requestIdFromContext(ctx); requestId != "" {
+		record.AddAttrs(slog.String("requestId", requestId))
+	}
+
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		record.AddAttrs(slog.String("traceId", span.TraceID().String()), slog.String("spanId", span.SpanID().String()))
+	}
+
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *requestContextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &requestContextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h *requestContextHandler) WithGroup(name string) slog.Handler {
+	return &requestContextHandler{h.Handler.WithGroup(name)}
+}
+
+func requestIdFromContext(ctx context.Context) string {
+	requestId, _ := ctx.Value(requestIdKey{}).(string)
+	return requestId
+}
+
+// Gives every request an id, reusing the one set by a proxy when it's valid, and returns it in the X-Request-Id header
+func withRequestId(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestId := r.Header.Get(requestIdHeader)
+		if requestIdPattern.MatchString(requestId) == false {
+			requestId = rand.Text()
+		}
+
+		w.Header().Set(requestIdHeader, requestId)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIdKey{}, requestId)))
+	})
+}
+
+// Records the status and size of the response for the access log and metrics
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	written, err := w.ResponseWriter.Write(data)
+	w.bytes += int64(written)
+	return written, err
+}
+
+// Handlers that never write respond with 200
+func (w *statusWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+
+	return w.status
+}
+
+// Lets http.ResponseController reach the flusher and deadlines of the connection
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Logs a line per request once it's done. Query strings aren't logged as they can identify visitors,
+// headers are only logged at the debug level with the credentials redacted.
+func withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		writer := &statusWriter{ResponseWriter: w}
+
+		next.ServeHTTP(writer, r)
+
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", writer.Status()),
+			slog.Float64("latencyMs", float64(time.Since(start).Microseconds())/1000),
+			slog.Int64("bytes", writer.bytes),
+		}
+
+		ctx := r.Context()
+		if slog.Default().Enabled(ctx, slog.LevelDebug) {
+			headers := make([]any, 0, len(r.Header))
+			for name := range r.Header {
+				headers = append(headers, slog.String(name, r.Header.Get(name)))
+			}
+			attrs = append(attrs, slog.Group("headers", headers...))
+		}
+
+		slog.LogAttrs(ctx, slog.LevelInfo, "Request", attrs...)
+	})
+}
@@ -2,42 +2,158 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
-
-	"github.com/joho/godotenv"
-)
-
-const (
-	ADDRESS  string = ":9000"
-	DATABASE string = "database.db"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	if err := godotenv.Load(); err != nil {
-		log.Fatalln("No .env file found.")
+	args := os.Args[1:]
+	if len(args) >= 2 && args[0] == "config" && args[1] == "print" {
+		err := printConfig(args[2:], os.Stdout)
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+		return
+	}
+
+	config, err := loadConfig(args, os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	appConfig = config
+	initializeLogger(config.Logging, os.Stderr)
+
+	err = run(config)
+	if err != nil {
+		log.Fatalln(err.Error())
 	}
+}
 
+// Runs the server until it fails or receives SIGINT or SIGTERM.
+// Shutting down drains the in-flight requests, then stops the background jobs and disconnects from the database.
+func run(config *Config) error {
 	mux := http.NewServeMux()
 
-	db, err := initializeDB()
+	// Set up first so it's flushed last, after the spans of the shutdown itself
+	shutdownTracing, err := initializeTracing(config.Tracing)
+	if err != nil {
+		return errors.New(fmt.Sprintf("There was an error while configuring tracing: %v", err))
+	}
+	defer shutdownTracing(context.Background())
+
+	db, err := initializeDB(config.Database)
 	if err != nil {
-		log.Fatalln("There was an error while opening the database:", err.Error())
+		return errors.New(fmt.Sprintf("There was an error while opening the database: %v", err))
 	}
+	defer disconnectDB(db)
 
-	imageStore, err := initializeImageStore()
+	err = runMigrations(context.Background(), db)
 	if err != nil {
-		log.Fatalln("There was an error while connecting to s3:", err.Error())
+		return errors.New(fmt.Sprintf("There was an error while migrating the database: %v", err))
 	}
 
-	defer db.Disconnect(context.TODO())
-	addRoutes(mux, db, imageStore)
+	imageStore, err := initializeImageStore(config.Storage)
+	if err != nil {
+		return errors.New(fmt.Sprintf("There was an error while connecting to s3: %v", err))
+	}
 
-	log.Println("Listening on:", ADDRESS)
-	log.Println("Database:", os.Getenv("MONGODB_URI"))
-	err = http.ListenAndServe(ADDRESS, mux)
+	geo, err := initializeGeoProvider(config.GeoIP)
 	if err != nil {
-		log.Fatalln("There was an error while serving:", err.Error())
+		return errors.New(fmt.Sprintf("There was an error while loading the GeoIP provider: %v", err))
 	}
+	defer geo.Close()
+
+	notifier, err := initializeNotifier(config.Reports)
+	if err != nil {
+		return errors.New(fmt.Sprintf("There was an error while configuring the report notifier: %v", err))
+	}
+
+	limiter, err := initializeRateLimiter(config.RateLimit, db)
+	if err != nil {
+		return errors.New(fmt.Sprintf("There was an error while configuring rate limiting: %v", err))
+	}
+
+	bots := newBotDetector(config.Analytics.BotPatternsFile)
+	broker := newAnalyticsBroker()
+	health := newHealthChecker(config.Health, mongoHealthCheck(db), storageHealthCheck(imageStore), ffmpegHealthCheck())
+	addRoutes(mux, db, imageStore, geo, bots, broker, notifier, health, limiter)
+
+	jobs := append(analyticsJobs(), bots.Job())
+	if notifier != nil {
+		jobs = append(jobs, weeklyReportJob(notifier))
+	}
+
+	server := &http.Server{
+		Addr:              config.Server.Address,
+		Handler:           withRequestId(withAccessLog(withCORS(config.CORS, withMetrics(withTracing(withRoutePrefix("", mux)))))),
+		ReadHeaderTimeout: config.Server.ReadHeaderTimeout,
+		ReadTimeout:       config.Server.ReadTimeout,
+		WriteTimeout:      config.Server.WriteTimeout,
+		IdleTimeout:       config.Server.IdleTimeout,
+	}
+
+	// Live streams never end on their own, so they're closed before waiting on the requests
+	server.RegisterOnShutdown(broker.Close)
+
+	useTLS := config.Server.TLSCertFile != ""
+	if useTLS {
+		certificates, err := newCertificateReloader(config.Server.TLSCertFile, config.Server.TLSKeyFile)
+		if err != nil {
+			return err
+		}
+
+		server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: certificates.GetCertificate}
+		jobs = append(jobs, certificates.Job())
+	}
+
+	scheduler := newScheduler(db, jobs...)
+	scheduler.Start()
+	defer scheduler.Stop()
+
+	signals, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+
+	served := make(chan error, 1)
+	go func() {
+		slog.Info("Listening", "address", config.Server.Address, "tls", useTLS, "database", config.Database.Name)
+		if useTLS {
+			// The certificate comes from the TLS config
+			served <- server.ListenAndServeTLS("", "")
+		} else {
+			served <- server.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err := <-served:
+		return errors.New(fmt.Sprintf("There was an error while serving: %v", err))
+	case <-signals.Done():
+	}
+
+	// A second signal kills the server without waiting
+	stopSignals()
+	slog.Info("Shutting down, waiting for requests to finish", "timeout", config.Server.ShutdownTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.Server.ShutdownTimeout)
+	defer cancel()
+
+	err = server.Shutdown(ctx)
+	if err != nil {
+		slog.Warn("Requests were cut off while shutting down", "error", err)
+		server.Close()
+	}
+
+	return nil
 }
@@ -0,0 +1,827 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+const (
+	defaultUploadMaxSize          = 20 << 20
+	defaultUploadMaxChunkSize     = 5 << 20
+	defaultUploadMaxResumableSize = 100 << 20
+	uploadSessionLifetime         = 24 * time.Hour
+	uploadFormFileField           = "file"
+	mimeSniffLength               = 512
+)
+
+// Size limits (in bytes) applied to every upload
+type UploadLimits struct {
+	// Maximum size of a single multipart or raw upload
+	MaxSize int64 `yaml:"maxSize" env:"UPLOAD_MAX_SIZE"`
+	// Maximum size of a single chunk of a resumable upload
+	MaxChunkSize int64 `yaml:"maxChunkSize" env:"UPLOAD_MAX_CHUNK_SIZE"`
+	// Maximum total size of a resumable upload
+	MaxResumableSize int64 `yaml:"maxResumableSize" env:"UPLOAD_MAX_RESUMABLE_SIZE"`
+}
+
+func handleMediaRoutes(db *mongo.Client, imageStore *ImageStore) *http.ServeMux {
+	mux := http.NewServeMux()
+	limits := appConfig.Uploads
+	sessions := NewUploadSessions()
+
+	mux.HandleFunc("POST /upload", ensureLoggedIn(uploadMedia(db, imageStore, limits)))
+	mux.HandleFunc("POST /upload/sessions", ensureLoggedIn(createUploadSession(db, sessions, limits)))
+	mux.HandleFunc("GET /upload/sessions/{id}", ensureAuthenticated(getUploadSession(sessions)))
+	mux.HandleFunc("PUT /upload/sessions/{id}", ensureLoggedIn(uploadChunk(db, sessions, imageStore, limits)))
+	mux.HandleFunc("DELETE /upload/sessions/{id}", ensureLoggedIn(deleteUploadSession(sessions)))
+	mux.HandleFunc("POST /gc", ensureLoggedIn(collectOrphanedImages(db, imageStore)))
+	mux.HandleFunc("GET /{name}", getMediaMetadata(db, imageStore))
+	mux.HandleFunc("GET /{name}/download", downloadMedia(db, imageStore))
+	mux.HandleFunc("PUT /{name}/focal-point", ensureLoggedIn(setFocalPoint(db, imageStore)))
+
+	return mux
+}
+
+// Accepts either a multipart/form-data body with the media in the "file" field or the raw media as the body.
+// The media is streamed to the image store, its type is sniffed from the content and never from the request headers.
+//
+// Images are accepted by default, the collection and attribute query parameters apply the rules of that attribute instead.
+func uploadMedia(db *mongo.Client, imageStore *ImageStore, limits UploadLimits) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		rule, err := getUploadRule(r.Context(), db, query.Get("collection"), query.Get("attribute"))
+		if err != nil {
+			WriteError(w, r, toAPIError(err, "Error while getting the upload rule"))
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, rule.Limit(limits.MaxSize))
+
+		var body io.Reader = r.Body
+		filename := query.Get("filename")
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mediaType == "multipart/form-data" {
+			part, err := findMultipartFile(r)
+			if err != nil {
+				WriteError(w, r, &APIError{Code: ErrorCodeInvalidBody, Message: "Couldn't read the multipart body", Cause: err})
+				return
+			}
+			defer part.Close()
+
+			body = part
+			if part.FileName() != "" {
+				filename = part.FileName()
+			}
+		}
+
+		bufferedBody := bufio.NewReaderSize(body, mimeSniffLength)
+		header, err := bufferedBody.Peek(mimeSniffLength)
+		if err != nil && err != io.EOF {
+			writeUploadError(w, r, err)
+			return
+		}
+
+		if len(header) == 0 {
+			WriteError(w, r, newAPIError(ErrorCodeInvalidBody, "No body was provided"))
+			return
+		}
+
+		mimeType := sniffMimeType(header)
+		if rule.Allows(mimeType) == false {
+			WriteError(w, r, unsupportedMediaType(mimeType))
+			return
+		}
+
+		media, err := storeUpload(r.Context(), db, imageStore, rule, bufferedBody, mimeType, filename)
+		if err != nil {
+			writeUploadError(w, r, err)
+			return
+		}
+
+		WriteJSON(w, http.StatusOK, ResponseMessage{
+			Status:  StatusCodeOk,
+			Message: "Uploaded media successfully",
+			Data:    media,
+		})
+	}
+}
+
+func createUploadSession(db *mongo.Client, sessions *UploadSessions, limits UploadLimits) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, _, err := ReadBodyJSON[NewUploadSession](r, db)
+		if err != nil {
+			WriteError(w, r, toAPIError(err, "Error while validating the upload session"))
+			return
+		}
+
+		rule, err := getUploadRule(r.Context(), db, body.Collection, body.Attribute)
+		if err != nil {
+			WriteError(w, r, toAPIError(err, "Error while getting the upload rule"))
+			return
+		}
+
+		maxSize := rule.Limit(limits.MaxResumableSize)
+		if body.Size > maxSize {
+			WriteError(w, r, newAPIError(ErrorCodePayloadTooLarge, fmt.Sprintf("Uploads cannot be larger than %v bytes", maxSize)))
+			return
+		}
+
+		session, err := sessions.Create(body.Size, body.Filename, rule)
+		if err != nil {
+			WriteError(w, r, toAPIError(err, "Error while creating upload session"))
+			return
+		}
+
+		WriteJSON(w, http.StatusCreated, ResponseMessage{
+			Status:  StatusCodeOk,
+			Message: "Created upload session",
+			Data:    session.Status(limits),
+		})
+	}
+}
+
+// Lets clients find the offset they should resume uploading from
+func getUploadSession(sessions *UploadSessions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, exists := sessions.Get(r.PathValue("id"))
+		if exists == false {
+			WriteError(w, r, errUploadSessionNotFound)
+			return
+		}
+
+		session.mu.Lock()
+		status := session.Status(UploadLimits{})
+		session.mu.Unlock()
+
+		WriteJSON(w, http.StatusOK, ResponseMessage{Status: StatusCodeOk, Data: status})
+	}
+}
+
+// Appends a chunk described by the Content-Range header (bytes start-end/total) to an upload session.
+// The upload is stored once the final chunk is received.
+func uploadChunk(db *mongo.Client, sessions *UploadSessions, imageStore *ImageStore, limits UploadLimits) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, exists := sessions.Get(r.PathValue("id"))
+		if exists == false {
+			WriteError(w, r, errUploadSessionNotFound)
+			return
+		}
+
+		start, end, total, err := parseContentRange(r.Header.Get("Content-Range"))
+		if err != nil {
+			WriteError(w, r, newAPIError(ErrorCodeInvalidBody, err.Error()))
+			return
+		}
+
+		if end-start+1 > limits.MaxChunkSize {
+			WriteError(w, r, newAPIError(ErrorCodePayloadTooLarge, fmt.Sprintf("Chunks cannot be larger than %v bytes", limits.MaxChunkSize)))
+			return
+		}
+
+		session.mu.Lock()
+		defer session.mu.Unlock()
+
+		if total != session.Size {
+			WriteError(w, r, newAPIError(ErrorCodeInvalidBody, fmt.Sprintf("Content-Range total must match the session size (%v)", session.Size)))
+			return
+		}
+
+		if start != session.Offset {
+			WriteError(w, r, newAPIError(ErrorCodeUploadOffsetMismatch, fmt.Sprintf("Chunk must start at offset %v", session.Offset)))
+			return
+		}
+
+		written, err := session.Append(http.MaxBytesReader(w, r.Body, end-start+1))
+		if err != nil {
+			writeUploadError(w, r, err)
+			return
+		}
+
+		if written != end-start+1 {
+			WriteError(w, r, newAPIError(ErrorCodeInvalidBody, fmt.Sprintf("Expected %v bytes but received %v", end-start+1, written)))
+			return
+		}
+
+		if session.Offset < session.Size {
+			WriteJSON(w, http.StatusOK, ResponseMessage{
+				Status:  StatusCodeOk,
+				Message: "Received chunk",
+				Data:    session.Status(limits),
+			})
+			return
+		}
+
+		defer sessions.Remove(session.Id)
+
+		media, err := session.Store(r.Context(), db, imageStore)
+		if err != nil {
+			WriteError(w, r, toAPIError(err, "Error while storing chunked upload"))
+			return
+		}
+
+		WriteJSON(w, http.StatusOK, ResponseMessage{
+			Status:  StatusCodeOk,
+			Message: "Uploaded media successfully",
+			Data:    media,
+		})
+	}
+}
+
+func deleteUploadSession(sessions *UploadSessions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if _, exists := sessions.Get(id); exists == false {
+			WriteError(w, r, errUploadSessionNotFound)
+			return
+		}
+
+		sessions.Remove(id)
+		WriteJSON(w, http.StatusOK, ResponseMessage{Status: StatusCodeOk, Message: "Cancelled upload session"})
+	}
+}
+
+type UploadedMedia struct {
+	Url      string `json:"url"`
+	MimeType string `json:"mimeType"`
+	Size     int64  `json:"size"`
+	// Either *ImageMetadata or *FileMetadata depending on the upload rule
+	Metadata any `json:"metadata"`
+}
+
+// Describes what an upload may contain, derived from the attribute it's uploaded for
+type UploadRule struct {
+	Kind      CollectionAttrType
+	MimeTypes map[string]bool
+	// Zero when only the server limits apply
+	MaxSize int64
+	// Private uploads are kept out of the public bucket
+	Private bool
+}
+
+var imageUploadRule = UploadRule{Kind: CollectionAttrTypeImage, MimeTypes: allowedImageMimeTypes}
+
+func (u UploadRule) Allows(mimeType string) bool {
+	_, allowed := u.MimeTypes[mimeType]
+	return allowed
+}
+
+// The attribute's size limit can only tighten the server's limit
+func (u UploadRule) Limit(serverLimit int64) int64 {
+	if u.MaxSize > 0 && u.MaxSize < serverLimit {
+		return u.MaxSize
+	}
+
+	return serverLimit
+}
+
+func getUploadRule(ctx context.Context, db *mongo.Client, collectionPath string, attributeName string) (UploadRule, error) {
+	if collectionPath == "" && attributeName == "" {
+		return imageUploadRule, nil
+	}
+
+	attributes, err := getCollectionAttributes(ctx, db, collectionPath)
+	if errors.As(err, new(*DBNotFoundError)) {
+		return UploadRule{}, collectionNotFound(collectionPath)
+	}
+
+	if err != nil {
+		return UploadRule{}, err
+	}
+
+	for _, attribute := range attributes {
+		if attribute.Name != attributeName {
+			continue
+		}
+
+		rule, accepted := uploadRuleOf(attribute)
+		if accepted == false {
+			return UploadRule{}, validationError(ErrorCodeInvalidQuery, "The upload query isn't valid", Misses{"attribute": fmt.Sprintf("Attribute %q doesn't accept uploads", attributeName)})
+		}
+
+		return rule, nil
+	}
+
+	return UploadRule{}, validationError(ErrorCodeInvalidQuery, "The upload query isn't valid", Misses{"attribute": fmt.Sprintf("Couldn't find attribute %q in collection (%v)", attributeName, collectionPath)})
+}
+
+// The rule uploads for the attribute must follow, only image and file attributes accept uploads
+func uploadRuleOf(attribute CollectionAttribute) (UploadRule, bool) {
+	switch attribute.Type {
+	case CollectionAttrTypeImage:
+		rule := imageUploadRule
+		rule.Private = attribute.Private
+		return rule, true
+	case CollectionAttrTypeFile:
+		rule := UploadRule{Kind: CollectionAttrTypeFile, MimeTypes: defaultFileMimeTypes, MaxSize: attribute.MaxSize, Private: attribute.Private}
+		if len(attribute.MimeTypes) > 0 {
+			rule.MimeTypes = make(map[string]bool)
+			for _, mimeType := range attribute.MimeTypes {
+				rule.MimeTypes[mimeType] = true
+			}
+		}
+
+		return rule, true
+	default:
+		return UploadRule{}, false
+	}
+}
+
+// Checks the uploaded media a url refers to against the rule, so entries can't reference media
+// that was uploaded for another attribute. Returns the reason it breaks the rule, if any.
+func checkUploadedMedia(ctx context.Context, db *mongo.Client, rule UploadRule, url string) (string, error) {
+	results, err := getDBResource(ctx, db.Database(CMS_DATABASE), CMS_C_MEDIA, bson.M{"url": url})
+	if err != nil {
+		return "", err
+	}
+
+	if len(results) == 0 {
+		return "Must be the url of an uploaded file", nil
+	}
+
+	media := results[0]
+	if kind, _ := media["kind"].(string); kind != string(rule.Kind) {
+		return fmt.Sprintf("Must be an uploaded %v", rule.Kind), nil
+	}
+
+	mimeType, _ := media["mimeType"].(string)
+	if rule.Allows(mimeType) == false {
+		return fmt.Sprintf("Doesn't accept media of type %q", mimeType), nil
+	}
+
+	var size int64
+	switch typed := media["size"].(type) {
+	case int32:
+		size = int64(typed)
+	case int64:
+		size = typed
+	case float64:
+		size = int64(typed)
+	}
+
+	if rule.MaxSize > 0 && size > rule.MaxSize {
+		return fmt.Sprintf("Must be at most %v bytes", rule.MaxSize), nil
+	}
+
+	return "", nil
+}
+
+// Stores the upload according to its rule and saves its metadata
+func storeUpload(ctx context.Context, db *mongo.Client, imageStore *ImageStore, rule UploadRule, reader io.Reader, mimeType string, filename string) (*UploadedMedia, error) {
+	counter := &countingReader{reader: reader}
+
+	if rule.Kind == CollectionAttrTypeFile {
+		file, err := imageStore.StoreFile(ctx, counter, mimeType, filename, rule.Private)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = createDBResource(ctx, db.Database(CMS_DATABASE), CMS_C_MEDIA, file.ToMap())
+		if err != nil {
+			slog.ErrorContext(ctx, "Error while saving file metadata", "error", err)
+		}
+
+		return &UploadedMedia{Url: file.Url, MimeType: mimeType, Size: counter.count, Metadata: file}, nil
+	}
+
+	img, err := imageStore.StoreFromReader(ctx, counter, mimeType, rule.Private)
+	if err != nil {
+		return nil, err
+	}
+
+	err = saveImageMetadata(ctx, db, img.Metadata)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error while saving image metadata", "error", err)
+	}
+
+	return &UploadedMedia{Url: img.Metadata.Url, MimeType: mimeType, Size: counter.count, Metadata: img.Metadata}, nil
+}
+
+// Streams stored media back with a Content-Disposition that keeps the original filename.
+// Add inline=true to let browsers display it instead of downloading it.
+// Private media can only be downloaded by authenticated callers.
+func downloadMedia(db *mongo.Client, imageStore *ImageStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		results, err := getDBResource(r.Context(), db.Database(CMS_DATABASE), CMS_C_MEDIA, bson.M{"name": name})
+		if err != nil {
+			WriteError(w, r, toAPIError(err, "Error while getting media metadata"))
+			return
+		}
+
+		if len(results) == 0 {
+			WriteError(w, r, mediaNotFound(name))
+			return
+		}
+
+		url, _ := results[0]["url"].(string)
+		filename, _ := results[0]["filename"].(string)
+		key, private := imageStore.locate(url)
+		if filename == "" {
+			filename = key
+		}
+
+		if private && isAuthenticated(r) == false {
+			WriteError(w, r, errNotAuthorized)
+			return
+		}
+
+		object, err := imageStore.Open(r.Context(), url)
+		if err != nil {
+			WriteError(w, r, &APIError{Code: ErrorCodeStorageUnavailable, Message: fmt.Sprintf("Error while downloading media (%v)", name), Cause: err})
+			return
+		}
+		defer object.Body.Close()
+
+		dispositionType := "attachment"
+		if r.URL.Query().Get("inline") == "true" {
+			dispositionType = "inline"
+		}
+
+		mimeType, _ := results[0]["mimeType"].(string)
+		w.Header().Set("Content-Type", mimeType)
+		w.Header().Set("Content-Disposition", contentDisposition(dispositionType, filename))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if object.ContentLength != nil {
+			w.Header().Set("Content-Length", strconv.FormatInt(*object.ContentLength, 10))
+		}
+
+		w.WriteHeader(http.StatusOK)
+		_, err = io.Copy(w, object.Body)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error while streaming media", "name", name, "error", err)
+		}
+	}
+}
+
+// Private media is only described to authenticated callers, its metadata reveals the private key
+func getMediaMetadata(db *mongo.Client, imageStore *ImageStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		results, err := getDBResource(r.Context(), db.Database(CMS_DATABASE), CMS_C_MEDIA, bson.M{"name": name})
+		if err != nil {
+			WriteError(w, r, toAPIError(err, "Error while getting media metadata"))
+			return
+		}
+
+		if len(results) == 0 {
+			WriteError(w, r, mediaNotFound(name))
+			return
+		}
+
+		url, _ := results[0]["url"].(string)
+		if _, private := imageStore.locate(url); private && isAuthenticated(r) == false {
+			WriteError(w, r, errNotAuthorized)
+			return
+		}
+
+		WriteJSON(w, http.StatusOK, ResponseMessage{Status: StatusCodeOk, Data: results[0]})
+	}
+}
+
+// Moves the focal point of an image and regenerates its crops around it
+func setFocalPoint(db *mongo.Client, imageStore *ImageStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cmsDatabase := db.Database(CMS_DATABASE)
+		name := r.PathValue("name")
+
+		focalPoint, _, err := ReadBodyJSON[FocalPointBody](r, db)
+		if err != nil {
+			WriteError(w, r, toAPIError(err, "Error while validating the focal point"))
+			return
+		}
+
+		results, err := getDBResource(r.Context(), cmsDatabase, CMS_C_MEDIA, bson.M{"name": name})
+		if err != nil {
+			WriteError(w, r, toAPIError(err, "Error while getting media metadata"))
+			return
+		}
+
+		if len(results) == 0 {
+			WriteError(w, r, mediaNotFound(name))
+			return
+		}
+
+		metadata := imageMetadataFromMap(results[0])
+		err = imageStore.Recrop(r.Context(), metadata, FocalPoint(focalPoint))
+		if err != nil {
+			WriteError(w, r, toAPIError(err, fmt.Sprintf("Error while cropping media (%v)", name)))
+			return
+		}
+
+		updated, err := updateDBResource(r.Context(), cmsDatabase, CMS_C_MEDIA, bson.M{"name": name}, bson.M{"$set": bson.M{"focalPoint": metadata.FocalPoint.ToMap()}})
+		if err != nil {
+			WriteError(w, r, toAPIError(err, fmt.Sprintf("Error while updating media (%v)", name)))
+			return
+		}
+
+		WriteJSON(w, http.StatusOK, ResponseMessage{Status: StatusCodeOk, Message: "Updated focal point", Data: updated})
+	}
+}
+
+type FocalPointBody FocalPoint
+
+func (f FocalPointBody) Validate(r *http.Request, db *mongo.Client) (Misses, error) {
+	return FocalPoint(f).Validate(), nil
+}
+
+func saveImageMetadata(ctx context.Context, db *mongo.Client, metadata *ImageMetadata) error {
+	if metadata == nil {
+		return errors.New("No metadata was extracted")
+	}
+
+	_, err := createDBResource(ctx, db.Database(CMS_DATABASE), CMS_C_MEDIA, metadata.ToMap())
+	return err
+}
+
+func imageMetadataFromMap(record map[string]any) *ImageMetadata {
+	metadata := &ImageMetadata{FocalPoint: defaultFocalPoint}
+	metadata.Name, _ = record["name"].(string)
+	metadata.Url, _ = record["url"].(string)
+	metadata.MimeType, _ = record["mimeType"].(string)
+	metadata.DominantColor, _ = record["dominantColor"].(string)
+	metadata.Placeholder, _ = record["placeholder"].(string)
+
+	width, _ := record["width"].(int32)
+	height, _ := record["height"].(int32)
+	metadata.Width = int(width)
+	metadata.Height = int(height)
+
+	if focalPoint, ok := record["focalPoint"].(bson.D); ok {
+		for _, element := range focalPoint {
+			value, _ := element.Value.(float64)
+			switch element.Key {
+			case "x":
+				metadata.FocalPoint.X = value
+			case "y":
+				metadata.FocalPoint.Y = value
+			}
+		}
+	}
+
+	return metadata
+}
+
+type NewUploadSession struct {
+	Size     int64  `json:"size"`
+	Filename string `json:"filename"`
+	// Optional, see getUploadRule
+	Collection string `json:"collection"`
+	Attribute  string `json:"attribute"`
+}
+
+func (n NewUploadSession) Validate(r *http.Request, db *mongo.Client) (Misses, error) {
+	misses := make(Misses, 0)
+
+	if n.Size <= 0 {
+		misses["size"] = "Must be a positive number of bytes"
+	}
+
+	return misses, nil
+}
+
+// Tracks resumable uploads in memory while their chunks are written to a temporary file.
+// Sessions don't survive a restart but a client can resume after any network failure.
+type UploadSessions struct {
+	mu       sync.Mutex
+	sessions map[string]*UploadSession
+}
+
+type UploadSession struct {
+	mu        sync.Mutex
+	Id        string
+	Size      int64
+	Offset    int64
+	ExpiresAt time.Time
+	Filename  string
+	Rule      UploadRule
+	path      string
+}
+
+type UploadSessionStatus struct {
+	Id           string    `json:"id"`
+	Size         int64     `json:"size"`
+	Offset       int64     `json:"offset"`
+	MaxChunkSize int64     `json:"maxChunkSize,omitempty"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+}
+
+func NewUploadSessions() *UploadSessions {
+	return &UploadSessions{sessions: make(map[string]*UploadSession)}
+}
+
+func (s *UploadSessions) Create(size int64, filename string, rule UploadRule) (*UploadSession, error) {
+	s.removeExpired()
+
+	id := rand.Text()
+	path := filepath.Join(os.TempDir(), "upload-"+id)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	session := &UploadSession{
+		Id:        id,
+		Size:      size,
+		ExpiresAt: time.Now().Add(uploadSessionLifetime),
+		Filename:  filename,
+		Rule:      rule,
+		path:      path,
+	}
+
+	s.mu.Lock()
+	s.sessions[id] = session
+	s.mu.Unlock()
+
+	return session, nil
+}
+
+func (s *UploadSessions) Get(id string) (*UploadSession, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, exists := s.sessions[id]
+	if exists == false || time.Now().After(session.ExpiresAt) {
+		return nil, false
+	}
+
+	return session, true
+}
+
+func (s *UploadSessions) Remove(id string) {
+	s.mu.Lock()
+	session, exists := s.sessions[id]
+	delete(s.sessions, id)
+	s.mu.Unlock()
+
+	if exists {
+		os.Remove(session.path)
+	}
+}
+
+func (s *UploadSessions) removeExpired() {
+	s.mu.Lock()
+	expired := make([]string, 0)
+	for id, session := range s.sessions {
+		if time.Now().After(session.ExpiresAt) {
+			expired = append(expired, id)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, id := range expired {
+		s.Remove(id)
+	}
+}
+
+// Status and Append must be called while holding the session lock
+func (s *UploadSession) Status(limits UploadLimits) UploadSessionStatus {
+	return UploadSessionStatus{
+		Id:           s.Id,
+		Size:         s.Size,
+		Offset:       s.Offset,
+		MaxChunkSize: limits.MaxChunkSize,
+		ExpiresAt:    s.ExpiresAt,
+	}
+}
+
+func (s *UploadSession) Append(chunk io.Reader) (int64, error) {
+	f, err := os.OpenFile(s.path, os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	_, err = f.Seek(s.Offset, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+
+	written, err := io.Copy(f, io.LimitReader(chunk, s.Size-s.Offset))
+	s.Offset += written
+
+	return written, err
+}
+
+// Sniffs the type of the completed upload and stores it according to the session's rule
+func (s *UploadSession) Store(ctx context.Context, db *mongo.Client, imageStore *ImageStore) (*UploadedMedia, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	bufferedFile := bufio.NewReaderSize(f, mimeSniffLength)
+	header, err := bufferedFile.Peek(mimeSniffLength)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	mimeType := sniffMimeType(header)
+	if s.Rule.Allows(mimeType) == false {
+		return nil, unsupportedMediaType(mimeType)
+	}
+
+	return storeUpload(ctx, db, imageStore, s.Rule, bufferedFile, mimeType, s.Filename)
+}
+
+func findMultipartFile(r *http.Request) (*multipart.Part, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, errors.New(fmt.Sprintf("No %q field was provided", uploadFormFileField))
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if part.FormName() == uploadFormFileField {
+			return part, nil
+		}
+
+		part.Close()
+	}
+}
+
+// Parses a Content-Range header of the form "bytes start-end/total"
+func parseContentRange(header string) (int64, int64, int64, error) {
+	invalid := errors.New("Content-Range must be of the form \"bytes start-end/total\"")
+
+	rangeSpec, found := strings.CutPrefix(header, "bytes ")
+	if found == false {
+		return 0, 0, 0, invalid
+	}
+
+	byteRange, totalString, found := strings.Cut(rangeSpec, "/")
+	if found == false {
+		return 0, 0, 0, invalid
+	}
+
+	startString, endString, found := strings.Cut(byteRange, "-")
+	if found == false {
+		return 0, 0, 0, invalid
+	}
+
+	start, errStart := strconv.ParseInt(startString, 10, 64)
+	end, errEnd := strconv.ParseInt(endString, 10, 64)
+	total, errTotal := strconv.ParseInt(totalString, 10, 64)
+	if errStart != nil || errEnd != nil || errTotal != nil || start < 0 || end < start || end >= total {
+		return 0, 0, 0, invalid
+	}
+
+	return start, end, total, nil
+}
+
+func writeUploadError(w http.ResponseWriter, r *http.Request, err error) {
+	var maxBytesError *http.MaxBytesError
+	if errors.As(err, &maxBytesError) {
+		WriteError(w, r, newAPIError(ErrorCodePayloadTooLarge, fmt.Sprintf("Upload cannot be larger than %v bytes", maxBytesError.Limit)))
+		return
+	}
+
+	WriteError(w, r, toAPIError(err, "Error while uploading media"))
+}
+
+var errUploadSessionNotFound = newAPIError(ErrorCodeResourceNotFound, "Upload session not found")
+
+func mediaNotFound(name string) *APIError {
+	return newAPIError(ErrorCodeResourceNotFound, fmt.Sprintf("Couldn't find media (%v)", name))
+}
+
+func unsupportedMediaType(mimeType string) *APIError {
+	return newAPIError(ErrorCodeUnsupportedMediaType, fmt.Sprintf("Unsupported media type %q", mimeType))
+}
+
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.count += int64(n)
+	return n, err
+}
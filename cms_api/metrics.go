@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// A registry of our own keeps the metrics of dependencies out unless they're registered here
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests by method, route pattern and status code.",
+	}, []string{"method", "route", "status"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Time spent serving HTTP requests by method and route pattern.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	httpRequestsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "http_requests_in_flight",
+		Help: "HTTP requests currently being served, including live analytics streams.",
+	})
+
+	dbOperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mongo_operation_duration_seconds",
+		Help:    "Time spent in MongoDB operations by operation and collection.",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 10, 60},
+	}, []string{"operation", "collection"})
+
+	imageProcessingDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "image_processing_duration_seconds",
+		Help:    "Time spent processing images by stage (process, upload or recrop).",
+		Buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"stage"})
+
+	rateLimitedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_rate_limited_requests_total",
+		Help: "Requests rejected by the rate limiter by route group.",
+	}, []string{"group"})
+
+	imageUploadedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "image_store_uploaded_bytes_total",
+		Help: "Bytes uploaded to the image store by bucket (public or private).",
+	}, []string{"bucket"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequestsTotal,
+		httpRequestDuration,
+		httpRequestsInFlight,
+		rateLimitedRequests,
+		dbOperationDuration,
+		imageProcessingDuration,
+		imageUploadedBytes,
+	)
+}
+
+// Serves the metrics in the Prometheus text format, behind a bearer token when metrics.token is set
+func handleMetrics() http.Handler {
+	metrics := promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := appConfig.Metrics.Token
+		if token != "" {
+			provided, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+				WriteJSON(w, http.StatusUnauthorized, ResponseMessage{Status: StatusCodeError, Message: "Invalid metrics token"})
+				return
+			}
+		}
+
+		metrics.ServeHTTP(w, r)
+	})
+}
+
+// The pattern a request was routed with, filled in by the sub-mux that served it
+type matchedRoute struct {
+	pattern string
+}
+
+type matchedRouteKey struct{}
+
+// Muxes route on their own copy of the request (sub-muxes behind a stripped prefix),
+// so each reports the pattern it matched (with the prefix added back) to withMetrics.
+// The innermost mux finishes first and its pattern is kept.
+func withRoutePrefix(prefix string, mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.ServeHTTP(w, r)
+
+		if route, ok := r.Context().Value(matchedRouteKey{}).(*matchedRoute); ok && route.pattern == "" && r.Pattern != "" {
+			route.pattern = prefix + routePath(r.Pattern)
+		}
+	})
+}
+
+// Counts and times every request by the route pattern it matched, so ids in paths don't create new series
+func withMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		httpRequestsInFlight.Inc()
+		defer httpRequestsInFlight.Dec()
+
+		route := &matchedRoute{}
+		r = r.WithContext(context.WithValue(r.Context(), matchedRouteKey{}, route))
+		writer := &statusWriter{ResponseWriter: w}
+
+		next.ServeHTTP(writer, r)
+
+		if route.pattern == "" {
+			route.pattern = "unmatched"
+		}
+
+		method := metricsMethod(r.Method)
+		httpRequestsTotal.WithLabelValues(method, route.pattern, strconv.Itoa(writer.Status())).Inc()
+		httpRequestDuration.WithLabelValues(method, route.pattern).Observe(time.Since(start).Seconds())
+	})
+}
+
+// Strips the method (and host) of a ServeMux pattern
+func routePath(pattern string) string {
+	if _, path, found := strings.Cut(pattern, " "); found {
+		pattern = path
+	}
+
+	if index := strings.Index(pattern, "/"); index > 0 {
+		pattern = pattern[index:]
+	}
+
+	return pattern
+}
+
+// Arbitrary methods would create a series each
+func metricsMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		return method
+	default:
+		return "OTHER"
+	}
+}
+
+func observeDBOperation(operation string, collection string, start time.Time) {
+	dbOperationDuration.WithLabelValues(operation, collection).Observe(time.Since(start).Seconds())
+}
+
+func observeImageProcessing(stage string, start time.Time) {
+	imageProcessingDuration.WithLabelValues(stage).Observe(time.Since(start).Seconds())
+}
+
+func bucketLabel(private bool) string {
+	if private {
+		return "private"
+	}
+
+	return "public"
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// A migration runs once per database, applied migrations are recorded by name in the migrations collection
+type Migration struct {
+	Name string
+	Run  func(ctx context.Context, db *mongo.Client) error
+}
+
+// Migrations run in order, new ones must be appended
+var migrations = []Migration{
+	{Name: "analytics_users_to_events", Run: migrateVisitorsToEvents},
+}
+
+func runMigrations(ctx context.Context, db *mongo.Client) error {
+	cmsDatabase := db.Database(CMS_DATABASE)
+
+	for _, migration := range migrations {
+		applied, err := getDBResource(ctx, cmsDatabase, CMS_C_MIGRATIONS, bson.M{"name": migration.Name})
+		if err != nil {
+			return err
+		}
+
+		if len(applied) != 0 {
+			continue
+		}
+
+		slog.InfoContext(ctx, "Running migration", "migration", migration.Name)
+		err = migration.Run(ctx, db)
+		if err != nil {
+			return err
+		}
+
+		_, err = createDBResource(ctx, cmsDatabase, CMS_C_MIGRATIONS, map[string]any{
+			"name":      migration.Name,
+			"appliedAt": bson.NewDateTimeFromTime(time.Now()),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSMTPPort      = 587
+	webhookNotifyTimeout = 10 * time.Second
+)
+
+// A report rendered both as plain text and HTML, notifiers send whichever they support
+type Report struct {
+	Subject string    `json:"subject"`
+	Text    string    `json:"text"`
+	HTML    string    `json:"html"`
+	SentAt  time.Time `json:"sentAt"`
+}
+
+type Notifier interface {
+	Notify(report *Report) error
+}
+
+// Picks the configured notifier (smtp, webhook or file), nil when reports are disabled.
+// The settings each notifier needs are checked when the configuration is validated.
+func initializeNotifier(reports ReportsConfig) (Notifier, error) {
+	switch reports.Notifier {
+	case "":
+		return nil, nil
+	case "smtp":
+		return &SMTPNotifier{
+			Host:       reports.SMTP.Host,
+			Port:       reports.SMTP.Port,
+			Username:   reports.SMTP.Username,
+			Password:   reports.SMTP.Password,
+			From:       reports.SMTP.From,
+			Recipients: reports.Recipients,
+		}, nil
+	case "webhook":
+		return &WebhookNotifier{Url: reports.WebhookURL, Client: &http.Client{Timeout: webhookNotifyTimeout}}, nil
+	case "file":
+		return &FileNotifier{Directory: reports.Directory}, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown report notifier %q", reports.Notifier))
+	}
+}
+
+// Mails the report as multipart/alternative, authenticating with PLAIN when a username is set.
+// net/smtp upgrades to TLS with STARTTLS whenever the server offers it.
+type SMTPNotifier struct {
+	Host       string
+	Port       int
+	Username   string
+	Password   string
+	From       string
+	Recipients []string
+}
+
+func (n *SMTPNotifier) Notify(report *Report) error {
+	var auth smtp.Auth
+	if n.Username != "" {
+		auth = smtp.PlainAuth("", n.Username, n.Password, n.Host)
+	}
+
+	message, err := n.message(report)
+	if err != nil {
+		return err
+	}
+
+	return smtp.SendMail(net.JoinHostPort(n.Host, fmt.Sprint(n.Port)), auth, n.From, n.Recipients, message)
+}
+
+func (n *SMTPNotifier) message(report *Report) ([]byte, error) {
+	boundary := rand.Text()
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", n.From)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(n.Recipients, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", report.Subject)
+	fmt.Fprintf(&message, "Date: %s\r\n", report.SentAt.Format(time.RFC1123Z))
+	fmt.Fprint(&message, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&message, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", boundary)
+
+	parts := []struct {
+		contentType string
+		body        string
+	}{
+		{"text/plain; charset=utf-8", report.Text},
+		{"text/html; charset=utf-8", report.HTML},
+	}
+
+	for _, part := range parts {
+		fmt.Fprintf(&message, "--%s\r\n", boundary)
+		fmt.Fprintf(&message, "Content-Type: %s\r\n", part.contentType)
+		fmt.Fprint(&message, "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+		writer := quotedprintable.NewWriter(&message)
+		if _, err := writer.Write([]byte(part.body)); err != nil {
+			return nil, err
+		}
+
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+
+		fmt.Fprint(&message, "\r\n")
+	}
+
+	fmt.Fprintf(&message, "--%s--\r\n", boundary)
+	return message.Bytes(), nil
+}
+
+// Posts the report as JSON, any status other than 2xx counts as a failure
+type WebhookNotifier struct {
+	Url    string
+	Client *http.Client
+}
+
+func (n *WebhookNotifier) Notify(report *Report) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	response, err := n.Client.Post(n.Url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return errors.New(fmt.Sprintf("Webhook responded with %v", response.Status))
+	}
+
+	return nil
+}
+
+// Writes the report into the directory as an .html and a .txt file, meant for testing the reports locally
+type FileNotifier struct {
+	Directory string
+}
+
+func (n *FileNotifier) Notify(report *Report) error {
+	err := os.MkdirAll(n.Directory, 0o755)
+	if err != nil {
+		return err
+	}
+
+	name := filepath.Join(n.Directory, "report-"+report.SentAt.UTC().Format("20060102T150405Z"))
+	err = os.WriteFile(name+".txt", []byte(report.Text), 0o644)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(name+".html", []byte(report.HTML), 0o644)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+// Expands to the ranges Cloudflare publishes at https://www.cloudflare.com/ips/
+const cloudflareProxies = "cloudflare"
+
+var cloudflareRanges = []string{
+	"173.245.48.0/20", "103.21.244.0/22", "103.22.200.0/22", "103.31.4.0/22", "141.101.64.0/18",
+	"108.162.192.0/18", "190.93.240.0/20", "188.114.96.0/20", "197.234.240.0/22", "198.41.128.0/17",
+	"162.158.0.0/15", "104.16.0.0/13", "104.24.0.0/14", "172.64.0.0/13", "131.0.72.0/22",
+	"2400:cb00::/32", "2606:4700::/32", "2803:f800::/32", "2405:b500::/32", "2405:8100::/32",
+	"2a06:98c0::/29", "2c0f:f248::/32",
+}
+
+var (
+	trustedProxiesOnce sync.Once
+	trustedProxies     []netip.Prefix
+)
+
+// Parses the trusted proxies, single addresses are turned into prefixes of their own
+func parseTrustedProxies(proxies []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(proxies))
+	for _, proxy := range proxies {
+		if proxy == cloudflareProxies {
+			cloudflare, err := parseTrustedProxies(cloudflareRanges)
+			if err != nil {
+				return nil, err
+			}
+
+			prefixes = append(prefixes, cloudflare...)
+			continue
+		}
+
+		if strings.Contains(proxy, "/") {
+			prefix, err := netip.ParsePrefix(proxy)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("%q isn't an address, a CIDR range or %v", proxy, cloudflareProxies))
+			}
+
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(proxy)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%q isn't an address, a CIDR range or %v", proxy, cloudflareProxies))
+		}
+
+		prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+
+	return prefixes, nil
+}
+
+// Whether the request was sent by one of the proxies of server.trustedProxies, only they may set the client's
+// address and location headers. The configuration is validated at startup, so it can't fail to parse here.
+func fromTrustedProxy(r *http.Request) bool {
+	trustedProxiesOnce.Do(func() {
+		trustedProxies, _ = parseTrustedProxies(appConfig.Server.TrustedProxies)
+	})
+
+	if len(trustedProxies) == 0 {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+
+	addr = addr.Unmap()
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const defaultRateLimitCacheSize = 10000
+
+// Routes sharing a limit, every client has a bucket of tokens per group
+type RateLimitGroup string
+
+const (
+	RateLimitGroupPublic    RateLimitGroup = "public"
+	RateLimitGroupAnalytics RateLimitGroup = "analytics"
+	RateLimitGroupLogin     RateLimitGroup = "login"
+	// Replaces the group of the route for callers with valid credentials
+	RateLimitGroupAuthenticated RateLimitGroup = "authenticated"
+)
+
+var rateLimitGroups = []RateLimitGroup{RateLimitGroupPublic, RateLimitGroupAnalytics, RateLimitGroupLogin, RateLimitGroupAuthenticated}
+
+// Buckets left alone until they're full again are deleted
+var rateLimitIndexes = []mongo.IndexModel{
+	{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+}
+
+// A bucket holds up to Burst tokens and gets Requests tokens back per minute, every request takes one
+type RateLimit struct {
+	Requests int
+	Burst    int
+}
+
+func (l RateLimit) Capacity() float64 {
+	if l.Burst == 0 {
+		return float64(l.Requests)
+	}
+
+	return float64(l.Burst)
+}
+
+func (l RateLimit) PerSecond() float64 {
+	return float64(l.Requests) / 60
+}
+
+// Adds the tokens earned since the bucket was last used
+func (l RateLimit) Refill(tokens float64, elapsed time.Duration) float64 {
+	return min(l.Capacity(), tokens+max(elapsed.Seconds(), 0)*l.PerSecond())
+}
+
+// Keeps the buckets of the clients, Take returns the tokens left and whether one could be taken
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, limit RateLimit) (float64, bool, error)
+}
+
+// Keeps the buckets in the memory of the instance, each instance limits clients on its own
+type MemoryRateLimitStore struct {
+	buckets *LRUCache[string, *tokenBucket]
+}
+
+type tokenBucket struct {
+	mu        sync.Mutex
+	tokens    float64
+	updatedAt time.Time
+}
+
+func newMemoryRateLimitStore(size int) *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: newLRUCache[string, *tokenBucket](size)}
+}
+
+func (s *MemoryRateLimitStore) Take(ctx context.Context, key string, limit RateLimit) (float64, bool, error) {
+	bucket := s.buckets.GetOrAdd(key, func() *tokenBucket {
+		return &tokenBucket{tokens: limit.Capacity(), updatedAt: time.Now()}
+	})
+
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+
+	now := time.Now()
+	bucket.tokens = limit.Refill(bucket.tokens, now.Sub(bucket.updatedAt))
+	bucket.updatedAt = now
+
+	if bucket.tokens < 1 {
+		return bucket.tokens, false, nil
+	}
+
+	bucket.tokens--
+	return bucket.tokens, true, nil
+}
+
+// Keeps the buckets in Mongo so every instance shares them. The bucket is refilled and taken from in a single
+// update using the clock of the database, so instances with drifting clocks agree on it.
+type MongoRateLimitStore struct {
+	db *mongo.Client
+}
+
+type rateLimitBucket struct {
+	Tokens  float64 `bson:"tokens"`
+	Allowed bool    `bson:"allowed"`
+}
+
+func (s *MongoRateLimitStore) Take(ctx context.Context, key string, limit RateLimit) (float64, bool, error) {
+	capacity := limit.Capacity()
+	elapsedSeconds := bson.M{"$divide": bson.A{bson.M{"$subtract": bson.A{"$$NOW", bson.M{"$ifNull": bson.A{"$updatedAt", "$$NOW"}}}}, 1000}}
+	untilFull := time.Duration(capacity / limit.PerSecond() * float64(time.Second))
+
+	update := bson.A{
+		bson.M{"$set": bson.M{
+			"tokens": bson.M{"$min": bson.A{capacity, bson.M{"$add": bson.A{
+				bson.M{"$ifNull": bson.A{"$tokens", capacity}},
+				bson.M{"$multiply": bson.A{elapsedSeconds, limit.PerSecond()}},
+			}}}},
+			"updatedAt": "$$NOW",
+		}},
+		bson.M{"$set": bson.M{"allowed": bson.M{"$gte": bson.A{"$tokens", 1}}}},
+		bson.M{"$set": bson.M{
+			"tokens":    bson.M{"$cond": bson.A{"$allowed", bson.M{"$subtract": bson.A{"$tokens", 1}}, "$tokens"}},
+			"expiresAt": bson.M{"$add": bson.A{"$$NOW", untilFull.Milliseconds()}},
+		}},
+	}
+
+	cmsDatabase := s.db.Database(CMS_DATABASE)
+	bucket, err := upsertAndGetDBResource[rateLimitBucket](ctx, cmsDatabase, CMS_C_RATE_LIMITS, bson.M{"_id": key}, update)
+	// Two instances creating the same bucket at once, the one that lost takes from the bucket of the other
+	if mongo.IsDuplicateKeyError(err) {
+		bucket, err = upsertAndGetDBResource[rateLimitBucket](ctx, cmsDatabase, CMS_C_RATE_LIMITS, bson.M{"_id": key}, update)
+	}
+
+	if err != nil {
+		return 0, false, err
+	}
+
+	return bucket.Tokens, bucket.Allowed, nil
+}
+
+// Limits the requests of each client per route group. A nil limiter lets every request through.
+type RateLimiter struct {
+	store  RateLimitStore
+	limits map[RateLimitGroup]RateLimit
+}
+
+func initializeRateLimiter(config RateLimitConfig, db *mongo.Client) (*RateLimiter, error) {
+	var store RateLimitStore
+	switch config.Store {
+	case "none":
+		return nil, nil
+	case "memory":
+		store = newMemoryRateLimitStore(config.CacheSize)
+	case "mongo":
+		store = &MongoRateLimitStore{db: db}
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown rate limit store %q", config.Store))
+	}
+
+	return &RateLimiter{store: store, limits: config.Limits()}, nil
+}
+
+// Takes a token from the client's bucket of the group before serving the request, or responds with 429 when it's empty.
+// Clients are told apart by IP (Cf-Connecting-Ip from trusted proxies), callers with valid credentials share the
+// authenticated bucket instead and credentials yet to be validated count as login attempts.
+// X-RateLimit-Limit is the size of the bucket, X-RateLimit-Remaining the tokens left
+// and X-RateLimit-Reset the seconds until it's full again.
+func (l *RateLimiter) Limit(group RateLimitGroup, next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		group, key := group, "ip:"+clientIp(r)
+		if hasValidatedCredentials(r) {
+			group, key = RateLimitGroupAuthenticated, "admin"
+		} else if r.Header.Get("Authorization") != "" {
+			// Guessing the password on any route is limited like logging in
+			group = RateLimitGroupLogin
+		}
+
+		limit := l.limits[group]
+		if limit.Requests == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Mongo being down shouldn't take the site down with it
+		tokens, allowed, err := l.store.Take(r.Context(), string(group)+" "+key, limit)
+		if err != nil {
+			slog.WarnContext(r.Context(), "Error while rate limiting, the request is let through", "group", group, "error", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		untilFull := (limit.Capacity() - tokens) / limit.PerSecond()
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(int(limit.Capacity())))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(int(math.Floor(tokens))))
+		w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(untilFull))))
+
+		if allowed == false {
+			retryAfter := int(math.Ceil((1 - tokens) / limit.PerSecond()))
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			rateLimitedRequests.WithLabelValues(string(group)).Inc()
+
+			WriteError(w, r, newAPIError(ErrorCodeRateLimited, fmt.Sprintf("Too many requests, retry in %v seconds", retryAfter)))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
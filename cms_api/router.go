@@ -7,22 +7,20 @@ import (
 	"go.mongodb.org/mongo-driver/v2/mongo"
 )
 
-func addRoutes(mux *http.ServeMux, db *mongo.Client, imageStore *ImageStore) {
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		WriteJSON(w, http.StatusOK, ResponseMessage{
-			Status: StatusCodeOk,
-			Message: "Service healthy",
-		})
-	})
+func addRoutes(mux *http.ServeMux, db *mongo.Client, imageStore *ImageStore, geo GeoProvider, bots *BotDetector, broker *AnalyticsBroker, notifier Notifier, health *HealthChecker, limiter *RateLimiter) {
+	// /health stays a liveness check for the probes set up before it was split
+	mux.HandleFunc("/health", getLiveness)
+	mux.HandleFunc("GET /health/live", getLiveness)
+	mux.HandleFunc("GET /health/ready", getReadiness(health))
+
+	mux.Handle("GET /metrics", handleMetrics())
 
-	mux.Handle("/v1/api/", http.StripPrefix("/v1/api", handleCollectionRoutes(db, imageStore)))
-	mux.Handle("/v1/api/auth/", http.StripPrefix("/v1/api/auth", handleAuthRoutes(db)))
-	mux.Handle("/v1/api/analytics/", http.StripPrefix("/v1/api/analytics", handleAnalyticsRoutes(db)))
+	mux.Handle("/v1/api/", http.StripPrefix("/v1/api", limiter.Limit(RateLimitGroupPublic, withRoutePrefix("/v1/api", handleCollectionRoutes(db, imageStore)))))
+	mux.Handle("/v1/api/auth/", http.StripPrefix("/v1/api/auth", limiter.Limit(RateLimitGroupLogin, withRoutePrefix("/v1/api/auth", handleAuthRoutes(db)))))
+	mux.Handle("/v1/api/analytics/", http.StripPrefix("/v1/api/analytics", limiter.Limit(RateLimitGroupAnalytics, withRoutePrefix("/v1/api/analytics", handleAnalyticsRoutes(db, geo, bots, broker, notifier)))))
+	mux.Handle("/v1/api/media/", http.StripPrefix("/v1/api/media", limiter.Limit(RateLimitGroupPublic, withRoutePrefix("/v1/api/media", handleMediaRoutes(db, imageStore)))))
 
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		WriteJSON(w, http.StatusNotFound, ResponseMessage{
-			Status:  StatusCodeError,
-			Message: fmt.Sprintf("Request not found for %q", r.URL.Path),
-		})
+		WriteError(w, r, newAPIError(ErrorCodeRouteNotFound, fmt.Sprintf("Request not found for %q", r.URL.Path)))
 	})
 }
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// A job runs in the background as soon as the scheduler starts and then every interval.
+// A run never overlaps with the previous run of the same job.
+// The context of a run is cancelled when the scheduler stops.
+type Job struct {
+	Name     string
+	Interval time.Duration
+	Run      func(ctx context.Context, db *mongo.Client) error
+}
+
+type Scheduler struct {
+	db     *mongo.Client
+	jobs   []Job
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newScheduler(db *mongo.Client, jobs ...Job) *Scheduler {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Scheduler{db: db, jobs: jobs, ctx: ctx, cancel: cancel}
+}
+
+func (s *Scheduler) Start() {
+	for _, job := range s.jobs {
+		s.wg.Add(1)
+		go s.loop(job)
+	}
+}
+
+// Stops scheduling new runs, cancels the running ones and waits for them to return
+func (s *Scheduler) Stop() {
+	s.cancel()
+	s.wg.Wait()
+}
+
+func (s *Scheduler) loop(job Job) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(job.Interval)
+	defer ticker.Stop()
+
+	for {
+		s.run(job)
+
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Runs the job once, recording when it ran and how it ended in the jobs collection
+func (s *Scheduler) run(job Job) {
+	startedAt := time.Now()
+	err := job.Run(s.ctx, s.db)
+
+	lastError := ""
+	if err != nil {
+		lastError = err.Error()
+		slog.ErrorContext(s.ctx, "Job failed", "job", job.Name, "error", err)
+	}
+
+	// Saved even when the run was cancelled by stopping
+	err = saveJobState(context.Background(), s.db, job.Name, bson.M{
+		"lastRunAt":   bson.NewDateTimeFromTime(startedAt),
+		"lastRunTook": time.Since(startedAt).Milliseconds(),
+		"lastError":   lastError,
+	})
+	if err != nil {
+		slog.Error("Error while saving the job state", "job", job.Name, "error", err)
+	}
+}
+
+// Returns the state saved by the job, empty when it never ran
+func getJobState(ctx context.Context, db *mongo.Client, name string) (map[string]interface{}, error) {
+	states, err := getDBResource(ctx, db.Database(CMS_DATABASE), CMS_C_JOBS, bson.M{"name": name})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(states) == 0 {
+		return map[string]interface{}{}, nil
+	}
+
+	return states[0], nil
+}
+
+func saveJobState(ctx context.Context, db *mongo.Client, name string, fields bson.M) error {
+	return upsertDBResource(ctx, db.Database(CMS_DATABASE), CMS_C_JOBS, bson.M{"name": name}, bson.M{"$set": fields})
+}
@@ -5,7 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 
 	"go.mongodb.org/mongo-driver/v2/mongo"
@@ -19,71 +19,72 @@ const (
 )
 
 type ResponseMessage struct {
-	Status  StatusCode `json:"status"`
-	Message string     `json:"message"`
-	Data    any        `json:"data"`
+	Status StatusCode `json:"status"`
+	// Set on errors only
+	Code    ErrorCode `json:"code,omitempty"`
+	Message string    `json:"message"`
+	Data    any       `json:"data"`
 }
 
 type Misses map[string]string
 
 type Validator interface {
-	// A validator is valid only when len(errors) === 0
-	// Each miss should be mapped to the corresponding validator field if it's related to one
-	Validate(r *http.Request, db *mongo.Client) Misses
+	// A validator is valid only when len(misses) === 0, the error is reserved for failures to validate
+	// Each miss should be mapped to the corresponding validator field
+	Validate(r *http.Request, db *mongo.Client) (Misses, error)
 }
 
 func WriteJSON[T any](w http.ResponseWriter, httpStatus int, data T) {
-	w.Header().Add("Content-Type", "application/json")
-	w.Header().Add("Access-Control-Allow-Origin", "*")
+	writeJSONAs(w, httpStatus, "application/json", data)
+}
+
+func writeJSONAs[T any](w http.ResponseWriter, httpStatus int, contentType string, data T) {
+	w.Header().Set("Content-Type", contentType)
 
 	response, err := json.Marshal(data)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, `{ "message": "Error while stringifying result: %v" }`, err.Error())
-		log.Printf("Error while encode response data: %v", err.Error())
+		slog.Error("Error while encoding response data", "error", err)
 		return
 	}
 
 	w.WriteHeader(httpStatus)
 	if _, err := w.Write(response); err != nil {
-		log.Println("Error while sending response:", err)
+		slog.Warn("Error while sending response", "error", err)
 	}
 }
 
+// Not a standard status, used (like nginx) when the client went away before the response was ready
+const StatusClientClosedRequest = 499
+
 func ReadJSON[T any](s string) (T, error) {
 	var data T
 	err := json.Unmarshal([]byte(s), &data)
 	return data, err
 }
 
+// The error is an APIError when the body is missing, malformed or invalid
 func ReadBodyJSON[T Validator](r *http.Request, db *mongo.Client) (T, Misses, error) {
 	var data T
 	err := json.NewDecoder(r.Body).Decode(&data)
-	if err != nil {
-		return data, nil, err
+	// Handlers with optional bodies look for io.EOF
+	if errors.Is(err, io.EOF) {
+		return data, nil, &APIError{Code: ErrorCodeInvalidBody, Message: "No body was provided", Cause: io.EOF}
 	}
 
-	if err == io.EOF {
-		return data, nil, errors.New("No body was provided")
+	if err != nil {
+		return data, nil, newAPIError(ErrorCodeInvalidBody, "The body must be valid JSON: "+err.Error())
 	}
 
+	misses, err := data.Validate(r, db)
 	if err != nil {
 		return data, nil, err
 	}
 
-	misses := data.Validate(r, db)
-
 	if len(misses) != 0 {
-		return data, misses, errors.New("Invalid Syntax")
+		return data, misses, validationError(ErrorCodeValidationFailed, "The body has invalid fields", misses)
 	}
 
 	return data, misses, nil
 }
-
-func handlePrefligh() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Add("Access-Control-Allow-Origin", "*")
-		w.Header().Add("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Add("Access-Control-Allow-Headers", "*")
-	}
-}
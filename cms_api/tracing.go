@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const defaultServiceName = "portfolio-cms"
+
+// Resolved through the global provider, so spans started before tracing is initialized are simply dropped
+var tracer = otel.Tracer("github.com/dalebezolli/portfolio-new")
+
+// Sets up the exporter of the tracing.exporter setting, W3C trace context is propagated even when tracing is disabled.
+// The returned function flushes the pending spans and must be called before exiting.
+func initializeTracing(config TracingConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch config.Exporter {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		options := make([]otlptracehttp.Option, 0)
+		if config.Endpoint != "" {
+			options = append(options, otlptracehttp.WithEndpointURL(config.Endpoint))
+		}
+		exporter, err = otlptracehttp.New(context.Background(), options...)
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout), stdouttrace.WithPrettyPrint())
+	default:
+		err = errors.New(fmt.Sprintf("Unknown tracing exporter %q", config.Exporter))
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.New(context.Background(),
+		resource.WithAttributes(semconv.ServiceName(config.ServiceName)),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio()))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// Starts a span per request, continuing the trace of the traceparent header, named after the route pattern once it's known
+func withTracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(r.Method),
+			semconv.URLPath(r.URL.Path),
+		))
+		defer span.End()
+
+		writer := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(writer, r.WithContext(ctx))
+
+		if route, ok := ctx.Value(matchedRouteKey{}).(*matchedRoute); ok && route.pattern != "" {
+			span.SetName(r.Method + " " + route.pattern)
+			span.SetAttributes(semconv.HTTPRoute(route.pattern))
+		}
+
+		status := writer.Status()
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
+
+// Starts the span of a database helper, the returned function ends it and records the duration metric
+func startDBOperation(ctx context.Context, operation string, collection string) (context.Context, func()) {
+	start := time.Now()
+	ctx, span := tracer.Start(ctx, "mongo "+operation+" "+collection, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		semconv.DBSystemMongoDB,
+		semconv.DBOperationName(operation),
+		semconv.DBCollectionName(collection),
+		semconv.DBNamespace(CMS_DATABASE),
+	))
+
+	return ctx, func() {
+		span.End()
+		observeDBOperation(operation, collection, start)
+	}
+}
+
+// Starts the span of an object store request
+func startStorageSpan(ctx context.Context, operation string, key string, private bool) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "r2 "+operation, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("storage.operation", operation),
+		attribute.String("storage.key", key),
+		attribute.String("storage.bucket", bucketLabel(private)),
+	))
+}
+
+// Ends the span, marking it as failed when there's an error
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
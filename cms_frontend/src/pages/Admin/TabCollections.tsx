@@ -5,7 +5,7 @@ import { useGlobalState } from "../../state/GlobalState";
 import { STable, TBody, THead, THeadRow, TRow } from "../../components/SimpleTable";
 import Input from "../../components/Input";
 import { Collection, CollectionAttribute, CollectionRecord } from "../../types";
-import { del, post, put } from "../../utils/network";
+import { del, post, put, upload } from "../../utils/network";
 import { Checkbox } from "../../components/Checkbox";
 import Select from "../../components/Select";
 import { selectTypes } from "../../utils/constants";
@@ -412,13 +412,16 @@ function RecordEditor() {
 									let target = e.currentTarget;
 									const file = target.files![0]
 
-									let base64Img = await new Promise((resolve: (value: string) => void) => {
-										let reader = new FileReader();
-										reader.onload = _ => resolve(reader.result as string)
-										reader.readAsDataURL(file)
-									});
+									const collectionPath = collections[selectedCollection].path;
+									const uploadUrl = new URL(`${import.meta.env.VITE_CMS_URL}/media/upload`);
+									uploadUrl.searchParams.set("collection", collectionPath);
+									uploadUrl.searchParams.set("attribute", name);
+									uploadUrl.searchParams.set("filename", file.name);
 
-									updateRecord(base64Img, name)
+									const response = await upload<{url: string}>({url: uploadUrl, file});
+									if(response?.data == null) return;
+
+									updateRecord(response.data.url, name)
 								}} />}
 								{type == "mdx" && <TextArea className="w-full" value={editingRecord[name]} onChange={(e) => updateRecord(e.currentTarget.value, name)} />}
 							</div>
@@ -12,6 +12,27 @@ export async function put<T>({url, headers, body}: BodiedRequestProps) {
 	return await networkRequest<T>({url, headers: finalHeaders, body, method: "PUT"});
 }
 
+// Sends the file as the raw body, the server sniffs its type from the content
+export async function upload<T>({url, headers, file}: UploadRequestProps) {
+	const finalHeaders = concatHeaders(defaultHeaders, headers ?? new Headers());
+
+	try {
+		const serverRequest = await fetch(url, {headers: finalHeaders, method: "POST", body: file});
+		if(serverRequest == null || serverRequest?.ok == false) {
+			return null;
+		}
+
+		const response = await serverRequest.json() as CMSResponse<T>;
+		if(response.status != "ok") {
+			return null;
+		}
+
+		return response;
+	} catch {
+		return null;
+	}
+}
+
 export async function del({url, headers}: RequestProps) {
 	await networkRequest({url, headers, method: "DELETE"});
 	return null;
@@ -57,6 +78,10 @@ type BodiedRequestProps = Omit<RequestProps, "body"> & {
 	body: {[key: string]: any};
 }
 
+type UploadRequestProps = Omit<RequestProps, "body"> & {
+	file: File;
+};
+
 const defaultHeaders = new Headers([
 	["Accept", "application/json"],
 ]);